@@ -7,7 +7,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 )
 
 func main() {
@@ -17,7 +20,7 @@ func main() {
 
 	flag.Parse()
 
-	address := fmt.Sprintf("%s:%s", *ip, *port)
+	address := net.JoinHostPort(*ip, *port)
 
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
@@ -27,6 +30,7 @@ func main() {
 
 	scanner := bufio.NewScanner(os.Stdin)
 	respScanner := bufio.NewScanner(conn)
+	respScanner.Split(protocol.ScanLines)
 	//fmt.Print(">> ")
 
 	for {
@@ -52,6 +56,13 @@ func main() {
 
 		if respScanner.Scan() {
 			fmt.Println(respScanner.Text())
+
+			// a multi-line reply starts with the number of lines that follow
+			if lines, err := strconv.Atoi(strings.TrimPrefix(respScanner.Text(), "*")); err == nil && strings.HasPrefix(respScanner.Text(), "*") {
+				for i := 0; i < lines && respScanner.Scan(); i++ {
+					fmt.Println(respScanner.Text())
+				}
+			}
 		}
 		if err := respScanner.Err(); err != nil {
 			fmt.Println(err.Error())
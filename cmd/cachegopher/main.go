@@ -10,7 +10,9 @@ import (
 	"syscall"
 
 	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/client"
 	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/crosscluster"
 	"github.com/voukatas/CacheGopher/pkg/logger"
 	"github.com/voukatas/CacheGopher/pkg/replication"
 	"github.com/voukatas/CacheGopher/pkg/server"
@@ -71,6 +73,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(cfg.CrossCluster) > 0 && cfg.Common.ClusterId == "" {
+		fmt.Println("The cluster_id is required when crossCluster links are configured")
+		os.Exit(1)
+	}
+
 	slogger, cleanup := logger.SetupLogger(cfg.Logging.File, cfg.Logging.Level, cfg.Common.Production)
 
 	defer cleanup()
@@ -91,15 +98,41 @@ func main() {
 		os.Exit(1)
 	}
 
+	defer replicator.Stop()
+
 	// Create cacheServer
 	cacheServer := server.NewServer(localCache, slogger, replicator, isPrimary, primaryAddress)
 
-	if *recover {
+	cacheServer.SetClusterId(cfg.Common.ClusterId)
+
+	// the shard of a secondary is the one of its primary
+	if isPrimary {
+		cacheServer.SetShards(cfg, myConfig.Address)
+	} else {
+		cacheServer.SetShards(cfg, primaryAddress)
+	}
+
+	if err := cacheServer.SetKeyspaceEvents(cfg.Common.KeyspaceEvents); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	// A primary must recover before it starts listening, otherwise the secondaries would sync an empty state from it.
+	// The secondaries don't need the flag, they always receive the full state when they connect to the primary
+	if *recover && isPrimary {
 		fmt.Println("Recovery mode enabled")
 		cacheServer.HandleRecovery(myConfig)
 		fmt.Println("Recovery mode ended")
 	}
 
+	// the cross cluster links forward only the strings, the primary rejects the collections before anyone can write one
+	if isPrimary && len(cfg.CrossCluster) > 0 {
+		if err := cacheServer.EnableCrossCluster(); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	listener, err := net.Listen("tcp", myConfig.Address)
 	if err != nil {
 		fmt.Println("Failed to start server: " + err.Error())
@@ -110,12 +143,40 @@ func main() {
 
 	slogger.Info("Server is running on " + myConfig.Address)
 
+	cacheServer.StartReplication()
+
+	// every primary forwards its own writes to the remote clusters
+	if isPrimary {
+		for _, linkConfig := range cfg.CrossCluster {
+			remoteCfg, err := config.LoadConfig(linkConfig.Config)
+			if err != nil {
+				fmt.Println("Failed to read the configuration of cluster " + linkConfig.Name + ": " + err.Error())
+				os.Exit(1)
+			}
+
+			remoteClient, err := client.NewClientWithConfig(remoteCfg, false)
+			if err != nil {
+				fmt.Println("Failed to create a client for cluster " + linkConfig.Name + ": " + err.Error())
+				os.Exit(1)
+			}
+			defer remoteClient.Close()
+
+			link := crosscluster.NewLink(linkConfig.Name, cfg.Common.ClusterId, remoteClient, cacheServer.CrossClusterState, slogger)
+			link.Start(replicator)
+			defer link.Stop()
+
+			slogger.Info("Cross cluster link to " + linkConfig.Name + " started")
+		}
+	}
+
 	// handle signals for gracefull shutdown
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
 
 	done := make(chan struct{})
 
+	go cacheServer.ExpireKeys(done)
+
 	go func() {
 		<-stopChan
 		slogger.Info("Graceful Shutdown...")
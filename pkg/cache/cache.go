@@ -3,19 +3,148 @@ package cache
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Cache interface {
 	Set(key string, value string)
+	SetEntry(key string, entry Entry)
 	Get(key string) (string, bool)
 	Delete(key string) bool
 	Flush()
 	Keys() []string
+	// Scan examines up to count keys after cursor, zero to start, and returns the keys that match and the next cursor,
+	// zero when the iteration is complete. A nil match accepts every key
+	Scan(cursor uint64, count int, match func(key string) bool) ([]string, uint64)
 	GetSnapshot() map[string]string
+	// RemoveExpired examines up to count keys and removes the ones that expired, it returns how many it removed. An
+	// expired key is removed anyway when it is accessed, this finds the ones that nobody accesses
+	RemoveExpired(count int) int
+	// Atomic runs fn while holding the lock of the cache, use it for read-modify-write operations
+	Atomic(fn func(s Store))
+	// SetListener registers the function that is notified about every change of the cache
+	SetListener(listener Listener)
 	Lock()
 	Unlock()
 }
 
+// Kind is the type of a value
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindHash
+	KindList
+	KindSet
+	KindZSet
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindHash:
+		return "hash"
+	case KindList:
+		return "list"
+	case KindSet:
+		return "set"
+	case KindZSet:
+		return "zset"
+	}
+
+	return "unknown"
+}
+
+// Entry is a value along with the metadata of the write that produced it
+type Entry struct {
+	Value string
+	// the type of the value, a hash, a list, a set or a sorted set is kept in Hash, List, Members or ZSet instead of
+	// Value. The collections are shared with the cache, so they can be changed only inside Atomic and the change must
+	// be stored with Set
+	Kind    Kind
+	Hash    map[string]string
+	List    []string
+	Members map[string]struct{}
+	ZSet    *ZSet
+	// hybrid logical clock timestamp of the write, zero if it is unknown
+	Timestamp uint64
+	// the cluster that the write originated from
+	Origin string
+	// the entry is removed on the first access after this moment, zero means that it never expires
+	ExpiresAt time.Time
+	// the version of the value, unique in the cache. A write with a zero version is assigned the next one, a write
+	// with a version keeps it, that is how a secondary stores the versions of its primary
+	Version uint64
+}
+
+func (e Entry) isExpired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// size is the part of the capacity of the cache that the entry takes, a string counts one and a collection one per element
+func (e Entry) size() int {
+	size := 1
+	switch e.Kind {
+	case KindHash:
+		size = len(e.Hash)
+	case KindList:
+		size = len(e.List)
+	case KindSet:
+		size = len(e.Members)
+	case KindZSet:
+		size = e.ZSet.Len()
+	}
+
+	return max(size, 1)
+}
+
+// EventType tells why a key changed
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventDelete
+	EventEvict
+	EventExpire
+	// the whole cache was flushed, the key is empty
+	EventFlush
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "del"
+	case EventEvict:
+		return "evicted"
+	case EventExpire:
+		return "expired"
+	case EventFlush:
+		return "flush"
+	}
+
+	return "unknown"
+}
+
+// Listener is called for every change while the lock of the cache is held, so it must be fast and it must not use the cache
+type Listener func(event EventType, key string)
+
+// Store is the view of the cache that is handed to Atomic. The lock is already held so it must not be used outside of the callback
+type Store interface {
+	// Get doesn't change the eviction order
+	Get(key string) (Entry, bool)
+	// Touch marks the key as recently used
+	Touch(key string)
+	// Set returns the version of the stored entry
+	Set(key string, entry Entry) uint64
+	Delete(key string) bool
+	// Flush removes every key
+	Flush()
+	Keys() []string
+}
+
 func NewCache(cacheType string, capacity int) (Cache, error) {
 	if capacity < 1 {
 		return nil, fmt.Errorf("capacity should be more than 1")
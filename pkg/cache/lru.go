@@ -2,14 +2,29 @@ package cache
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type CacheItem struct {
-	key   string
-	value string
-	prev  *CacheItem
-	next  *CacheItem
+	key       string
+	value     string
+	timestamp uint64
+	origin    string
+	expiresAt time.Time
+	version   uint64
+	kind      Kind
+	hash      map[string]string
+	list      []string
+	members   map[string]struct{}
+	zset      *ZSet
+	prev      *CacheItem
+	next      *CacheItem
+	// the part of the capacity that the item takes
+	size int
+	// the position of the item in the scan order
+	seq uint64
 }
 
 func NewCacheItem(key string, value string) *CacheItem {
@@ -25,12 +40,27 @@ func NewCacheItem(key string, value string) *CacheItem {
 type LRUCache struct {
 	store    map[string]*CacheItem
 	capacity int
+	// the sum of the sizes of the items, a collection takes one per element
+	used     int
 	head     *CacheItem
 	tail     *CacheItem
 	lock     sync.RWMutex
+	listener Listener
+	// the keys in the order they were added, a SCAN cursor is the seq of the last key it returned. The removed keys
+	// are left behind and dropped once they are the majority, the seqs don't change so the cursors stay valid
+	order   []scanEntry
+	stale   int
+	lastSeq uint64
+	// the last version that was assigned or stored, it isn't reset by a Flush so a version is never reused
+	lastVersion uint64
 	//logger   logger.Logger
 }
 
+type scanEntry struct {
+	seq uint64
+	key string
+}
+
 func NewLRUCache(capacity int) Cache {
 	return &LRUCache{
 		store:    make(map[string]*CacheItem, capacity),
@@ -40,6 +70,96 @@ func NewLRUCache(capacity int) Cache {
 	}
 }
 
+func (item *CacheItem) entry() Entry {
+	return Entry{
+		Value:     item.value,
+		Kind:      item.kind,
+		Hash:      item.hash,
+		List:      item.list,
+		Members:   item.members,
+		ZSet:      item.zset,
+		Timestamp: item.timestamp,
+		Origin:    item.origin,
+		ExpiresAt: item.expiresAt,
+		Version:   item.version,
+	}
+}
+
+// store copies the entry to the item
+func (item *CacheItem) store(entry Entry) {
+	item.value = entry.Value
+	item.kind = entry.Kind
+	item.hash = entry.Hash
+	item.list = entry.List
+	item.members = entry.Members
+	item.zset = entry.ZSet
+	item.timestamp = entry.Timestamp
+	item.origin = entry.Origin
+	item.expiresAt = entry.ExpiresAt
+	item.version = entry.Version
+	item.size = entry.size()
+}
+
+// SetListener
+func (lru *LRUCache) SetListener(listener Listener) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+
+	lru.listener = listener
+}
+
+// notify
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) notify(event EventType, key string) {
+	if lru.listener != nil {
+		lru.listener(event, key)
+	}
+}
+
+// lookup returns the item of the key, an expired item is removed
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) lookup(key string) (*CacheItem, bool) {
+	item, exists := lru.store[key]
+	if !exists {
+		return nil, false
+	}
+
+	if item.entry().isExpired(time.Now()) {
+		lru.removeItem(item)
+		lru.notify(EventExpire, key)
+		return nil, false
+	}
+
+	return item, true
+}
+
+// removeItem removes the item from the store and the queue
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) removeItem(item *CacheItem) {
+	delete(lru.store, item.key)
+	lru.removeItemFromQ(item)
+	lru.used -= item.size
+
+	lru.stale++
+	if lru.stale > len(lru.order)/2 {
+		lru.compactOrder()
+	}
+}
+
+// compactOrder drops the removed keys from the scan order
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) compactOrder() {
+	order := make([]scanEntry, 0, len(lru.store))
+	for _, entry := range lru.order {
+		if item, exists := lru.store[entry.key]; exists && item.seq == entry.seq {
+			order = append(order, entry)
+		}
+	}
+
+	lru.order = order
+	lru.stale = 0
+}
+
 // removeItemFromQ
 // Note: This method does not handle synchronization and expects the caller to manage locking
 func (lru *LRUCache) removeItemFromQ(item *CacheItem) {
@@ -96,29 +216,68 @@ func (lru *LRUCache) moveToFrontOfQ(item *CacheItem) {
 
 // Set
 func (lru *LRUCache) Set(key string, value string) {
+	lru.SetEntry(key, Entry{Value: value})
+}
+
+// SetEntry
+func (lru *LRUCache) SetEntry(key string, entry Entry) {
 	lru.lock.Lock()
 	defer lru.lock.Unlock()
 
+	lru.set(key, entry)
+}
+
+// set stores the entry and returns its version
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) set(key string, entry Entry) uint64 {
+
+	if entry.Version == 0 {
+		lru.lastVersion++
+		entry.Version = lru.lastVersion
+	} else if entry.Version > lru.lastVersion {
+		// a replicated version, the versions of this cache continue after it
+		lru.lastVersion = entry.Version
+	}
+
 	if item, exists := lru.store[key]; exists {
 		//fmt.Println("SET item exists")
 		lru.moveToFrontOfQ(item)
-		item.value = value
-		return
+		lru.used -= item.size
+		item.store(entry)
+		lru.used += item.size
+		lru.notify(EventSet, key)
+		// a collection that grew can push other keys out, never the item itself
+		lru.evict(0, item)
+		return entry.Version
 
 	}
 
 	//fmt.Println("SET item doesn't exists")
-	newItem := NewCacheItem(key, value)
-	if len(lru.store) >= lru.capacity {
-		//fmt.Println("SET item capacity reached, evict")
-		// evict the tail
-		delete(lru.store, lru.tail.key)
-		lru.removeItemFromQ(lru.tail)
-	}
+	newItem := NewCacheItem(key, entry.Value)
+	newItem.store(entry)
+	lru.evict(newItem.size, nil)
 
+	lru.lastSeq++
+	newItem.seq = lru.lastSeq
+	lru.order = append(lru.order, scanEntry{seq: newItem.seq, key: key})
 	lru.store[key] = newItem
+	lru.used += newItem.size
 	lru.addItemToFrontOfQ(newItem)
+	lru.notify(EventSet, key)
 
+	return entry.Version
+}
+
+// evict removes the least recently used items until there is space for size more, keep is never removed. An item
+// that is larger than the capacity on its own is kept
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) evict(size int, keep *CacheItem) {
+	for lru.used+size > lru.capacity && lru.tail != nil && lru.tail != keep {
+		//fmt.Println("SET item capacity reached, evict")
+		evicted := lru.tail.key
+		lru.removeItem(lru.tail)
+		lru.notify(EventEvict, evicted)
+	}
 }
 
 func (lru *LRUCache) Lock() {
@@ -134,7 +293,7 @@ func (lru *LRUCache) Get(key string) (string, bool) {
 	lru.lock.Lock()
 	defer lru.lock.Unlock()
 
-	if item, exists := lru.store[key]; exists {
+	if item, exists := lru.lookup(key); exists {
 		//fmt.Println("GET key found")
 		lru.moveToFrontOfQ(item)
 		return item.value, true
@@ -145,14 +304,18 @@ func (lru *LRUCache) Get(key string) (string, bool) {
 
 }
 
-// GetSnapshot key-value records
+// GetSnapshot key-value records of the string values
 func (lru *LRUCache) GetSnapshot() map[string]string {
 	lru.lock.RLock()
 	defer lru.lock.RUnlock()
 
 	keyValMap := make(map[string]string, 0)
+	now := time.Now()
 
 	for k, v := range lru.store {
+		if v.kind != KindString || v.entry().isExpired(now) {
+			continue
+		}
 		keyValMap[k] = v.value
 	}
 
@@ -164,23 +327,61 @@ func (lru *LRUCache) Delete(key string) bool {
 	lru.lock.Lock()
 	defer lru.lock.Unlock()
 
-	item, exists := lru.store[key]
+	return lru.delete(key)
+}
+
+// delete
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) delete(key string) bool {
+
+	item, exists := lru.lookup(key)
 	if !exists {
 		return false
 	}
 
-	delete(lru.store, key)
-	lru.removeItemFromQ(item)
+	lru.removeItem(item)
+	lru.notify(EventDelete, key)
 
 	return true
 
 }
 
+// RemoveExpired
+func (lru *LRUCache) RemoveExpired(count int) int {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+
+	// the iteration of a map starts at a random key, so every call examines a different sample
+	expired := []*CacheItem{}
+	now := time.Now()
+	for _, item := range lru.store {
+		if count <= 0 {
+			break
+		}
+		count--
+		if item.entry().isExpired(now) {
+			expired = append(expired, item)
+		}
+	}
+
+	for _, item := range expired {
+		lru.removeItem(item)
+		lru.notify(EventExpire, item.key)
+	}
+
+	return len(expired)
+}
+
 // Flush
 func (lru *LRUCache) Flush() {
 	lru.lock.Lock()
 	defer lru.lock.Unlock()
 
+	lru.flush()
+}
+
+// flush is Flush while the lock is held
+func (lru *LRUCache) flush() {
 	// This might prevent potential memory leaks but it will slow down signifigantly the performance. Tradeoffs... consider a revisit on this
 	current := lru.head
 	for current != nil {
@@ -194,6 +395,10 @@ func (lru *LRUCache) Flush() {
 	lru.store = make(map[string]*CacheItem) // Reinitialize the map
 	lru.head = nil
 	lru.tail = nil
+	lru.order = nil
+	lru.stale = 0
+	lru.used = 0
+	lru.notify(EventFlush, "")
 }
 
 // Keys
@@ -201,13 +406,103 @@ func (lru *LRUCache) Keys() []string {
 	lru.lock.Lock()
 	defer lru.lock.Unlock()
 
+	return lru.keys()
+}
+
+// keys
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (lru *LRUCache) keys() []string {
 	keys := make([]string, 0, len(lru.store))
-	for key := range lru.store {
+	now := time.Now()
+	for key, item := range lru.store {
+		if item.entry().isExpired(now) {
+			continue
+		}
 		keys = append(keys, key)
 	}
 	return keys
 }
 
+// Scan examines up to count keys after the cursor and returns the ones that match along with the cursor of the next
+// call, zero when the iteration is complete. The keys are visited in the order they were added, so a key that
+// exists for the whole iteration is returned exactly once
+func (lru *LRUCache) Scan(cursor uint64, count int, match func(key string) bool) ([]string, uint64) {
+	lru.lock.RLock()
+	defer lru.lock.RUnlock()
+
+	if count < 1 {
+		count = 1
+	}
+
+	start := sort.Search(len(lru.order), func(i int) bool {
+		return lru.order[i].seq > cursor
+	})
+
+	keys := []string{}
+	now := time.Now()
+	end := start
+	for ; end < len(lru.order) && end-start < count; end++ {
+		entry := lru.order[end]
+		item, exists := lru.store[entry.key]
+		if !exists || item.seq != entry.seq || item.entry().isExpired(now) {
+			continue
+		}
+		if match == nil || match(entry.key) {
+			keys = append(keys, entry.key)
+		}
+	}
+
+	if end >= len(lru.order) {
+		return keys, 0
+	}
+
+	return keys, lru.order[end-1].seq
+}
+
+// Atomic
+func (lru *LRUCache) Atomic(fn func(s Store)) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+
+	fn(&lruStore{lru: lru})
+}
+
+// lruStore gives access to the unsynchronized methods of the LRUCache while the lock is held by Atomic
+type lruStore struct {
+	lru *LRUCache
+}
+
+func (s *lruStore) Get(key string) (Entry, bool) {
+	item, exists := s.lru.lookup(key)
+	if !exists {
+		return Entry{}, false
+	}
+
+	return item.entry(), true
+}
+
+func (s *lruStore) Touch(key string) {
+	if item, exists := s.lru.store[key]; exists {
+		s.lru.moveToFrontOfQ(item)
+	}
+}
+
+func (s *lruStore) Set(key string, entry Entry) uint64 {
+	return s.lru.set(key, entry)
+}
+
+func (s *lruStore) Delete(key string) bool {
+	return s.lru.delete(key)
+}
+
+func (s *lruStore) Flush() {
+	s.lru.flush()
+}
+
+func (s *lruStore) Keys() []string {
+	return s.lru.keys()
+}
+
 func (lru *LRUCache) PrintLRU() {
 	fmt.Println("LRU Q contents: ")
 	currentCacheItem := lru.head
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestLRUEviction(t *testing.T) {
@@ -172,3 +173,230 @@ func TestGetAllConcurrency(t *testing.T) {
 		t.Errorf("Expected 10 entries in the map, got %d", len(result))
 	}
 }
+
+func TestAtomicReadModifyWrite(t *testing.T) {
+	lru := NewTestLRUCache(10)
+	lru.SetEntry("counter", Entry{Value: "0", Timestamp: 1, Origin: "eu"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lru.Atomic(func(s Store) {
+				entry, _ := s.Get("counter")
+				n, _ := strconv.Atoi(entry.Value)
+				entry.Value = strconv.Itoa(n + 1)
+				entry.Timestamp++
+				s.Set("counter", entry)
+			})
+		}()
+	}
+	wg.Wait()
+
+	lru.Atomic(func(s Store) {
+		entry, ok := s.Get("counter")
+		if !ok || entry.Value != "100" || entry.Timestamp != 101 || entry.Origin != "eu" {
+			t.Errorf("Expected counter to be 100 with timestamp 101 from eu, got %+v", entry)
+		}
+	})
+
+	// a plain Set clears the metadata of the previous write
+	lru.Set("counter", "0")
+	lru.Atomic(func(s Store) {
+		if entry, _ := s.Get("counter"); entry.Timestamp != 0 || entry.Origin != "" {
+			t.Errorf("Expected the metadata to be cleared, got %+v", entry)
+		}
+	})
+}
+
+func TestListenerAndExpiration(t *testing.T) {
+	lru := NewTestLRUCache(2)
+
+	events := make([]string, 0)
+	lru.SetListener(func(event EventType, key string) {
+		events = append(events, event.String()+":"+key)
+	})
+
+	lru.Set("a", "a")
+	lru.Set("b", "b")
+	lru.Set("c", "c") // evicts a
+	lru.Delete("b")
+	lru.SetEntry("d", Entry{Value: "d", ExpiresAt: time.Now().Add(-time.Second)})
+
+	if _, ok := lru.Get("d"); ok {
+		t.Error("Expected d to be expired")
+	}
+	if len(lru.Keys()) != 1 {
+		t.Errorf("Expected only c to be left, got %v", lru.Keys())
+	}
+	lru.Flush()
+
+	expected := []string{"set:a", "set:b", "evicted:a", "set:c", "del:b", "set:d", "expired:d", "flush:"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	lru := NewTestLRUCache(10)
+
+	expired := make([]string, 0)
+	lru.SetListener(func(event EventType, key string) {
+		if event == EventExpire {
+			expired = append(expired, key)
+		}
+	})
+
+	lru.Set("a", "a")
+	lru.SetEntry("b", Entry{Value: "b", ExpiresAt: time.Now().Add(-time.Second)})
+	lru.SetEntry("c", Entry{Value: "c", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if removed := lru.RemoveExpired(10); removed != 1 {
+		t.Errorf("Expected 1 removed key, got %d", removed)
+	}
+	if !reflect.DeepEqual(expired, []string{"b"}) {
+		t.Errorf("Expected an expired event for b, got %v", expired)
+	}
+	if len(lru.store) != 2 || lru.used != 2 {
+		t.Errorf("Expected a and c to be left, got %d keys with %d used", len(lru.store), lru.used)
+	}
+	if removed := lru.RemoveExpired(10); removed != 0 {
+		t.Errorf("Expected nothing left to remove, got %d", removed)
+	}
+}
+
+func TestScanIsStable(t *testing.T) {
+	lru := NewTestLRUCache(1000)
+	for i := 0; i < 100; i++ {
+		lru.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	seen := map[string]int{}
+	cursor := uint64(0)
+	for calls := 0; ; calls++ {
+		keys, next := lru.Scan(cursor, 7, nil)
+		for _, key := range keys {
+			seen[key]++
+		}
+
+		// the keys change during the scan, enough deletes to trigger a compaction of the order
+		if calls == 2 {
+			for i := 50; i < 100; i++ {
+				lru.Delete("key" + strconv.Itoa(i))
+			}
+			for i := 100; i < 120; i++ {
+				lru.Set("key"+strconv.Itoa(i), "value")
+			}
+			// an update doesn't move the key
+			lru.Set("key0", "new value")
+		}
+
+		if next == 0 {
+			break
+		}
+		if calls > 100 {
+			t.Fatal("the scan didn't complete")
+		}
+		cursor = next
+	}
+
+	// the keys that existed for the whole scan are returned exactly once, the added ones once
+	for i := 0; i < 50; i++ {
+		if count := seen["key"+strconv.Itoa(i)]; count != 1 {
+			t.Errorf("key%d was returned %d times", i, count)
+		}
+	}
+	for i := 100; i < 120; i++ {
+		if count := seen["key"+strconv.Itoa(i)]; count != 1 {
+			t.Errorf("key%d was returned %d times", i, count)
+		}
+	}
+
+	match := func(key string) bool { return key == "key7" }
+	if keys, next := lru.Scan(0, 1000, match); !reflect.DeepEqual(keys, []string{"key7"}) || next != 0 {
+		t.Errorf("unexpected scan result %v, %d", keys, next)
+	}
+
+	lru.Flush()
+	if keys, next := lru.Scan(cursor, 10, nil); len(keys) != 0 || next != 0 {
+		t.Errorf("expected an empty scan after a flush, got %v, %d", keys, next)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	lru := NewTestLRUCache(2)
+
+	var versions []uint64
+	lru.Atomic(func(s Store) {
+		versions = append(versions, s.Set("a", Entry{Value: "1"}))
+		versions = append(versions, s.Set("a", Entry{Value: "2"}))
+		versions = append(versions, s.Set("b", Entry{Value: "1"}))
+	})
+	if !reflect.DeepEqual(versions, []uint64{1, 2, 3}) {
+		t.Fatalf("Expected the versions 1, 2, 3, got %v", versions)
+	}
+
+	// a replicated version is kept and the next ones continue after it
+	lru.SetEntry("c", Entry{Value: "1", Version: 10})
+	lru.Set("d", "1")
+	lru.Atomic(func(s Store) {
+		if entry, _ := s.Get("c"); entry.Version != 10 {
+			t.Errorf("Expected version 10, got %d", entry.Version)
+		}
+		if entry, _ := s.Get("d"); entry.Version != 11 {
+			t.Errorf("Expected version 11, got %d", entry.Version)
+		}
+	})
+
+	// a version is not reused after a flush
+	lru.Flush()
+	lru.Set("a", "1")
+	lru.Atomic(func(s Store) {
+		if entry, _ := s.Get("a"); entry.Version != 12 {
+			t.Errorf("Expected version 12, got %d", entry.Version)
+		}
+	})
+}
+
+func TestCollectionsCountPerElement(t *testing.T) {
+	lru := NewTestLRUCache(5)
+	lru.Set("a", "a")
+	lru.Set("b", "b")
+
+	hash := map[string]string{"f1": "1", "f2": "2", "f3": "3"}
+	lru.SetEntry("hash", Entry{Kind: KindHash, Hash: hash})
+	if len(lru.Keys()) != 3 || lru.used != 5 {
+		t.Fatalf("Expected the 3 keys to fill the cache, got %v with %d used", lru.Keys(), lru.used)
+	}
+
+	// the hash grows inside Atomic and pushes the least recently used string out
+	lru.Atomic(func(s Store) {
+		entry, _ := s.Get("hash")
+		entry.Hash["f4"] = "4"
+		s.Set("hash", entry)
+	})
+	if _, ok := lru.Get("a"); ok {
+		t.Error("Expected a to be evicted")
+	}
+	if _, ok := lru.Get("b"); !ok {
+		t.Error("Expected b to be kept")
+	}
+
+	// a collection larger than the capacity is kept on its own
+	lru.SetEntry("list", Entry{Kind: KindList, List: []string{"1", "2", "3", "4", "5", "6"}})
+	if keys := lru.Keys(); len(keys) != 1 || keys[0] != "list" {
+		t.Errorf("Expected only the list to be left, got %v", keys)
+	}
+
+	// a string replaces the collection
+	lru.Set("list", "value")
+	lru.Atomic(func(s Store) {
+		if entry, _ := s.Get("list"); entry.Kind != KindString || entry.List != nil || lru.used != 1 {
+			t.Errorf("Expected a string that takes 1, got %+v with %d used", entry, lru.used)
+		}
+	})
+	if snapshot := lru.GetSnapshot(); len(snapshot) != 1 {
+		t.Errorf("Expected the string in the snapshot, got %v", snapshot)
+	}
+}
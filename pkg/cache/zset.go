@@ -0,0 +1,274 @@
+package cache
+
+import "math/rand"
+
+const (
+	zsetMaxLevel = 32
+	// the chance of a node to have one more level
+	zsetLevelP = 0.25
+)
+
+// ZMember is a member of a sorted set with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZSet is a sorted set, a skip list ordered by score and then by member along with a map of the scores. Every
+// level of the skip list keeps the span of its links so the rank of a member is found in O(log n)
+type ZSet struct {
+	head *zsetNode
+	// the number of levels in use and the number of nodes
+	level  int
+	length int
+	scores map[string]float64
+}
+
+type zsetNode struct {
+	member   string
+	score    float64
+	backward *zsetNode
+	levels   []zsetLevel
+}
+
+type zsetLevel struct {
+	forward *zsetNode
+	// the number of nodes the link skips, the node it points to included
+	span int
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{
+		head:   &zsetNode{levels: make([]zsetLevel, zsetMaxLevel)},
+		level:  1,
+		scores: map[string]float64{},
+	}
+}
+
+// Len returns the number of members
+func (z *ZSet) Len() int {
+	return len(z.scores)
+}
+
+// Score returns the score of the member
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, exists := z.scores[member]
+	return score, exists
+}
+
+// Add sets the score of the member and reports if the member is new
+func (z *ZSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.delete(old, member)
+	}
+
+	z.insert(score, member)
+	z.scores[member] = score
+
+	return !exists
+}
+
+// Remove removes the member and reports if it existed
+func (z *ZSet) Remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+
+	z.delete(score, member)
+	delete(z.scores, member)
+
+	return true
+}
+
+// Rank returns the position of the member in ascending order, starting from zero
+func (z *ZSet) Rank(member string) (int, bool) {
+	score, exists := z.scores[member]
+	if !exists {
+		return 0, false
+	}
+
+	rank := 0
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !less(score, member, x.levels[i].forward.score, x.levels[i].forward.member) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != z.head && x.member == member {
+			return rank - 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// Range returns the members from start to stop by rank, both included. A negative index counts from the end and
+// with reverse the ranks count from the highest score
+func (z *ZSet) Range(start, stop int, reverse bool) []ZMember {
+	length := z.Len()
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+	if start > stop {
+		return []ZMember{}
+	}
+
+	members := make([]ZMember, 0, stop-start+1)
+	if reverse {
+		for x := z.byRank(length - start); len(members) < cap(members); x = x.backward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	} else {
+		for x := z.byRank(start + 1); len(members) < cap(members); x = x.levels[0].forward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	}
+
+	return members
+}
+
+// RangeByScore returns the members with a score from min to max, both included, in ascending order. The first
+// offset members are skipped and at most count are returned, a count below 1 returns all of them
+func (z *ZSet) RangeByScore(min, max float64, offset, count int) []ZMember {
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.score < min {
+			x = x.levels[i].forward
+		}
+	}
+
+	members := []ZMember{}
+	for x = x.levels[0].forward; x != nil && x.score <= max; x = x.levels[0].forward {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if count > 0 && len(members) >= count {
+			break
+		}
+		members = append(members, ZMember{Member: x.member, Score: x.score})
+	}
+
+	return members
+}
+
+// less reports if the first score and member sort before the second ones
+func less(score float64, member string, otherScore float64, otherMember string) bool {
+	return score < otherScore || (score == otherScore && member < otherMember)
+}
+
+func randomLevel() int {
+	level := 1
+	for level < zsetMaxLevel && rand.Float64() < zsetLevelP {
+		level++
+	}
+
+	return level
+}
+
+// byRank returns the node at the rank, starting from one
+func (z *ZSet) byRank(rank int) *zsetNode {
+	traversed := 0
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+
+	return nil
+}
+
+func (z *ZSet) insert(score float64, member string) {
+	var update [zsetMaxLevel]*zsetNode
+	// the rank of update[i]
+	var rank [zsetMaxLevel]int
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		if i < z.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && less(x.levels[i].forward.score, x.levels[i].forward.member, score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > z.level {
+		for i := z.level; i < level; i++ {
+			update[i] = z.head
+			update[i].levels[i].span = z.length
+		}
+		z.level = level
+	}
+
+	node := &zsetNode{member: member, score: score, levels: make([]zsetLevel, level)}
+	for i := 0; i < level; i++ {
+		node.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = node
+		node.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	// the links above the node skip one more
+	for i := level; i < z.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != z.head {
+		node.backward = update[0]
+	}
+	if node.levels[0].forward != nil {
+		node.levels[0].forward.backward = node
+	}
+	z.length++
+}
+
+func (z *ZSet) delete(score float64, member string) {
+	var update [zsetMaxLevel]*zsetNode
+
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && less(x.levels[i].forward.score, x.levels[i].forward.member, score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+
+	for i := 0; i < z.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	}
+	for z.level > 1 && z.head.levels[z.level-1].forward == nil {
+		z.level--
+	}
+	z.length--
+}
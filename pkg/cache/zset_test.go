@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestZSetMatchesASortedSlice(t *testing.T) {
+	z := NewZSet()
+	scores := map[string]float64{}
+
+	sorted := func() []ZMember {
+		members := make([]ZMember, 0, len(scores))
+		for member, score := range scores {
+			members = append(members, ZMember{Member: member, Score: score})
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return less(members[i].Score, members[i].Member, members[j].Score, members[j].Member)
+		})
+		return members
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		member := "m" + strconv.Itoa(rng.Intn(300))
+		if rng.Intn(4) == 0 {
+			_, existed := scores[member]
+			delete(scores, member)
+			if removed := z.Remove(member); removed != existed {
+				t.Fatalf("Remove(%s) = %v, expected %v", member, removed, existed)
+			}
+			continue
+		}
+
+		// few distinct scores so the members break the ties
+		score := float64(rng.Intn(50))
+		_, existed := scores[member]
+		scores[member] = score
+		if added := z.Add(member, score); added == existed {
+			t.Fatalf("Add(%s) = %v, expected %v", member, added, !existed)
+		}
+	}
+
+	expected := sorted()
+	if z.Len() != len(expected) {
+		t.Fatalf("Expected %d members, got %d", len(expected), z.Len())
+	}
+	if all := z.Range(0, -1, false); !reflect.DeepEqual(all, expected) {
+		t.Fatalf("Range doesn't match the sorted members")
+	}
+
+	for rank, m := range expected {
+		if got, ok := z.Rank(m.Member); !ok || got != rank {
+			t.Fatalf("Rank(%s) = %d, expected %d", m.Member, got, rank)
+		}
+	}
+
+	if got := z.Range(10, 19, false); !reflect.DeepEqual(got, expected[10:20]) {
+		t.Errorf("Range(10, 19) = %v", got)
+	}
+	reversed := z.Range(0, 4, true)
+	for i, m := range reversed {
+		if m != expected[len(expected)-1-i] {
+			t.Errorf("Range reversed[%d] = %v, expected %v", i, m, expected[len(expected)-1-i])
+		}
+	}
+	if got := z.Range(-3, -1, false); !reflect.DeepEqual(got, expected[len(expected)-3:]) {
+		t.Errorf("Range(-3, -1) = %v", got)
+	}
+	if got := z.Range(len(expected), -1, false); len(got) != 0 {
+		t.Errorf("Expected an empty range, got %v", got)
+	}
+
+	var between []ZMember
+	for _, m := range expected {
+		if m.Score >= 10 && m.Score <= 20 {
+			between = append(between, m)
+		}
+	}
+	if got := z.RangeByScore(10, 20, 0, 0); !reflect.DeepEqual(got, between) {
+		t.Errorf("RangeByScore(10, 20) = %v, expected %v", got, between)
+	}
+	if got := z.RangeByScore(10, 20, 2, 3); !reflect.DeepEqual(got, between[2:5]) {
+		t.Errorf("RangeByScore(10, 20) with a limit = %v, expected %v", got, between[2:5])
+	}
+
+	if _, ok := z.Rank("missing"); ok {
+		t.Error("Expected no rank for a missing member")
+	}
+}
+
+func TestZSetCountsPerMember(t *testing.T) {
+	lru := NewTestLRUCache(4)
+	lru.Set("a", "a")
+
+	zset := NewZSet()
+	zset.Add("m1", 1)
+	zset.Add("m2", 2)
+	zset.Add("m3", 3)
+	lru.SetEntry("board", Entry{Kind: KindZSet, ZSet: zset})
+	if lru.used != 4 {
+		t.Fatalf("Expected 4 used, got %d", lru.used)
+	}
+
+	// a new member pushes the string out
+	lru.Atomic(func(s Store) {
+		entry, _ := s.Get("board")
+		entry.ZSet.Add("m4", 4)
+		s.Set("board", entry)
+	})
+	if _, ok := lru.Get("a"); ok {
+		t.Error("Expected a to be evicted")
+	}
+	if lru.used != 4 {
+		t.Errorf("Expected 4 used, got %d", lru.used)
+	}
+}
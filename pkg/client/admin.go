@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many keys a SCAN asks from a node at a time
+const scanBatchSize = 100
+
+// Nodes returns every node that the client knows, the primaries first and then by ID. A node can be passed to Ping
+func (c *Client) Nodes() []*CacheNode {
+	nodes := c.nodes()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].IsPrimary != nodes[j].IsPrimary {
+			return nodes[i].IsPrimary
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	return nodes
+}
+
+// primaries returns the primary of every shard
+func (c *Client) primaries() []*CacheNode {
+	primaries := []*CacheNode{}
+	for _, node := range c.Nodes() {
+		if node.IsPrimary {
+			primaries = append(primaries, node)
+		}
+	}
+
+	return primaries
+}
+
+// PingResult is the outcome of the PING of a node
+type PingResult struct {
+	Latency time.Duration
+	Err     error
+}
+
+// PingAll PINGs every node in parallel and returns the results by node ID
+func (c *Client) PingAll(ctx context.Context) map[string]PingResult {
+	results := map[string]PingResult{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, node := range c.nodes() {
+		wg.Add(1)
+		go func(node *CacheNode) {
+			defer wg.Done()
+
+			start := time.Now()
+			resp, err := c.sendCommandContext(ctx, node, "PING")
+			if err == nil && resp != "PONG" {
+				err = fmt.Errorf("unexpected reply to PING: %s", resp)
+			}
+
+			lock.Lock()
+			results[node.ID] = PingResult{Latency: time.Since(start), Err: err}
+			lock.Unlock()
+		}(node)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// FlushAll removes every key of every shard, the primaries replicate the FLUSH to their secondaries.
+// The shards that failed are reported in the error, the rest are flushed anyway. A cluster with cross cluster links
+// rejects it
+func (c *Client) FlushAll(ctx context.Context) error {
+	var errs []error
+
+	for _, node := range c.primaries() {
+		if _, err := c.sendCommandContext(ctx, node, "FLUSH"); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush %s: %w", node.ID, err))
+		}
+	}
+
+	if c.nearCache != nil {
+		c.nearCache.flush()
+	}
+
+	return errors.Join(errs...)
+}
+
+// KeyScanner iterates the keys of every shard, a shard at a time, with a cursor on its primary. A key that exists for
+// the whole iteration is returned once, a key that is set or deleted during it might be returned or not
+type KeyScanner struct {
+	client  *Client
+	ctx     context.Context
+	pattern string
+	nodes   []*CacheNode
+	cursor  uint64
+	batch   []string
+	key     string
+	err     error
+}
+
+// Scan returns an iterator over the keys that match the glob pattern, "*" matches every key
+//
+//	scanner := c.Scan(ctx, "user:*")
+//	for scanner.Next() {
+//		fmt.Println(scanner.Key())
+//	}
+//	if err := scanner.Err(); err != nil {
+func (c *Client) Scan(ctx context.Context, pattern string) *KeyScanner {
+	return &KeyScanner{
+		client:  c,
+		ctx:     ctx,
+		pattern: pattern,
+		nodes:   c.primaries(),
+	}
+}
+
+// Next moves to the next key, it returns false when the iteration is complete or failed
+func (ks *KeyScanner) Next() bool {
+	for len(ks.batch) == 0 {
+		if ks.err != nil || len(ks.nodes) == 0 {
+			return false
+		}
+
+		if err := ks.fetch(); err != nil {
+			ks.err = err
+			return false
+		}
+	}
+
+	ks.key, ks.batch = ks.batch[0], ks.batch[1:]
+
+	return true
+}
+
+// Key returns the current key
+func (ks *KeyScanner) Key() string {
+	return ks.key
+}
+
+// Err returns the error that stopped the iteration, if any
+func (ks *KeyScanner) Err() error {
+	return ks.err
+}
+
+// fetch reads the next batch of the current node and moves to the next node when its cursor is back to zero
+func (ks *KeyScanner) fetch() error {
+	node := ks.nodes[0]
+	cmd := fmt.Sprintf("SCAN %d MATCH %s COUNT %d", ks.cursor, ks.pattern, scanBatchSize)
+
+	lines, err := ks.client.sendLines(ks.ctx, node, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", node.ID, err)
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("failed to scan %s: missing cursor", node.ID)
+	}
+
+	cursor, err := strconv.ParseUint(lines[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: invalid cursor %s", node.ID, lines[0])
+	}
+
+	ks.batch = lines[1:]
+	ks.cursor = cursor
+	if cursor == 0 {
+		ks.nodes = ks.nodes[1:]
+	}
+
+	return nil
+}
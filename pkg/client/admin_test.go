@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+func newTwoShardClient(t *testing.T) *Client {
+	cfg := &config.Configuration{
+		ClientConfig: config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15, UnHealthyInterval: 1},
+		Servers: []config.ServerConfig{
+			{ID: "shard2", Address: "localhost:12364", Role: "PRIMARY"},
+			{ID: "shard1", Address: "localhost:12363", Role: "PRIMARY"},
+		},
+	}
+
+	client, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestAdminOperations(t *testing.T) {
+	for _, port := range []int{12363, 12364} {
+		listener, err := startTestServer(t, 1000, port, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer (listener).Stop()
+	}
+
+	client := newTwoShardClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	nodes := client.Nodes()
+	if len(nodes) != 2 || nodes[0].ID != "shard1" || nodes[0].Address() != "localhost:12363" {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	if resp, err := client.Ping(nodes[0]); err != nil || resp != "PONG" {
+		t.Errorf("Ping failed: resp=%s, err=%v", resp, err)
+	}
+
+	for id, result := range client.PingAll(ctx) {
+		if result.Err != nil || result.Latency <= 0 {
+			t.Errorf("PingAll failed for %s: %+v", id, result)
+		}
+	}
+
+	// more keys than a batch of SCAN
+	for i := 0; i < 250; i++ {
+		if _, err := client.Set(fmt.Sprintf("key:%03d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Set("other", "value")
+
+	scanAll := func(pattern string) map[string]bool {
+		keys := map[string]bool{}
+		scanner := client.Scan(ctx, pattern)
+		for scanner.Next() {
+			if keys[scanner.Key()] {
+				t.Errorf("key %s was returned twice", scanner.Key())
+			}
+			keys[scanner.Key()] = true
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("Scan failed: %v", err)
+		}
+		return keys
+	}
+
+	if keys := scanAll("*"); len(keys) != 251 {
+		t.Errorf("expected 251 keys, got %d", len(keys))
+	}
+	if keys := scanAll("key:1*"); len(keys) != 100 {
+		t.Errorf("expected 100 keys, got %d", len(keys))
+	}
+
+	if err := client.FlushAll(ctx); err != nil {
+		t.Fatalf("FlushAll failed: %v", err)
+	}
+	if keys := scanAll("*"); len(keys) != 0 {
+		t.Errorf("expected no keys after FlushAll, got %d", len(keys))
+	}
+}
+
+func TestAdminOperationsWithUnavailableNode(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12363, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	// nothing listens on the port of shard2
+	client := newTwoShardClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	results := client.PingAll(ctx)
+	if results["shard1"].Err != nil || results["shard2"].Err == nil {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	if err := client.FlushAll(ctx); err == nil || !strings.Contains(err.Error(), "shard2") {
+		t.Errorf("expected the flush of shard2 to fail, got %v", err)
+	}
+
+	scanner := client.Scan(ctx, "*")
+	for scanner.Next() {
+	}
+	if err := scanner.Err(); err == nil || !strings.Contains(err.Error(), "shard2") {
+		t.Errorf("expected the scan of shard2 to fail, got %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+// ReadStrategy selects the node of a shard that serves a read
+type ReadStrategy string
+
+const (
+	// the nodes are used in turns
+	RoundRobin ReadStrategy = "round-robin"
+	// the node with the fewest requests in flight
+	LeastOutstanding ReadStrategy = "least-outstanding"
+	// the faster of two random nodes, by the moving average of their latency
+	LatencyAware ReadStrategy = "ewma"
+	// the primary while it is available, the secondaries in turns otherwise
+	PrimaryPreferred ReadStrategy = "primary-preferred"
+	// round robin, but a second node is asked if the first is slower than most of the recent requests
+	Hedged ReadStrategy = "hedged"
+)
+
+func parseReadStrategy(name string) (ReadStrategy, error) {
+	switch strategy := ReadStrategy(name); strategy {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastOutstanding, LatencyAware, PrimaryPreferred, Hedged:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown read strategy: %s", name)
+	}
+}
+
+const (
+	// the weight of the newest latency in the moving average
+	ewmaAlpha = 0.3
+	// the number of latencies that are kept per node for the delay of the hedged reads
+	latencySamples         = 100
+	defaultHedgePercentile = 95
+	// used until enough latencies are recorded
+	defaultHedgeDelay = 10 * time.Millisecond
+	minHedgeSamples   = 10
+)
+
+// nodeStats keeps the load and the latency of a node for the read strategies
+type nodeStats struct {
+	outstanding atomic.Int64
+	lock        sync.Mutex
+	ewma        float64
+	samples     []time.Duration
+	next        int
+}
+
+func newNodeStats() *nodeStats {
+	return &nodeStats{samples: make([]time.Duration, 0, latencySamples)}
+}
+
+func (s *nodeStats) begin() time.Time {
+	s.outstanding.Add(1)
+	return time.Now()
+}
+
+// end records the latency of the requests that got a reply
+func (s *nodeStats) end(start time.Time, replied bool) {
+	s.outstanding.Add(-1)
+	if !replied {
+		return
+	}
+
+	latency := time.Since(start)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ewma == 0 {
+		s.ewma = float64(latency)
+	} else {
+		s.ewma = ewmaAlpha*float64(latency) + (1-ewmaAlpha)*s.ewma
+	}
+
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+// cost is the expected time of a new request, a node without latencies is tried first
+func (s *nodeStats) cost() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.ewma * float64(s.outstanding.Load()+1)
+}
+
+func (s *nodeStats) latencies() []time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]time.Duration(nil), s.samples...)
+}
+
+type ReadBalancer struct {
+	nodes    []*CacheNode
+	index    int
+	lock     sync.Mutex
+	cfg      config.ClientConfig
+	strategy ReadStrategy
+}
+
+func NewReadBalancer(cfg config.ClientConfig) *ReadBalancer {
+	// an unknown strategy is rejected by New
+	strategy, err := parseReadStrategy(cfg.ReadStrategy)
+	if err != nil {
+		strategy = RoundRobin
+	}
+
+	return &ReadBalancer{
+		nodes:    make([]*CacheNode, 0),
+		index:    0,
+		cfg:      cfg,
+		strategy: strategy,
+	}
+}
+
+func (rb *ReadBalancer) addCacheNode(node *CacheNode) {
+	rb.nodes = append(rb.nodes, node)
+}
+
+func (rb *ReadBalancer) setStrategy(strategy ReadStrategy) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	rb.strategy = strategy
+}
+
+func (rb *ReadBalancer) getStrategy() ReadStrategy {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	return rb.strategy
+}
+
+// getNextCacheNode picks an available node that is not in tried
+func (rb *ReadBalancer) getNextCacheNode(tried map[*CacheNode]bool) (*CacheNode, error) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	total := len(rb.nodes)
+	if total == 0 {
+		return nil, fmt.Errorf("no cache nodes exist")
+	}
+
+	var node *CacheNode
+
+	switch rb.strategy {
+	case LeastOutstanding:
+		node = rb.leastOutstanding(tried)
+	case LatencyAware:
+		node = rb.powerOfTwoChoices(tried)
+	case PrimaryPreferred:
+		for _, candidate := range rb.nodes {
+			if candidate.IsPrimary && !tried[candidate] && candidate.breaker.available() {
+				node = candidate
+				break
+			}
+		}
+		if node == nil {
+			node = rb.roundRobin(tried)
+		}
+	default:
+		node = rb.roundRobin(tried)
+	}
+
+	if node == nil {
+		return nil, fmt.Errorf("no available cache nodes")
+	}
+
+	return node, nil
+}
+
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (rb *ReadBalancer) roundRobin(tried map[*CacheNode]bool) *CacheNode {
+	total := len(rb.nodes)
+
+	for i := 0; i < total; i++ {
+
+		node := rb.nodes[rb.index%total]
+		rb.index++
+
+		if !tried[node] && node.breaker.available() {
+			return node
+		}
+
+	}
+
+	return nil
+}
+
+// the candidates are visited from a rotating start so the ties are spread
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (rb *ReadBalancer) leastOutstanding(tried map[*CacheNode]bool) *CacheNode {
+	total := len(rb.nodes)
+	var best *CacheNode
+
+	for i := 0; i < total; i++ {
+		node := rb.nodes[(rb.index+i)%total]
+		if tried[node] || !node.breaker.available() {
+			continue
+		}
+		if best == nil || node.stats.outstanding.Load() < best.stats.outstanding.Load() {
+			best = node
+		}
+	}
+	rb.index++
+
+	return best
+}
+
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (rb *ReadBalancer) powerOfTwoChoices(tried map[*CacheNode]bool) *CacheNode {
+	candidates := make([]*CacheNode, 0, len(rb.nodes))
+	for _, node := range rb.nodes {
+		if !tried[node] && node.breaker.available() {
+			candidates = append(candidates, node)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+
+	if candidates[second].stats.cost() < candidates[first].stats.cost() {
+		return candidates[second]
+	}
+
+	return candidates[first]
+}
+
+// hedgeDelay is the percentile of the recent latencies of the nodes
+func (rb *ReadBalancer) hedgeDelay() time.Duration {
+	rb.lock.Lock()
+	nodes := rb.nodes
+	rb.lock.Unlock()
+
+	latencies := []time.Duration{}
+	for _, node := range nodes {
+		latencies = append(latencies, node.stats.latencies()...)
+	}
+
+	if len(latencies) < minHedgeSamples {
+		return defaultHedgeDelay
+	}
+
+	percentile := rb.cfg.HedgePercentile
+	if percentile <= 0 || percentile > 100 {
+		percentile = defaultHedgePercentile
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(float64(len(latencies)-1) * percentile / 100)
+
+	return latencies[idx]
+}
+
+// SetReadStrategy changes the strategy of the reads of every shard
+func (c *Client) SetReadStrategy(strategy ReadStrategy) error {
+	if _, err := parseReadStrategy(string(strategy)); err != nil {
+		return err
+	}
+
+	for _, balancer := range c.balancers {
+		balancer.setStrategy(strategy)
+	}
+
+	return nil
+}
+
+type readResult struct {
+	resp string
+	node *CacheNode
+	err  error
+}
+
+// hedgedGet sends the read to a second node if the first didn't reply within the hedge delay and returns the first reply.
+// A node that fails is replaced immediately, the request that loses is cancelled
+func (c *Client) hedgedGet(ctx context.Context, balancer *ReadBalancer, cmd string) (string, *CacheNode, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the requests that lose never block on the channel
+	results := make(chan readResult, len(balancer.nodes))
+	tried := map[*CacheNode]bool{}
+
+	send := func() error {
+		node, err := balancer.getNextCacheNode(tried)
+		if err != nil {
+			return err
+		}
+		tried[node] = true
+		c.logger.Debug("node selected to send the request: " + node.ID)
+
+		go func() {
+			resp, err := c.sendCommandContext(ctx, node, cmd)
+			results <- readResult{resp: resp, node: node, err: err}
+		}()
+
+		return nil
+	}
+
+	if err := send(); err != nil {
+		c.logger.Error(err.Error())
+		return "", nil, err
+	}
+	pending := 1
+
+	hedge := time.NewTimer(balancer.hedgeDelay())
+	defer hedge.Stop()
+
+	var last readResult
+
+	for pending > 0 {
+		select {
+		case <-hedge.C:
+			if send() == nil {
+				c.logger.Debug("hedged the read of: " + cmd)
+				pending++
+			}
+
+		case result := <-results:
+			pending--
+			if result.err == nil || isReplyError(result.err) {
+				return result.resp, result.node, result.err
+			}
+
+			last = result
+			if contextErr(ctx) != nil {
+				return "", result.node, result.err
+			}
+
+			c.logger.Warn("GET from node: " + result.node.ID + " failed: " + result.err.Error())
+			if pending == 0 && send() == nil {
+				pending++
+			}
+		}
+	}
+
+	return "", last.node, last.err
+}
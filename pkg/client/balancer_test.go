@@ -0,0 +1,142 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+func newTestBalancer(strategy ReadStrategy, nodes ...*CacheNode) *ReadBalancer {
+	balancer := NewReadBalancer(config.ClientConfig{ReadStrategy: string(strategy)})
+	for _, node := range nodes {
+		balancer.addCacheNode(node)
+	}
+
+	return balancer
+}
+
+func newTestNode(id string, isPrimary bool) *CacheNode {
+	return NewCacheNode(id, isPrimary, NewConnPool(1, id+":1", config.ClientConfig{UnHealthyInterval: 60}))
+}
+
+func TestPrimaryPreferred(t *testing.T) {
+	primary := newTestNode("primary", true)
+	secondary1 := newTestNode("secondary1", false)
+	secondary2 := newTestNode("secondary2", false)
+	balancer := newTestBalancer(PrimaryPreferred, secondary1, primary, secondary2)
+
+	for i := 0; i < 3; i++ {
+		if node, err := balancer.getNextCacheNode(nil); err != nil || node != primary {
+			t.Fatalf("expected the primary, got %v, err=%v", node, err)
+		}
+	}
+
+	// the secondaries are used in turns while the primary is down
+	primary.SetUnhealthy(time.Minute)
+	seen := map[*CacheNode]bool{}
+	for i := 0; i < 2; i++ {
+		node, err := balancer.getNextCacheNode(nil)
+		if err != nil || node == primary {
+			t.Fatalf("expected a secondary, got %v, err=%v", node, err)
+		}
+		seen[node] = true
+	}
+	if len(seen) != 2 {
+		t.Error("expected both secondaries to be used")
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	busy := newTestNode("busy", true)
+	idle := newTestNode("idle", false)
+	balancer := newTestBalancer(LeastOutstanding, busy, idle)
+
+	busy.stats.begin()
+	busy.stats.begin()
+	idle.stats.begin()
+
+	for i := 0; i < 3; i++ {
+		if node, _ := balancer.getNextCacheNode(nil); node != idle {
+			t.Fatalf("expected the node with the fewest requests, got %s", node.ID)
+		}
+	}
+
+	// a node that was already tried is skipped
+	if node, _ := balancer.getNextCacheNode(map[*CacheNode]bool{idle: true}); node != busy {
+		t.Errorf("expected the busy node, got %s", node.ID)
+	}
+}
+
+func TestLatencyAware(t *testing.T) {
+	slow := newTestNode("slow", true)
+	fast := newTestNode("fast", false)
+	balancer := newTestBalancer(LatencyAware, slow, fast)
+
+	slow.stats.end(slow.stats.begin().Add(-50*time.Millisecond), true)
+	fast.stats.end(fast.stats.begin().Add(-time.Millisecond), true)
+
+	// with two nodes both are always compared
+	for i := 0; i < 10; i++ {
+		if node, _ := balancer.getNextCacheNode(nil); node != fast {
+			t.Fatalf("expected the fast node, got %s", node.ID)
+		}
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	node := newTestNode("node", true)
+	balancer := newTestBalancer(Hedged, node)
+
+	if delay := balancer.hedgeDelay(); delay != defaultHedgeDelay {
+		t.Errorf("expected the default delay without latencies, got %s", delay)
+	}
+
+	for i := 1; i <= 100; i++ {
+		node.stats.end(node.stats.begin().Add(-time.Duration(i)*time.Millisecond), true)
+	}
+
+	// the 95th percentile of 1ms..100ms
+	if delay := balancer.hedgeDelay(); delay < 94*time.Millisecond || delay > 97*time.Millisecond {
+		t.Errorf("unexpected hedge delay %s", delay)
+	}
+}
+
+func TestHedgedRead(t *testing.T) {
+	hung := startHungServer(t)
+	defer hung.Close()
+
+	listener, err := startTestServer(t, 10, 12352, map[string]string{"testkey": "testvalue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	clientConf := config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15, UnHealthyInterval: 60}
+	slowNode := NewCacheNode("slow", true, NewConnPool(1, hung.Addr().String(), clientConf))
+	fastNode := NewCacheNode("fast", false, NewConnPool(1, "localhost:12352", clientConf))
+
+	ring := NewHashRing()
+	ring.AddNode(slowNode)
+	balancer := newTestBalancer(Hedged, slowNode, fastNode)
+
+	client := &Client{
+		ring:      ring,
+		logger:    &NoOpLogger{},
+		balancers: map[string]*ReadBalancer{"slow": balancer},
+	}
+
+	// the first request goes to the node that never replies
+	start := time.Now()
+	if resp, err := client.Get("testkey"); err != nil || resp != "testvalue" {
+		t.Fatalf("Get failed: resp=%s, err=%v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the hedged read returned after %s", elapsed)
+	}
+
+	// the request that lost was cancelled, it says nothing about the health of the node
+	if slowNode.State() != BreakerClosed {
+		t.Errorf("expected the breaker of the slow node to stay closed, got %s", slowNode.State())
+	}
+}
@@ -1,24 +1,21 @@
 package client
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
-	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/voukatas/CacheGopher/pkg/config"
 	"github.com/voukatas/CacheGopher/pkg/errorutil"
 	"github.com/voukatas/CacheGopher/pkg/logger"
-)
-
-// package-scope logger, use this for the whole lib, not only for the Client
-var (
-	libLoggerInstance logger.Logger = &NoOpLogger{}
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 )
 
 // An empty logger that doesn't trigger any logging but it is convinient to use because we avoid the err != nil for every log
@@ -30,355 +27,560 @@ func (n *NoOpLogger) Info(msg string)  {}
 func (n *NoOpLogger) Warn(msg string)  {}
 func (n *NoOpLogger) Error(msg string) {}
 
-// maybe i should consider using an Exported not bound to Client logger in the future
-func setupLogger() {
-
-	libLoggerInstance = logger.SetupDebugLogger()
+var ErrClientClosed = errors.New("the client is closed")
 
+type Client struct {
+	ring      HashRing
+	logger    logger.Logger
+	balancers map[string]*ReadBalancer
+	// stops the background tasks of the client
+	done chan struct{}
+	// nil unless EnableNearCache is called
+	nearCache *nearCache
+	// the default consistency of the reads
+	consistency Consistency
+	// the offsets of the writes for the session consistency
+	session session
+	// the running loads of GetOrLoad
+	loads flightGroup
+	// set by Close, every call fails with ErrClientClosed after it
+	closed    atomic.Bool
+	closeOnce sync.Once
 }
 
-func getLogger() logger.Logger {
-	return libLoggerInstance
-}
+// nodes returns every node of the topology, primaries and secondaries
+func (c *Client) nodes() []*CacheNode {
+	nodes := []*CacheNode{}
+	for _, balancer := range c.balancers {
+		nodes = append(nodes, balancer.nodes...)
+	}
 
-type PoolConn struct {
-	conn      net.Conn
-	scanner   *bufio.Scanner
-	createdAt time.Time
+	return nodes
 }
 
-type ConnPool struct {
-	pool    chan *PoolConn
-	address string
-	cfg     config.ClientConfig
-	// size    int
-}
+// NewClient creates a client from the cacheGopherConfig.json of the working directory
+func NewClient(enableLogging bool) (*Client, error) {
+	cfg, err := config.LoadConfig("cacheGopherConfig.json")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read configuration: " + err.Error())
+	}
 
-type ReadBalancer struct {
-	nodes []*CacheNode
-	index int
-	lock  sync.Mutex
-	cfg   config.ClientConfig
+	return NewClientWithConfig(cfg, enableLogging)
 }
 
-func NewReadBalancer(cfg config.ClientConfig) *ReadBalancer {
-	return &ReadBalancer{
-		nodes: make([]*CacheNode, 0),
-		index: 0,
-		cfg:   cfg,
+// NewClientWithConfig creates a client for the topology of cfg, useful when the client talks to more than one cluster
+func NewClientWithConfig(cfg *config.Configuration, enableLogging bool) (*Client, error) {
+	if enableLogging {
+		return New(cfg, WithLogger(logger.SetupDebugLogger()))
 	}
-}
 
-func (rb *ReadBalancer) addCacheNode(node *CacheNode) {
-	rb.nodes = append(rb.nodes, node)
+	return New(cfg)
 }
 
-func (rb *ReadBalancer) getNextCacheNode() (*CacheNode, error) {
-	rb.lock.Lock()
-	defer rb.lock.Unlock()
+// New creates a client for the topology of cfg, the options override the defaults and the client configuration of cfg
+func New(cfg *config.Configuration, opts ...Option) (*Client, error) {
+	options := defaultClientOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	readStrategy, err := parseReadStrategy(cfg.ClientConfig.ReadStrategy)
+	if err != nil {
+		return nil, err
+	}
+	if options.readStrategy != "" {
+		readStrategy = options.readStrategy
+	}
 
-	total := len(rb.nodes)
-	if total == 0 {
-		return nil, fmt.Errorf("no cache nodes exist")
+	consistency, err := parseConsistency(cfg.ClientConfig.Consistency)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < total; i++ {
+	ring := options.ring
+	balancers := map[string]*ReadBalancer{}
+	pools := []*ConnPool{}
 
-		node := rb.nodes[rb.index%total]
-		rb.index++
+	for _, node := range cfg.Servers {
 
-		node.HealthLock.Lock()
-		if !node.Unhealthy || time.Now().After(node.RetryAt) {
+		newPool := NewConnPool(options.poolSize, node.Address, cfg.ClientConfig)
+		newPool.dialTimeout = options.dialTimeout
+		newPool.dialAttempts = options.retries + 1
+		newPool.waitTimeout = options.poolWaitTimeout
+		newPool.logger = options.logger
+		pools = append(pools, newPool)
 
-			if node.Unhealthy {
-				node.Unhealthy = false
+		if strings.ToUpper(node.Role) == "PRIMARY" {
+			newNode := NewCacheNode(node.ID, true, newPool)
+
+			ring.AddNode(newNode)
+			newBalancer := NewReadBalancer(cfg.ClientConfig)
+			newBalancer.setStrategy(readStrategy)
+			newBalancer.addCacheNode(newNode)
+			balancers[node.ID] = newBalancer
+
+		} else if strings.ToUpper(node.Role) == "SECONDARY" {
+			newNode := NewCacheNode(node.ID, false, newPool)
+
+			readBalancer, exists := balancers[node.Primary]
+			if !exists {
+				return nil, fmt.Errorf("Unknown primary %s of %s, the primaries should be listed first", node.Primary, node.ID)
 			}
+			readBalancer.addCacheNode(newNode)
 
-			node.HealthLock.Unlock()
-			return node, nil
+		} else {
+			return nil, fmt.Errorf("Unknown role: %s", node.Role)
 		}
+	}
 
-		node.HealthLock.Unlock()
+	client := &Client{
+		ring:        ring,
+		balancers:   balancers,
+		done:        make(chan struct{}),
+		consistency: consistency,
+		logger:      options.logger,
+	}
 
+	for _, pool := range pools {
+		go pool.maintain(options.idleCheckInterval, options.minIdle)
 	}
 
-	return nil, fmt.Errorf("no available cache nodes")
-}
+	if cfg.ClientConfig.HealthCheckInterval > 0 {
+		client.startHealthChecks(time.Duration(cfg.ClientConfig.HealthCheckInterval) * time.Second)
+	}
 
-func (pc *PoolConn) isExpired(timeout int) bool {
-	maxValidTime := time.Duration(timeout) * time.Second
-	getLogger().Debug("isExpired timeout: " + maxValidTime.String())
-	return time.Since(pc.createdAt) > maxValidTime
+	return client, nil
 }
 
-func (pc *PoolConn) Close() {
-	pc.conn.Close()
+// Close stops the background tasks of the client and closes its connections, the calls after it fail with
+// ErrClientClosed. The requests that are running finish and their connections are closed when they are returned
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+
+		if c.done != nil {
+			close(c.done)
+		}
+
+		if c.nearCache != nil {
+			close(c.nearCache.done)
+			c.nearCache.flush()
+		}
+
+		for _, node := range c.nodes() {
+			node.ConnPool.Close()
+		}
+	})
+
+	return nil
 }
 
-func NewConnPool(size int, address string, cfg config.ClientConfig) *ConnPool {
-	return &ConnPool{
-		pool:    make(chan *PoolConn, size),
-		address: address,
-		cfg:     cfg,
+// newRandomId returns a random hex string that identifies the client to the servers, e.g. as the owner of a lease
+func newRandomId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := crand.Read(id); err != nil {
+		return "", err
 	}
+
+	return hex.EncodeToString(id), nil
 }
 
-func (cp *ConnPool) Get() (*PoolConn, error) {
-	getLogger().Debug("Get connection from pool called")
+func validateCommand(cmdBytes []byte) error {
+	const maxTokenSize = 64 * 1024
+
+	if len(cmdBytes) > maxTokenSize {
+		return fmt.Errorf("command exceeds the maximum allowed size of 64KB")
 
-	for {
-		select {
-		case poolConn := <-cp.pool:
-			if poolConn.isExpired(cp.cfg.ConnectionTimeout) {
-				getLogger().Debug("isExpired or is invalid")
-				poolConn.Close()
-				continue
-			}
-			getLogger().Debug("found poolConn")
-			return poolConn, nil
+	}
 
-		default:
+	return nil
+}
 
-			return cp.dialWithBackOff()
-		}
+func (c *Client) sendCommand(node *CacheNode, cmd string) (string, error) {
+	return c.sendCommandContext(context.Background(), node, cmd)
+}
+
+// sendCommandContext sends cmd and waits for the reply until ctx is done
+func (c *Client) sendCommandContext(ctx context.Context, node *CacheNode, cmd string) (string, error) {
+	replies, err := c.pipeline(ctx, node, cmd)
+	if err != nil {
+		return "", err
 	}
+
+	return parseReply(replies[0])
 }
 
-func (cp *ConnPool) dialWithBackOff() (*PoolConn, error) {
-	getLogger().Debug(" dialWithBackOff")
-	maxAttempts := 3
-	baseTime := 100 * time.Millisecond
-	maxBackoff := 1 * time.Second
+// pipeline sends the commands with a single write and returns a reply line per command. The outcome is recorded in the
+// breaker of the node, a node that doesn't reply counts as a failure but an error reply means that the node is healthy
+func (c *Client) pipeline(ctx context.Context, node *CacheNode, cmds ...string) ([]string, error) {
+	return c.send(ctx, node, false, cmds)
+}
 
-	var conn net.Conn
-	var err error
+// sendLines sends a command that replies with a *<n> header followed by n lines and returns the lines
+func (c *Client) sendLines(ctx context.Context, node *CacheNode, cmd string) ([]string, error) {
+	replies, err := c.send(ctx, node, true, []string{cmd})
+	if err != nil {
+		return nil, err
+	}
 
-	for attempt := 0; attempt < maxAttempts; attempt++ {
+	if _, isHeader := parseLinesHeader(replies[0]); !isHeader {
+		if _, err := parseReply(replies[0]); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected reply: %s", replies[0])
+	}
 
-		conn, err = net.Dial("tcp", cp.address)
+	return replies[1:], nil
+}
 
-		if err == nil {
-			tcpConn, ok := conn.(*net.TCPConn)
-			if !ok {
-				getLogger().Debug("Connection is not TCP type")
-				err = fmt.Errorf("expected TCP connection, got different type")
-				continue
+// parseLinesHeader returns n of a *<n> header
+func parseLinesHeader(line string) (int, bool) {
+	if !strings.HasPrefix(line, "*") {
+		return 0, false
+	}
 
-			}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return 0, false
+	}
 
-			// disable Nagle's Algorithm
-			// if err := tcpConn.SetNoDelay(true); err != nil {
-			// 	return nil, fmt.Errorf("failed to set TCP_NODELAY: %s", err)
-			// }
+	return n, true
+}
 
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(time.Duration(cp.cfg.KeepAliveInterval) * time.Second)
-			getLogger().Debug("KeepAlive: " + fmt.Sprint(cp.cfg.KeepAliveInterval))
+func (c *Client) send(ctx context.Context, node *CacheNode, multiLine bool, cmds []string) ([]string, error) {
+	var cmdBytes []byte
 
-			poolConn := &PoolConn{conn: tcpConn, scanner: bufio.NewScanner(tcpConn), createdAt: time.Now()}
-			getLogger().Debug("Successfully Created poolConn")
-			return poolConn, nil
-		}
+	for _, cmd := range cmds {
+		line := []byte(protocol.Format(cmd))
 
-		// consider adding a more sophisticated jitter approach
-		jitter := time.Duration(rand.Int63n(100)) * time.Millisecond
-		delay := time.Duration(1<<attempt)*baseTime + jitter
+		if err := validateCommand(line); err != nil {
+
+			c.logger.Debug("Error sending command:" + err.Error())
+			return nil, err
 
-		if delay > maxBackoff {
-			delay = maxBackoff
 		}
 
-		time.Sleep(delay)
+		cmdBytes = append(cmdBytes, line...)
 	}
 
-	return nil, err
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
 
-}
+	allowed, trial := node.breaker.acquire()
+	if !allowed {
+		return nil, fmt.Errorf("%w: %s", ErrNodeUnavailable, node.ID)
+	}
 
-func (cp *ConnPool) Return(poolConn *PoolConn) error {
-	select {
-	case cp.pool <- poolConn:
-	// return the connection to the pool
+	start := node.stats.begin()
+	replies, err := c.exchange(ctx, node, cmdBytes, len(cmds), multiLine)
+	node.stats.end(start, err == nil)
+	switch {
+	case err == nil:
+		node.breaker.done(outcomeSuccess, trial)
+	case contextErr(ctx) != nil, errors.Is(err, ErrPoolTimeout):
+		// the node is not to blame, the requests that hold its connections report its health
+		node.breaker.done(outcomeIgnored, trial)
 	default:
-		// pool is full so drop it
-		poolConn.Close()
+		node.breaker.done(outcomeFailure, trial)
 	}
 
-	return nil
+	return replies, err
 }
 
-type Client struct {
-	ring      HashRing
-	balancers map[string]*ReadBalancer
+// isReplyError reports if err is an error reply of a healthy node, the other nodes of the shard would reply the same
+func isReplyError(err error) bool {
+	return errors.Is(err, errorutil.ErrKeyNotFound) || errors.Is(err, errorutil.ErrWrongType)
 }
 
-func NewClient(enableLogging bool) (*Client, error) {
-	cfg, err := config.LoadConfig("cacheGopherConfig.json")
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read configuration: " + err.Error())
+func parseReply(resp string) (string, error) {
+	if resp == "ERROR: Key not found" {
+		return "", errorutil.ErrKeyNotFound
+	} else if strings.HasPrefix(resp, "ERROR: WRONGTYPE") {
+		return "", errorutil.ErrWrongType
+	} else if strings.Contains(resp, "ERROR:") {
+		return "", fmt.Errorf("%s", resp)
 	}
+	return resp, nil
+}
 
-	ring := NewHashRing()
-	balancers := map[string]*ReadBalancer{}
+// exchange writes the commands and returns the reply lines. A connection that was interrupted in the middle
+// of a command might still receive its reply so it is closed instead of being returned to the pool.
+// With multiLine the reply of the single command can be a *<n> header, the header and the n lines are returned
+func (c *Client) exchange(ctx context.Context, node *CacheNode, cmdBytes []byte, replies int, multiLine bool) ([]string, error) {
+	attempts := 2
+	var poolConn *PoolConn
+	var err error
 
-	for _, node := range cfg.Servers {
+	for attempts > 0 {
+		poolConn, err = node.ConnPool.GetContext(ctx)
+		if err != nil {
+			c.logger.Debug("Error in conn pool" + err.Error())
+			return nil, err
+		}
 
-		newPool := NewConnPool(5, node.Address, cfg.ClientConfig)
+		c.logger.Debug("sendCommand: Before writing to the connection")
+		resp, reusable, err := poolConn.roundTrip(ctx, cmdBytes, replies, multiLine)
+		c.logger.Debug("sendCommand: After reading the response")
 
-		if strings.ToUpper(node.Role) == "PRIMARY" {
-			newNode := NewCacheNode(node.ID, true, newPool)
+		if err != nil {
+			node.ConnPool.discard(poolConn)
 
-			ring.AddNode(newNode)
-			newBalancer := NewReadBalancer(cfg.ClientConfig)
-			newBalancer.addCacheNode(newNode)
-			balancers[node.ID] = newBalancer
+			if ctxErr := contextErr(ctx); ctxErr != nil {
+				return nil, fmt.Errorf("%w: %s", ctxErr, err.Error())
+			}
 
-		} else if strings.ToUpper(node.Role) == "SECONDARY" {
-			newNode := NewCacheNode(node.ID, false, newPool)
+			// only a failed write is retried, the command might have been executed if the read failed
+			var writeErr *connWriteError
+			attempts--
+			if !errors.As(err, &writeErr) || attempts <= 0 {
+				return nil, err
+			}
 
-			readBalancer := balancers[node.Primary]
-			readBalancer.addCacheNode(newNode)
+			continue
+		}
 
+		if reusable {
+			node.ConnPool.Return(poolConn)
 		} else {
-			return nil, fmt.Errorf("Unknown role: %s", node.Role)
+			node.ConnPool.discard(poolConn)
 		}
-	}
-
-	if enableLogging {
-
-		setupLogger()
 
+		return resp, nil
 	}
 
-	return &Client{
-		ring:      ring,
-		balancers: balancers,
-	}, nil
+	return nil, err
 }
 
-func validateCommand(cmdBytes []byte) error {
-	const maxTokenSize = 64 * 1024
-
-	if len(cmdBytes) > maxTokenSize {
-		getLogger().Debug("data exceeds the maximum allowed size of 64KB")
-		return fmt.Errorf("command exceeds the maximum allowed size of 64KB")
-
+// contextErr is like ctx.Err but it also reports a deadline that passed before the timer of ctx fired,
+// the deadline on the connection can expire first
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	if bytes.Contains(cmdBytes[:len(cmdBytes)-1], []byte("\n")) {
-		getLogger().Debug("Invalid Data, data can't contain the newline chars")
-		return fmt.Errorf("command cannot contain newline characters")
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
 	}
 
 	return nil
 }
 
-func (c *Client) sendCommand(node *CacheNode, cmd string) (string, error) {
+// connWriteError marks the errors that happened before the command reached the server
+type connWriteError struct {
+	err error
+}
 
-	cmdBytes := []byte(strings.TrimSpace(cmd) + "\n")
+func (e *connWriteError) Error() string {
+	return e.err.Error()
+}
 
-	if err := validateCommand(cmdBytes); err != nil {
+func (e *connWriteError) Unwrap() error {
+	return e.err
+}
 
-		getLogger().Debug("Error sending command:" + err.Error())
-		return "", err
+// roundTrip writes the commands and reads a line per command, the deadline of ctx is applied on the connection
+// and a cancellation interrupts a blocked write or read. The connection is not reusable if the
+// cancellation raced with the reply, its deadline might be set after it is returned to the pool
+func (pc *PoolConn) roundTrip(ctx context.Context, cmdBytes []byte, replies int, multiLine bool) ([]string, bool, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetDeadline(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(time.Now())
+	})
+
+	resp, err := pc.writeAndRead(cmdBytes, replies, multiLine)
 
+	if !stop() {
+		return resp, false, err
 	}
+	pc.conn.SetDeadline(time.Time{})
 
-	attempts := 2
-	var poolConn *PoolConn
-	var err error
+	return resp, true, err
+}
 
-	for attempts > 0 {
-		poolConn, err = node.ConnPool.Get()
-		if err != nil {
-			getLogger().Debug("Error in conn pool" + err.Error())
-			return "", err
-		}
+func (pc *PoolConn) writeAndRead(cmdBytes []byte, replies int, multiLine bool) ([]string, error) {
+	if _, err := pc.conn.Write(cmdBytes); err != nil {
+		return nil, &connWriteError{err: err}
+	}
 
-		getLogger().Debug("sendCommand: Before writing to the connection")
-		_, err = poolConn.conn.Write(cmdBytes)
-		getLogger().Debug("sendCommand: After writing to the connection")
+	pc.logger.Debug("sendCommand: Waiting for response")
 
-		if err != nil {
-			poolConn.Close()
-			attempts--
-			if attempts <= 0 {
-				return "", err
+	resp := make([]string, 0, replies)
+	for len(resp) < replies {
+		if !pc.scanner.Scan() {
+			if err := pc.scanner.Err(); err != nil {
+				return nil, err
 			}
 
-			continue
-
+			return nil, fmt.Errorf("no response")
 		}
+		resp = append(resp, pc.scanner.Text())
 
-		break
+		if multiLine && len(resp) == 1 {
+			if n, isHeader := parseLinesHeader(resp[0]); isHeader {
+				replies += n
+			}
+		}
 	}
-	defer node.ConnPool.Return(poolConn)
 
-	getLogger().Debug("sendCommand: Waiting for response")
+	return resp, nil
+}
 
-	if poolConn.scanner.Scan() {
-		getLogger().Debug("Data from read: " + poolConn.scanner.Text())
-		if poolConn.scanner.Text() == "ERROR: Key not found" {
-			return "", errorutil.ErrKeyNotFound
-		} else if strings.Contains(poolConn.scanner.Text(), "ERROR:") {
-			return "", fmt.Errorf(poolConn.scanner.Text())
-		}
-		return poolConn.scanner.Text(), nil
-	}
+func (c *Client) Set(k, v string) (string, error) {
+	return c.SetContext(context.Background(), k, v)
+}
 
-	if err := poolConn.scanner.Err(); err != nil {
+// SetContext is like Set but gives up when ctx is done, in that case the write might still be executed by the server
+func (c *Client) SetContext(ctx context.Context, k, v string) (string, error) {
+	c.logger.Debug("SET " + k + " " + v)
+	cmd := fmt.Sprintf("SET %s %s", k, v)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
 		return "", err
 	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	resp, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(k)
+	}
 
-	return "", fmt.Errorf("no response")
+	return resp, err
 }
 
-func (c *Client) Set(k, v string) (string, error) {
-	getLogger().Debug("SET " + k + " " + v)
-	cmd := fmt.Sprintf("SET %s %s", k, v)
+// SetWithTTL is like Set but the server removes the key when ttl passes, the precision is a millisecond
+func (c *Client) SetWithTTL(k, v string, ttl time.Duration) (string, error) {
+	return c.SetWithTTLContext(context.Background(), k, v, ttl)
+}
+
+// SetWithTTLContext is like SetWithTTL but gives up when ctx is done
+func (c *Client) SetWithTTLContext(ctx context.Context, k, v string, ttl time.Duration) (string, error) {
+	if ttl < time.Millisecond {
+		return "", fmt.Errorf("the TTL should be at least 1ms")
+	}
+
+	c.logger.Debug("PSETEX " + k + " " + v)
+	cmd := fmt.Sprintf("PSETEX %s %d %s", k, ttl.Milliseconds(), v)
 	primaryNode, err := c.ring.GetNode(k)
 	if err != nil {
 		return "", err
 	}
-	getLogger().Debug("node selected to send the request: " + primaryNode.ID)
-	resp, err := c.sendCommand(primaryNode, cmd)
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	resp, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(k)
+	}
+
+	return resp, err
+}
+
+func (c *Client) Get(k string, opts ...GetOption) (string, error) {
+	return c.GetContext(context.Background(), k, opts...)
+}
+
+// GetContext is like Get but gives up when ctx is done
+func (c *Client) GetContext(ctx context.Context, k string, opts ...GetOption) (string, error) {
+	c.logger.Debug("GET " + k)
+	options := c.getOptions(opts)
+
+	// the near cache is as fresh as a secondary, it serves only the eventual reads
+	if c.nearCache == nil || options.consistency != ConsistencyEventual {
+		resp, _, err := c.get(ctx, k, options.consistency)
+		return resp, err
+	}
+
+	if c.closed.Load() {
+		return "", ErrClientClosed
+	}
+
+	if resp, found := c.nearCache.get(k); found {
+		c.logger.Debug("GET " + k + " served from the near cache")
+		return resp, nil
+	}
+
+	c.nearCache.beginRead(k)
+	resp, node, err := c.get(ctx, k, options.consistency)
+	c.nearCache.endRead(k, resp, node, err == nil)
 
 	return resp, err
 }
 
-func (c *Client) Get(k string) (string, error) {
-	getLogger().Debug("GET " + k)
+// get reads the key from a node of its shard that satisfies the consistency and returns the node that replied
+func (c *Client) get(ctx context.Context, k string, consistency Consistency) (string, *CacheNode, error) {
 	cmd := fmt.Sprintf("GET %s", k)
 	primaryNode, err := c.ring.GetNode(k)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	balancer := c.balancers[primaryNode.ID]
 
+	switch consistency {
+	case ConsistencyPrimary:
+		c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+		resp, err := c.sendCommandContext(ctx, primaryNode, cmd)
+		return resp, primaryNode, err
+
+	case ConsistencySession:
+		// without a write on the shard any node will do
+		if token, exists := c.session.token(primaryNode.ID); exists {
+			return c.failover(ctx, balancer, func(node *CacheNode) (string, bool, error) {
+				return c.sessionRead(ctx, node, cmd, token)
+			})
+		}
+	}
+
+	if balancer.getStrategy() == Hedged {
+		return c.hedgedGet(ctx, balancer, cmd)
+	}
+
+	return c.failover(ctx, balancer, func(node *CacheNode) (string, bool, error) {
+		resp, err := c.sendCommandContext(ctx, node, cmd)
+		return resp, false, err
+	})
+}
+
+// failover tries the nodes of the balancer until one of them replies, read can skip a node without an error
+func (c *Client) failover(ctx context.Context, balancer *ReadBalancer, read func(*CacheNode) (string, bool, error)) (string, *CacheNode, error) {
+	tried := map[*CacheNode]bool{}
+
 	for {
 
-		node, err := balancer.getNextCacheNode()
+		node, err := balancer.getNextCacheNode(tried)
 		if err != nil {
-			getLogger().Error(err.Error())
-			return "", err
+			c.logger.Error(err.Error())
+			return "", nil, err
+		}
+		tried[node] = true
+		c.logger.Debug("node selected to send the request: " + node.ID)
+		resp, skip, err := read(node)
+
+		if skip {
+			continue
 		}
-		getLogger().Debug("node selected to send the request: " + node.ID)
-		resp, err := c.sendCommand(node, cmd)
 
 		if err != nil {
 			switch {
-			case errors.Is(err, errorutil.ErrKeyNotFound):
-				return "", err
+			case isReplyError(err):
+				return "", node, err
+			case contextErr(ctx) != nil:
+				return "", node, err
 			default:
-				// set unhealthy
-				getLogger().Warn("node: " + node.ID + " set to UnHealthy")
-				node.SetUnhealthy(time.Duration(balancer.cfg.UnHealthyInterval) * time.Second)
+				// the breaker of the node counted the failure, try the next one
+				c.logger.Warn("GET from node: " + node.ID + " failed: " + err.Error())
 				continue
 			}
 		}
 
-		return resp, err
+		return resp, node, err
 	}
 
 }
@@ -392,17 +594,55 @@ func (c *Client) Ping(node *CacheNode) (string, error) {
 }
 
 func (c *Client) Delete(k string) (string, error) {
-	getLogger().Debug("DELETE " + k)
+	return c.DeleteContext(context.Background(), k)
+}
+
+// DeleteContext is like Delete but gives up when ctx is done, in that case the delete might still be executed by the server
+func (c *Client) DeleteContext(ctx context.Context, k string) (string, error) {
+	c.logger.Debug("DELETE " + k)
 	cmd := fmt.Sprintf("DELETE %s", k)
 	primaryNode, err := c.ring.GetNode(k)
 	if err != nil {
 		return "", err
 	}
-	getLogger().Debug("node selected to send the request: " + primaryNode.ID)
-	res, err := c.sendCommand(primaryNode, cmd)
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	res, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(k)
+	}
 
 	return res, err
 
 }
 
-// pending to implement the other commands, FLUSH DELETE
+// SetIfNewer is used by the cross cluster replication, the primary keeps the value only if timestamp is newer than the
+// current one. A zero expiresAt keeps the value until it is deleted
+func (c *Client) SetIfNewer(k, v string, expiresAt time.Time, timestamp uint64, origin string) (string, error) {
+	c.logger.Debug("XSET " + k + " " + v)
+	expires := int64(0)
+	if !expiresAt.IsZero() {
+		expires = expiresAt.UnixMilli()
+	}
+	cmd := fmt.Sprintf("XSET %s %d %s %d %s", k, timestamp, origin, expires, v)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+
+	return c.sendCommand(primaryNode, cmd)
+}
+
+// DeleteIfNewer is used by the cross cluster replication, the primary deletes the key only if timestamp is newer than the current value
+func (c *Client) DeleteIfNewer(k string, timestamp uint64, origin string) (string, error) {
+	c.logger.Debug("XDELETE " + k)
+	cmd := fmt.Sprintf("XDELETE %s %d %s", k, timestamp, origin)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+
+	return c.sendCommand(primaryNode, cmd)
+}
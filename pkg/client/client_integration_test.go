@@ -34,6 +34,7 @@ func TestRealServerInteraction(t *testing.T) {
 
 	client := &Client{
 		ring:      ring,
+		logger:    &NoOpLogger{},
 		balancers: balancers,
 	}
 	// Test Ping
@@ -90,6 +91,7 @@ func TestRealServerInteractionConcurrently(t *testing.T) {
 
 	client := &Client{
 		ring:      ring,
+		logger:    &NoOpLogger{},
 		balancers: balancers,
 	}
 	// Test Ping
@@ -188,6 +190,7 @@ func TestRoundRobinInMultipleRealServersInteraction(t *testing.T) {
 
 	client := &Client{
 		ring:      ring,
+		logger:    &NoOpLogger{},
 		balancers: balancers,
 	}
 
@@ -273,6 +276,7 @@ func TestRoundRobinInMultipleRealServersInteractionWithBlacklisting(t *testing.T
 
 	client := &Client{
 		ring:      ring,
+		logger:    &NoOpLogger{},
 		balancers: balancers,
 	}
 
@@ -317,3 +321,127 @@ func TestRoundRobinInMultipleRealServersInteractionWithBlacklisting(t *testing.T
 	}
 
 }
+
+func newSingleNodeClient(port int) *Client {
+	clientConf := config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15}
+
+	pool := NewConnPool(2, fmt.Sprintf("localhost:%d", port), clientConf)
+	newNode := NewCacheNode("testNode", true, pool)
+
+	ring := NewHashRing()
+	ring.AddNode(newNode)
+	newBalancer := NewReadBalancer(clientConf)
+	newBalancer.addCacheNode(newNode)
+
+	return &Client{
+		ring:      ring,
+		logger:    &NoOpLogger{},
+		balancers: map[string]*ReadBalancer{"testNode": newBalancer},
+	}
+}
+
+func TestNearCacheInvalidation(t *testing.T) {
+
+	listener, err := startTestServer(t, 10, 12350, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12350)
+	if err := client.EnableNearCache(NearCacheOptions{Size: 10, Tracking: true}); err != nil {
+		t.Fatal(err)
+	}
+	writer := newSingleNodeClient(12350)
+
+	// wait for the invalidation connection, the values are not kept before it is ready
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.nearCache.lock.Lock()
+		ready := client.nearCache.ready["testNode"]
+		client.nearCache.lock.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("invalidation connection was not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := writer.Set("testkey", "testvalue"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get("testkey"); err != nil || resp != "testvalue" {
+		t.Fatalf("Get failed: resp=%s, err=%v", resp, err)
+	}
+	if _, found := client.nearCache.get("testkey"); !found {
+		t.Fatal("expected the value to be kept in the near cache")
+	}
+
+	// a write from another client invalidates the local value
+	if _, err := writer.Set("testkey", "newvalue"); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		if _, found := client.nearCache.get("testkey"); !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the near cache was not invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp, err := client.Get("testkey"); err != nil || resp != "newvalue" {
+		t.Errorf("Get failed: resp=%s, err=%v", resp, err)
+	}
+}
+
+func TestNearCacheWithoutTracking(t *testing.T) {
+
+	listener, err := startTestServer(t, 10, 12351, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	if err := newSingleNodeClient(12351).EnableNearCache(NearCacheOptions{Size: 10}); err == nil {
+		t.Error("expected an error without a TTL and tracking")
+	}
+
+	client := newSingleNodeClient(12351)
+	if err := client.EnableNearCache(NearCacheOptions{Size: 10, TTL: 300 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	writer := newSingleNodeClient(12351)
+
+	if _, err := client.Set("testkey", "testvalue"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get("testkey"); err != nil || resp != "testvalue" {
+		t.Fatalf("Get failed: resp=%s, err=%v", resp, err)
+	}
+
+	// without tracking the value of another client is seen after the TTL
+	if _, err := writer.Set("testkey", "newvalue"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get("testkey"); err != nil || resp != "testvalue" {
+		t.Errorf("expected the value of the near cache: resp=%s, err=%v", resp, err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if resp, err := client.Get("testkey"); err != nil || resp != "newvalue" {
+		t.Errorf("expected the new value after the TTL: resp=%s, err=%v", resp, err)
+	}
+
+	// the own writes are never served stale
+	if _, err := client.Set("testkey", "ownvalue"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get("testkey"); err != nil || resp != "ownvalue" {
+		t.Errorf("Get failed: resp=%s, err=%v", resp, err)
+	}
+}
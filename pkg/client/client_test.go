@@ -2,6 +2,8 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -67,6 +69,7 @@ func TestClient(t *testing.T) {
 
 	client := &Client{
 		ring:      ring,
+		logger:    &NoOpLogger{},
 		balancers: balancers,
 	}
 
@@ -127,10 +130,9 @@ func TestValidateCommand(t *testing.T) {
 			errMsg:    "command exceeds the maximum allowed size of 64KB",
 		},
 		{
-			name:      "Contains Illegal Newline",
-			cmdBytes:  []byte("SET key value\nanother"),
-			wantError: true,
-			errMsg:    "command cannot contain newline characters",
+			name:      "Can Contain Newline",
+			cmdBytes:  []byte("$21\nSET key value\nanother\n"),
+			wantError: false,
 		},
 		{
 			name:      "Can Contain Escaped Illegal Newline",
@@ -150,3 +152,101 @@ func TestValidateCommand(t *testing.T) {
 		})
 	}
 }
+
+// a server that accepts the commands but never replies
+func startHungServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestContextDeadline(t *testing.T) {
+	listener := startHungServer(t)
+	defer listener.Close()
+
+	clientConf := config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15}
+	pool := NewConnPool(1, listener.Addr().String(), clientConf)
+	newNode := NewCacheNode("testNode", true, pool)
+
+	ring := NewHashRing()
+	ring.AddNode(newNode)
+	newBalancer := NewReadBalancer(clientConf)
+	newBalancer.addCacheNode(newNode)
+
+	client := &Client{
+		ring:      ring,
+		logger:    &NoOpLogger{},
+		balancers: map[string]*ReadBalancer{"testNode": newBalancer},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.GetContext(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetContext returned after %s", elapsed)
+	}
+
+	// the connection that timed out might receive the reply later so it must not be reused
+	if len(pool.pool) != 0 {
+		t.Error("the interrupted connection was returned to the pool")
+	}
+
+	// the caller gave up, the node is still considered healthy
+	if newNode.State() != BreakerClosed {
+		t.Error("the node was set unhealthy because of the deadline of the caller")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := client.SetContext(ctx, "key", "value"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+}
+
+func TestContextCancelsDial(t *testing.T) {
+	// nothing listens on the port so every dial fails and is retried with a backoff
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	pool := NewConnPool(1, address, config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := pool.GetContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("the dial backoff ignored the context, returned after %s", elapsed)
+	}
+}
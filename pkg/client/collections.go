@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HSet sets a field of a hash and reports if the field is new. A key that holds another type fails with
+// errorutil.ErrWrongType, like every method of the hashes, the lists and the sets
+func (c *Client) HSet(ctx context.Context, key, field, value string) (bool, error) {
+	resp, err := c.collectionWrite(ctx, key, fmt.Sprintf("HSET %s %s %s", key, field, value))
+	return resp == "1", err
+}
+
+// HGet returns the value of a field of a hash, errorutil.ErrKeyNotFound if the key or the field doesn't exist
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	return c.collectionRead(ctx, key, fmt.Sprintf("HGET %s %s", key, field))
+}
+
+// HDel removes fields of a hash and returns how many existed, the key is removed with its last field
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int, error) {
+	return c.collectionCount(ctx, key, "HDEL "+key+" "+strings.Join(fields, " "))
+}
+
+// HGetAll returns the fields of a hash with their values, it is empty if the key doesn't exist
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	lines, err := c.collectionReadLines(ctx, key, "HGETALL "+key)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply to HGETALL: %d lines", len(lines))
+	}
+
+	hash := make(map[string]string, len(lines)/2)
+	for i := 0; i < len(lines); i += 2 {
+		hash[lines[i]] = lines[i+1]
+	}
+
+	return hash, nil
+}
+
+// LPush adds a value at the head of a list and returns the length of the list
+func (c *Client) LPush(ctx context.Context, key, value string) (int, error) {
+	return c.collectionCount(ctx, key, fmt.Sprintf("LPUSH %s %s", key, value))
+}
+
+// RPush adds a value at the tail of a list and returns the length of the list
+func (c *Client) RPush(ctx context.Context, key, value string) (int, error) {
+	return c.collectionCount(ctx, key, fmt.Sprintf("RPUSH %s %s", key, value))
+}
+
+// LPop removes and returns the head of a list, errorutil.ErrKeyNotFound if the list is empty
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.collectionWrite(ctx, key, "LPOP "+key)
+}
+
+// RPop removes and returns the tail of a list, errorutil.ErrKeyNotFound if the list is empty
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.collectionWrite(ctx, key, "RPOP "+key)
+}
+
+// LRange returns the elements of a list from start to stop, both included. A negative index counts from the end,
+// so 0, -1 returns the whole list
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return c.collectionReadLines(ctx, key, fmt.Sprintf("LRANGE %s %d %d", key, start, stop))
+}
+
+// SAdd adds members to a set and returns how many were new
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int, error) {
+	return c.collectionCount(ctx, key, "SADD "+key+" "+strings.Join(members, " "))
+}
+
+// SRem removes members of a set and returns how many existed, the key is removed with its last member
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int, error) {
+	return c.collectionCount(ctx, key, "SREM "+key+" "+strings.Join(members, " "))
+}
+
+// SMembers returns the members of a set sorted, it is empty if the key doesn't exist
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return c.collectionReadLines(ctx, key, "SMEMBERS "+key)
+}
+
+// SIsMember reports if member belongs to the set
+func (c *Client) SIsMember(ctx context.Context, key, member string) (bool, error) {
+	resp, err := c.collectionRead(ctx, key, fmt.Sprintf("SISMEMBER %s %s", key, member))
+	return resp == "1", err
+}
+
+// collectionWrite sends a write of a collection to the primary of the key
+func (c *Client) collectionWrite(ctx context.Context, key string, cmd string) (string, error) {
+	c.logger.Debug(cmd)
+	primaryNode, err := c.ring.GetNode(key)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	resp, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(key)
+	}
+
+	return resp, err
+}
+
+// collectionCount sends a write of a collection that replies with a count
+func (c *Client) collectionCount(ctx context.Context, key string, cmd string) (int, error) {
+	resp, err := c.collectionWrite(ctx, key, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := strconv.Atoi(resp)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply: %s", resp)
+	}
+
+	return count, nil
+}
+
+// collectionRead reads a single line from a node of the shard of the key, the near cache is not used
+func (c *Client) collectionRead(ctx context.Context, key string, cmd string) (string, error) {
+	c.logger.Debug(cmd)
+	primaryNode, err := c.ring.GetNode(key)
+	if err != nil {
+		return "", err
+	}
+
+	resp, _, err := c.failover(ctx, c.balancers[primaryNode.ID], func(node *CacheNode) (string, bool, error) {
+		resp, err := c.sendCommandContext(ctx, node, cmd)
+		return resp, false, err
+	})
+
+	return resp, err
+}
+
+// collectionReadLines reads a *<n> reply from a node of the shard of the key
+func (c *Client) collectionReadLines(ctx context.Context, key string, cmd string) ([]string, error) {
+	c.logger.Debug(cmd)
+	primaryNode, err := c.ring.GetNode(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	_, _, err = c.failover(ctx, c.balancers[primaryNode.ID], func(node *CacheNode) (string, bool, error) {
+		var err error
+		lines, err = c.sendLines(ctx, node, cmd)
+		return "", false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
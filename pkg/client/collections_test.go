@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+func TestCollections(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12367, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12367"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	if isNew, err := client.HSet(ctx, "user", "name", "gopher"); err != nil || !isNew {
+		t.Errorf("HSet failed: new=%v, err=%v", isNew, err)
+	}
+	client.HSet(ctx, "user", "bio", "likes go")
+	if value, err := client.HGet(ctx, "user", "bio"); err != nil || value != "likes go" {
+		t.Errorf("HGet failed: value=%s, err=%v", value, err)
+	}
+	if _, err := client.HGet(ctx, "user", "age"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if removed, err := client.HDel(ctx, "user", "bio", "age"); err != nil || removed != 1 {
+		t.Errorf("HDel failed: removed=%d, err=%v", removed, err)
+	}
+	if hash, err := client.HGetAll(ctx, "user"); err != nil || !reflect.DeepEqual(hash, map[string]string{"name": "gopher"}) {
+		t.Errorf("HGetAll failed: hash=%v, err=%v", hash, err)
+	}
+
+	client.RPush(ctx, "queue", "b")
+	if length, err := client.LPush(ctx, "queue", "a"); err != nil || length != 2 {
+		t.Errorf("LPush failed: length=%d, err=%v", length, err)
+	}
+	if values, err := client.LRange(ctx, "queue", 0, -1); err != nil || !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("LRange failed: values=%v, err=%v", values, err)
+	}
+	if value, err := client.RPop(ctx, "queue"); err != nil || value != "b" {
+		t.Errorf("RPop failed: value=%s, err=%v", value, err)
+	}
+	if value, err := client.LPop(ctx, "queue"); err != nil || value != "a" {
+		t.Errorf("LPop failed: value=%s, err=%v", value, err)
+	}
+	if _, err := client.LPop(ctx, "queue"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound for an empty list, got %v", err)
+	}
+
+	if added, err := client.SAdd(ctx, "tags", "go", "cache", "go"); err != nil || added != 2 {
+		t.Errorf("SAdd failed: added=%d, err=%v", added, err)
+	}
+	if member, err := client.SIsMember(ctx, "tags", "go"); err != nil || !member {
+		t.Errorf("SIsMember failed: member=%v, err=%v", member, err)
+	}
+	client.SRem(ctx, "tags", "go")
+	if members, err := client.SMembers(ctx, "tags"); err != nil || !reflect.DeepEqual(members, []string{"cache"}) {
+		t.Errorf("SMembers failed: members=%v, err=%v", members, err)
+	}
+
+	// the type errors are not retried on another node
+	if _, err := client.Get("tags"); !errors.Is(err, errorutil.ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+	if _, err := client.SMembers(ctx, "user"); !errors.Is(err, errorutil.ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+	if _, err := client.LPush(ctx, "user", "value"); !errors.Is(err, errorutil.ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+}
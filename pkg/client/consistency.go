@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Consistency selects the nodes that can serve a read
+type Consistency int
+
+const (
+	// any node of the shard, a secondary might not have received the latest writes yet
+	ConsistencyEventual Consistency = iota
+	// only the primary of the shard
+	ConsistencyPrimary
+	// the primary or a secondary that has applied the last write of this client on the shard
+	ConsistencySession
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyEventual:
+		return "eventual"
+	case ConsistencyPrimary:
+		return "primary"
+	case ConsistencySession:
+		return "session"
+	default:
+		return "unknown"
+	}
+}
+
+func parseConsistency(name string) (Consistency, error) {
+	switch name {
+	case "", "eventual":
+		return ConsistencyEventual, nil
+	case "primary":
+		return ConsistencyPrimary, nil
+	case "session":
+		return ConsistencySession, nil
+	default:
+		return ConsistencyEventual, fmt.Errorf("unknown consistency: %s", name)
+	}
+}
+
+// GetOption changes a single read
+type GetOption func(*getOptions)
+
+type getOptions struct {
+	consistency Consistency
+}
+
+// WithConsistency overrides the default consistency of the client for a read
+func WithConsistency(consistency Consistency) GetOption {
+	return func(opts *getOptions) {
+		opts.consistency = consistency
+	}
+}
+
+func (c *Client) getOptions(opts []GetOption) getOptions {
+	options := getOptions{consistency: c.consistency}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// SetConsistency sets the default consistency of the reads
+func (c *Client) SetConsistency(consistency Consistency) {
+	c.consistency = consistency
+}
+
+// replPosition is a position in the write stream of a primary, the reply to OFFSET. The offsets start from zero every
+// time a primary starts, so they are compared only within the same replication id
+type replPosition struct {
+	id     string
+	offset uint64
+}
+
+// covers reports whether a node at the position has applied the write at token
+func (p replPosition) covers(token replPosition) bool {
+	return p.id == token.id && p.offset >= token.offset
+}
+
+// parsePosition parses <replication id> <offset>
+func parsePosition(reply string) (replPosition, error) {
+	fields := strings.Fields(reply)
+	if len(fields) != 2 {
+		return replPosition{}, fmt.Errorf("unexpected reply to OFFSET: %s", reply)
+	}
+	offset, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return replPosition{}, fmt.Errorf("unexpected reply to OFFSET: %s", reply)
+	}
+
+	return replPosition{id: fields[0], offset: offset}, nil
+}
+
+// session keeps the replication position of the last write of the client per shard
+type session struct {
+	lock sync.Mutex
+	// primary id -> position
+	tokens map[string]replPosition
+}
+
+// observe keeps the position of a write. A position with another replication id replaces the token, the primary
+// restarted and the old offsets mean nothing anymore
+func (s *session) observe(primaryId string, position replPosition) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[string]replPosition)
+	}
+	if token, exists := s.tokens[primaryId]; !exists || token.id != position.id || position.offset > token.offset {
+		s.tokens[primaryId] = position
+	}
+}
+
+// observeReply keeps the position of a write from the reply to OFFSET. A server that doesn't know OFFSET replies with
+// an error, the token then has no replication id so no secondary covers it and the session reads go to the primary
+func (s *session) observeReply(primaryId string, reply string) {
+	position, err := parsePosition(reply)
+	if err != nil {
+		position = replPosition{offset: ^uint64(0)}
+	}
+	s.observe(primaryId, position)
+}
+
+// token returns the position of the last write on the shard, false without a write
+func (s *session) token(primaryId string) (replPosition, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, exists := s.tokens[primaryId]
+	return token, exists
+}
+
+// write sends a write to the primary together with an OFFSET in the same round trip, the server executes them in order
+// so the offset covers the write and it becomes the session token of the shard
+func (c *Client) write(ctx context.Context, primaryNode *CacheNode, cmd string) (string, error) {
+	replies, err := c.pipeline(ctx, primaryNode, cmd, "OFFSET")
+	if err != nil {
+		return "", err
+	}
+
+	c.session.observeReply(primaryNode.ID, replies[1])
+
+	return parseReply(replies[0])
+}
+
+// sessionRead reads from a node that has applied the token. The position of a secondary is asked in the same round
+// trip as the read, a secondary that is behind or follows another replication id is skipped and the primary is
+// always up to date
+func (c *Client) sessionRead(ctx context.Context, node *CacheNode, cmd string, token replPosition) (string, bool, error) {
+	if position := node.position.Load(); node.IsPrimary || (position != nil && position.covers(token)) {
+		resp, err := c.sendCommandContext(ctx, node, cmd)
+		return resp, false, err
+	}
+
+	replies, err := c.pipeline(ctx, node, "OFFSET", cmd)
+	if err != nil {
+		return "", false, err
+	}
+
+	// a position that can't be parsed covers nothing
+	position, _ := parsePosition(replies[0])
+	node.position.Store(&position)
+
+	if !position.covers(token) {
+		c.logger.Debug("node: " + node.ID + " is behind the session, offset " + replies[0])
+		return "", true, nil
+	}
+
+	resp, err := parseReply(replies[1])
+	return resp, false, err
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+// offsetServer replies to GET with a fixed value and to OFFSET with a position that the test controls
+type offsetServer struct {
+	listener net.Listener
+	value    string
+	position atomic.Pointer[replPosition]
+	gets     atomic.Int64
+}
+
+func (s *offsetServer) setPosition(id string, offset uint64) {
+	s.position.Store(&replPosition{id: id, offset: offset})
+}
+
+func startOffsetServer(t *testing.T, value string, offset uint64) *offsetServer {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &offsetServer{listener: listener, value: value}
+	server.setPosition("run1", offset)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					switch cmd := scanner.Text(); {
+					case cmd == "OFFSET":
+						position := server.position.Load()
+						fmt.Fprintf(conn, "%s %d\n", position.id, position.offset)
+					case strings.HasPrefix(cmd, "GET"):
+						server.gets.Add(1)
+						fmt.Fprintf(conn, "%s\n", server.value)
+					default:
+						fmt.Fprintf(conn, "OK\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func TestReadConsistency(t *testing.T) {
+	primary := startOffsetServer(t, "new", 5)
+	defer primary.listener.Close()
+	secondary := startOffsetServer(t, "old", 3)
+	defer secondary.listener.Close()
+
+	clientConf := config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15}
+	primaryNode := NewCacheNode("primary", true, NewConnPool(1, primary.listener.Addr().String(), clientConf))
+	secondaryNode := NewCacheNode("secondary", false, NewConnPool(1, secondary.listener.Addr().String(), clientConf))
+
+	ring := NewHashRing()
+	ring.AddNode(primaryNode)
+	balancer := NewReadBalancer(clientConf)
+	balancer.addCacheNode(primaryNode)
+	balancer.addCacheNode(secondaryNode)
+
+	client := &Client{
+		ring:      ring,
+		logger:    &NoOpLogger{},
+		balancers: map[string]*ReadBalancer{"primary": balancer},
+	}
+
+	readAll := func(opts ...GetOption) map[string]int {
+		values := map[string]int{}
+		for i := 0; i < 4; i++ {
+			resp, err := client.Get("key", opts...)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			values[resp]++
+		}
+		return values
+	}
+
+	// without a write the session reads go to any node
+	if values := readAll(WithConsistency(ConsistencySession)); values["old"] != 2 || values["new"] != 2 {
+		t.Errorf("expected the reads to be spread, got %v", values)
+	}
+
+	if _, err := client.Set("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := client.session.token("primary"); token != (replPosition{id: "run1", offset: 5}) {
+		t.Fatalf("expected the session token run1 5, got %+v", token)
+	}
+
+	// the secondary is behind the write
+	if values := readAll(WithConsistency(ConsistencySession)); values["new"] != 4 {
+		t.Errorf("expected only the primary to serve the session reads, got %v", values)
+	}
+	if values := readAll(); values["old"] != 2 {
+		t.Errorf("expected the eventual reads to use the secondary, got %v", values)
+	}
+
+	// the secondary caught up, it serves the session reads again
+	secondary.setPosition("run1", 5)
+	client.SetConsistency(ConsistencySession)
+	if values := readAll(); values["old"] != 2 {
+		t.Errorf("expected the secondary to serve the session reads, got %v", values)
+	}
+
+	// its position is remembered, it is not asked again
+	if position := secondaryNode.position.Load(); position == nil || *position != (replPosition{id: "run1", offset: 5}) {
+		t.Errorf("expected the position of the secondary to be kept, got %+v", position)
+	}
+
+	secondaryGets := secondary.gets.Load()
+	if values := readAll(WithConsistency(ConsistencyPrimary)); values["new"] != 4 {
+		t.Errorf("expected only the primary to serve the reads, got %v", values)
+	}
+	if secondary.gets.Load() != secondaryGets {
+		t.Error("the secondary was queried by a primary read")
+	}
+
+	// the primary restarted and the secondary synced with it before the write arrived, its offset is higher but it
+	// belongs to another replication id
+	secondaryNode.position.Store(nil)
+	secondary.setPosition("run2", 7)
+	client.session.observe("primary", replPosition{id: "run1", offset: 6})
+	if values := readAll(); values["new"] != 4 {
+		t.Errorf("expected a secondary of another replication id to be skipped, got %v", values)
+	}
+
+	// a write on the restarted primary replaces the token, its offset starts from zero again
+	primary.setPosition("run2", 2)
+	if _, err := client.Set("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := client.session.token("primary"); token != (replPosition{id: "run2", offset: 2}) {
+		t.Fatalf("expected the session token run2 2, got %+v", token)
+	}
+	if values := readAll(); values["old"] != 2 {
+		t.Errorf("expected the secondary to serve the session reads of the new replication id, got %v", values)
+	}
+}
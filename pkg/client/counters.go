@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Incr adds 1 to the integer value of the key and returns the new value, a missing key counts as 0
+func (c *Client) Incr(k string) (int64, error) {
+	return c.IncrByContext(context.Background(), k, 1)
+}
+
+// Decr subtracts 1 from the integer value of the key and returns the new value, a missing key counts as 0
+func (c *Client) Decr(k string) (int64, error) {
+	return c.IncrByContext(context.Background(), k, -1)
+}
+
+// IncrBy adds delta to the integer value of the key and returns the new value, a missing key counts as 0
+func (c *Client) IncrBy(k string, delta int64) (int64, error) {
+	return c.IncrByContext(context.Background(), k, delta)
+}
+
+// IncrByContext is like IncrBy but gives up when ctx is done. The increment is atomic on the primary of the key
+func (c *Client) IncrByContext(ctx context.Context, k string, delta int64) (int64, error) {
+	resp, err := c.counter(ctx, k, fmt.Sprintf("INCRBY %s %d", k, delta))
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseInt(resp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply to INCRBY: %s", resp)
+	}
+
+	return value, nil
+}
+
+// IncrByFloat adds delta to the numeric value of the key and returns the new value, a missing key counts as 0
+func (c *Client) IncrByFloat(k string, delta float64) (float64, error) {
+	return c.IncrByFloatContext(context.Background(), k, delta)
+}
+
+// IncrByFloatContext is like IncrByFloat but gives up when ctx is done
+func (c *Client) IncrByFloatContext(ctx context.Context, k string, delta float64) (float64, error) {
+	resp, err := c.counter(ctx, k, "INCRBYFLOAT "+k+" "+strconv.FormatFloat(delta, 'f', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseFloat(resp, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply to INCRBYFLOAT: %s", resp)
+	}
+
+	return value, nil
+}
+
+// counter sends an increment to the primary of the key
+func (c *Client) counter(ctx context.Context, k string, cmd string) (string, error) {
+	c.logger.Debug(cmd)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	resp, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(k)
+	}
+
+	return resp, err
+}
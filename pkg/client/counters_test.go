@@ -0,0 +1,59 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12365, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12365"), WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if value, err := client.Incr("counter"); err != nil || value != 1 {
+		t.Errorf("Incr failed: value=%d, err=%v", value, err)
+	}
+	if value, err := client.IncrBy("counter", 41); err != nil || value != 42 {
+		t.Errorf("IncrBy failed: value=%d, err=%v", value, err)
+	}
+	if value, err := client.Decr("counter"); err != nil || value != 41 {
+		t.Errorf("Decr failed: value=%d, err=%v", value, err)
+	}
+	if value, err := client.IncrByFloat("price", 1.5); err != nil || value != 1.5 {
+		t.Errorf("IncrByFloat failed: value=%v, err=%v", value, err)
+	}
+
+	client.Set("text", "hello")
+	if _, err := client.Incr("text"); err == nil || !strings.Contains(err.Error(), "not an integer") {
+		t.Errorf("expected an error for a value that is not an integer, got %v", err)
+	}
+
+	// the increments of several goroutines are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := client.Incr("concurrent"); err != nil {
+					t.Errorf("Incr failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := client.Get("concurrent"); err != nil || value != "400" {
+		t.Errorf("expected 400, got %s (err=%v)", value, err)
+	}
+}
@@ -1,12 +1,13 @@
 package client
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/sharding"
 )
 
 type CacheNode struct {
@@ -14,29 +15,39 @@ type CacheNode struct {
 	IsPrimary bool
 	Hash      uint32
 	*ConnPool
-	Unhealthy  bool
-	RetryAt    time.Time
-	HealthLock sync.Mutex // Lock for controling the health status and the timestamp of it
+	breaker *circuitBreaker
+	stats   *nodeStats
+	// the last replication position that the node reported
+	position atomic.Pointer[replPosition]
 }
 
 func NewCacheNode(id string, isPrimary bool, pool *ConnPool) *CacheNode {
-	hash := sha1.New()
-	hash.Write([]byte(pool.address))
+	breaker := newCircuitBreaker(id, pool.cfg)
+	breaker.logger = pool.logger
 
 	return &CacheNode{
 		ID:        id,
 		IsPrimary: isPrimary,
-		Hash:      binary.BigEndian.Uint32(hash.Sum(nil)[:4]),
+		Hash:      sharding.Hash(pool.address),
 		ConnPool:  pool,
+		breaker:   breaker,
+		stats:     newNodeStats(),
 	}
 }
 
+// SetUnhealthy opens the breaker of the node, no request is sent to it until delay passes
 func (node *CacheNode) SetUnhealthy(delay time.Duration) {
-	node.HealthLock.Lock()
-	defer node.HealthLock.Unlock()
+	node.breaker.trip(delay)
+}
+
+// Address returns the host:port of the node
+func (node *CacheNode) Address() string {
+	return node.ConnPool.address
+}
 
-	node.Unhealthy = true
-	node.RetryAt = time.Now().Add(delay)
+// State returns the state of the breaker of the node
+func (node *CacheNode) State() BreakerState {
+	return node.breaker.State()
 }
 
 type HashRing interface {
@@ -77,6 +88,8 @@ func (s *SimpleHashRing) RemoveNode(node *CacheNode) {
 
 }
 
+// GetNode returns the primary of the key. A key with a {tag} is placed by the tag, so the keys that share it live on
+// the same primary and can be used together in a transaction, see sharding.HashTag
 // In case a discovery functionality is added, the mutexes should be used
 // Take the risky road and avoid using the mutexes for now since we only read, for now...
 func (s *SimpleHashRing) GetNode(key string) (*CacheNode, error) {
@@ -84,10 +97,7 @@ func (s *SimpleHashRing) GetNode(key string) (*CacheNode, error) {
 		return nil, fmt.Errorf("ring is empty")
 	}
 
-	hash := sha1.New()
-	hash.Write([]byte(key))
-	// common practice to use 32-bit, also performs faster in calculations
-	keyHash := binary.BigEndian.Uint32(hash.Sum(nil)[:4])
+	keyHash := sharding.KeyHash(key)
 	// fmt.Println("keyHash  ", keyHash)
 	//
 	// for _, node := range s.nodes {
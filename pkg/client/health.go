@@ -0,0 +1,319 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/logger"
+)
+
+// BreakerState is the state of the circuit breaker of a node
+type BreakerState int
+
+const (
+	// the requests flow and their outcomes are counted
+	BreakerClosed BreakerState = iota
+	// the node failed too often, the requests are rejected until the cooldown passes
+	BreakerOpen
+	// the cooldown passed, a single trial request decides if the breaker closes or opens again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeStateChange is passed to the observers that are registered with Client.OnNodeStateChange
+type NodeStateChange struct {
+	Node string
+	From BreakerState
+	To   BreakerState
+	At   time.Time
+}
+
+// ErrNodeUnavailable is returned without contacting a node while its breaker is open
+var ErrNodeUnavailable = errors.New("node is unavailable")
+
+const (
+	defaultBreakerWindow = 20
+	// a node that fails its first request is not used until the cooldown passes
+	defaultBreakerMinRequests = 1
+	defaultBreakerFailureRate = 0.5
+)
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// the caller gave up, it says nothing about the health of the node
+	outcomeIgnored
+)
+
+type circuitBreaker struct {
+	lock  sync.Mutex
+	node  string
+	state BreakerState
+	// the outcomes of the last requests, true is a failure
+	window      []bool
+	next        int
+	count       int
+	failures    int
+	minRequests int
+	failureRate float64
+	cooldown    time.Duration
+	retryAt     time.Time
+	// a trial request is in flight
+	trial     bool
+	observers []func(NodeStateChange)
+	logger    logger.Logger
+}
+
+func newCircuitBreaker(node string, cfg config.ClientConfig) *circuitBreaker {
+	window := cfg.BreakerWindow
+	if window <= 0 {
+		window = defaultBreakerWindow
+	}
+
+	minRequests := cfg.BreakerMinRequests
+	if minRequests <= 0 {
+		minRequests = defaultBreakerMinRequests
+	}
+	if minRequests > window {
+		minRequests = window
+	}
+
+	failureRate := cfg.BreakerFailureRate
+	if failureRate <= 0 || failureRate > 1 {
+		failureRate = defaultBreakerFailureRate
+	}
+
+	return &circuitBreaker{
+		node:        node,
+		window:      make([]bool, window),
+		minRequests: minRequests,
+		failureRate: failureRate,
+		cooldown:    time.Duration(cfg.UnHealthyInterval) * time.Second,
+		logger:      &NoOpLogger{},
+	}
+}
+
+func (cb *circuitBreaker) State() BreakerState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	return cb.state
+}
+
+func (cb *circuitBreaker) addObserver(observer func(NodeStateChange)) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.observers = append(cb.observers, observer)
+}
+
+// available reports if a request would be allowed without reserving the trial, it is used to pick a node
+func (cb *circuitBreaker) available() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		return !time.Now().Before(cb.retryAt)
+	case BreakerHalfOpen:
+		return !cb.trial
+	default:
+		return true
+	}
+}
+
+// acquire must be called before a request, trial is passed to done with the outcome of the request
+func (cb *circuitBreaker) acquire() (allowed bool, trial bool) {
+	cb.lock.Lock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Now().Before(cb.retryAt) {
+			cb.lock.Unlock()
+			return false, false
+		}
+		change := cb.setState(BreakerHalfOpen)
+		cb.trial = true
+		observers := cb.observers
+		cb.lock.Unlock()
+
+		cb.notify(observers, change)
+		return true, true
+
+	case BreakerHalfOpen:
+		defer cb.lock.Unlock()
+		if cb.trial {
+			return false, false
+		}
+		cb.trial = true
+		return true, true
+
+	default:
+		cb.lock.Unlock()
+		return true, false
+	}
+}
+
+func (cb *circuitBreaker) done(result outcome, trial bool) {
+	cb.lock.Lock()
+
+	var change *NodeStateChange
+
+	switch {
+	case trial && cb.state == BreakerHalfOpen:
+		cb.trial = false
+		switch result {
+		case outcomeSuccess:
+			change = cb.setState(BreakerClosed)
+		case outcomeFailure:
+			change = cb.open(cb.cooldown)
+		}
+
+	case !trial && cb.state == BreakerClosed && result != outcomeIgnored:
+		// the requests that started before the breaker opened are not counted
+		failed := result == outcomeFailure
+		if cb.count == len(cb.window) {
+			if cb.window[cb.next] {
+				cb.failures--
+			}
+		} else {
+			cb.count++
+		}
+		cb.window[cb.next] = failed
+		cb.next = (cb.next + 1) % len(cb.window)
+		if failed {
+			cb.failures++
+		}
+
+		if failed && cb.count >= cb.minRequests && float64(cb.failures) >= cb.failureRate*float64(cb.count) {
+			change = cb.open(cb.cooldown)
+		}
+	}
+
+	observers := cb.observers
+	cb.lock.Unlock()
+
+	cb.notify(observers, change)
+}
+
+// trip opens the breaker for the cooldown whatever its state
+func (cb *circuitBreaker) trip(cooldown time.Duration) {
+	cb.lock.Lock()
+	change := cb.open(cooldown)
+	cb.trial = false
+	observers := cb.observers
+	cb.lock.Unlock()
+
+	cb.notify(observers, change)
+}
+
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (cb *circuitBreaker) open(cooldown time.Duration) *NodeStateChange {
+	cb.retryAt = time.Now().Add(cooldown)
+	return cb.setState(BreakerOpen)
+}
+
+// setState resets the counted outcomes and returns the change, nil if the state is the same
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (cb *circuitBreaker) setState(state BreakerState) *NodeStateChange {
+	cb.count = 0
+	cb.failures = 0
+	cb.next = 0
+
+	if cb.state == state {
+		return nil
+	}
+
+	change := &NodeStateChange{Node: cb.node, From: cb.state, To: state, At: time.Now()}
+	cb.state = state
+
+	return change
+}
+
+// notify runs the observers in the goroutine of the request, they should not block
+func (cb *circuitBreaker) notify(observers []func(NodeStateChange), change *NodeStateChange) {
+	if change == nil {
+		return
+	}
+
+	cb.logger.Warn("node: " + change.Node + " changed from " + change.From.String() + " to " + change.To.String())
+	for _, observer := range observers {
+		observer(*change)
+	}
+}
+
+// OnNodeStateChange registers a function that is called when the breaker of a node changes state, it should not block
+func (c *Client) OnNodeStateChange(observer func(NodeStateChange)) {
+	for _, node := range c.nodes() {
+		node.breaker.addObserver(observer)
+	}
+}
+
+// startHealthChecks PINGs every node in the background so a node that fails is detected before the requests reach it
+// and an open breaker is tested as soon as its cooldown passes
+func (c *Client) startHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.checkNodes(interval)
+			}
+		}
+	}()
+}
+
+func (c *Client) checkNodes(timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, node := range c.nodes() {
+		wg.Add(1)
+		go func(node *CacheNode) {
+			defer wg.Done()
+			c.probe(node, timeout)
+		}(node)
+	}
+
+	wg.Wait()
+}
+
+// probe is like a PING through sendCommandContext, but a node that doesn't reply in time is counted as failed
+func (c *Client) probe(node *CacheNode, timeout time.Duration) {
+	allowed, trial := node.breaker.acquire()
+	if !allowed {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := c.exchange(ctx, node, []byte("PING\n"), 1, false)
+	if err != nil || resp[0] != "PONG" {
+		c.logger.Debug("health check of node: " + node.ID + " failed")
+		node.breaker.done(outcomeFailure, trial)
+		return
+	}
+
+	node.breaker.done(outcomeSuccess, trial)
+}
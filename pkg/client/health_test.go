@@ -0,0 +1,151 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+func TestBreakerFailureRate(t *testing.T) {
+	cb := newCircuitBreaker("node", config.ClientConfig{BreakerWindow: 4, BreakerMinRequests: 4, BreakerFailureRate: 0.5, UnHealthyInterval: 60})
+
+	request := func(result outcome) {
+		allowed, trial := cb.acquire()
+		if !allowed {
+			t.Fatal("expected the request to be allowed")
+		}
+		cb.done(result, trial)
+	}
+
+	// not enough requests are counted yet
+	request(outcomeFailure)
+	request(outcomeSuccess)
+	request(outcomeFailure)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected closed, got %s", cb.State())
+	}
+
+	// the cancelled requests are not counted
+	request(outcomeIgnored)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected closed, got %s", cb.State())
+	}
+
+	// 2 of the last 4 requests failed
+	request(outcomeSuccess)
+	request(outcomeFailure)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected open, got %s", cb.State())
+	}
+
+	if allowed, _ := cb.acquire(); allowed || cb.available() {
+		t.Error("expected the requests to be rejected while the breaker is open")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	cb := newCircuitBreaker("node", config.ClientConfig{})
+
+	var lock sync.Mutex
+	changes := []BreakerState{}
+	cb.addObserver(func(change NodeStateChange) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, change.To)
+	})
+
+	cb.trip(100 * time.Millisecond)
+	if cb.available() {
+		t.Fatal("expected the node to be unavailable during the cooldown")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	allowed, trial := cb.acquire()
+	if !allowed || !trial {
+		t.Fatalf("expected a trial request after the cooldown, allowed=%v trial=%v", allowed, trial)
+	}
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %s", cb.State())
+	}
+
+	// only one trial at a time
+	if allowed, _ := cb.acquire(); allowed {
+		t.Error("expected a second request to be rejected during the trial")
+	}
+
+	// a failed trial opens the breaker again, cooldown is zero in this config
+	cb.done(outcomeFailure, trial)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected open, got %s", cb.State())
+	}
+
+	allowed, trial = cb.acquire()
+	if !allowed || !trial {
+		t.Fatal("expected a new trial request")
+	}
+	cb.done(outcomeSuccess, trial)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected closed, got %s", cb.State())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected the changes %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("expected the changes %v, got %v", expected, changes)
+		}
+	}
+}
+
+func TestHealthCheckOpensBreakerOfHungNode(t *testing.T) {
+	listener := startHungServer(t)
+	defer listener.Close()
+
+	clientConf := config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15, UnHealthyInterval: 60}
+	pool := NewConnPool(1, listener.Addr().String(), clientConf)
+	newNode := NewCacheNode("testNode", true, pool)
+
+	ring := NewHashRing()
+	ring.AddNode(newNode)
+	newBalancer := NewReadBalancer(clientConf)
+	newBalancer.addCacheNode(newNode)
+
+	client := &Client{
+		ring:      ring,
+		logger:    &NoOpLogger{},
+		balancers: map[string]*ReadBalancer{"testNode": newBalancer},
+	}
+
+	changes := make(chan NodeStateChange, 1)
+	client.OnNodeStateChange(func(change NodeStateChange) {
+		changes <- change
+	})
+
+	client.checkNodes(100 * time.Millisecond)
+
+	select {
+	case change := <-changes:
+		if change.Node != "testNode" || change.To != BreakerOpen {
+			t.Errorf("unexpected change %+v", change)
+		}
+	default:
+		t.Fatal("expected the health check to open the breaker")
+	}
+
+	// the writes to an open primary fail without waiting for it
+	start := time.Now()
+	if _, err := client.Set("key", "value"); !errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected ErrNodeUnavailable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Set returned after %s", elapsed)
+	}
+}
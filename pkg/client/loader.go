@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+// Loader fetches a value from the source of truth, it returns errorutil.ErrKeyNotFound if the value doesn't exist
+type Loader func(ctx context.Context, key string) (string, error)
+
+// LoadOptions configures GetOrLoad
+type LoadOptions struct {
+	// how long a loaded value is fresh
+	TTL time.Duration
+	// how long after the TTL the value is still served while a single caller refreshes it in the background, zero disables it
+	StaleTTL time.Duration
+	// how long a not found of the loader is cached, zero disables the negative caching
+	NegativeTTL time.Duration
+	// a lease on the server so that only one process loads a key, zero disables it. It should be longer than a load
+	LockTTL time.Duration
+}
+
+// how often a process that didn't get the lease checks for the value of the process that got it
+const loadPollInterval = 20 * time.Millisecond
+
+// the values of GetOrLoad are stored as "~cg1 <fresh until unix ms> v <value>" or "~cg1 <fresh until unix ms> n"
+// for a cached not found. A value without the prefix was stored by a plain Set and it is always fresh
+const envelopePrefix = "~cg1 "
+
+type envelope struct {
+	freshUntil time.Time
+	negative   bool
+	value      string
+}
+
+func encodeEnvelope(env envelope) string {
+	if env.negative {
+		return fmt.Sprintf("%s%d n", envelopePrefix, env.freshUntil.UnixMilli())
+	}
+
+	return fmt.Sprintf("%s%d v %s", envelopePrefix, env.freshUntil.UnixMilli(), env.value)
+}
+
+func decodeEnvelope(raw string) envelope {
+	if !strings.HasPrefix(raw, envelopePrefix) {
+		return envelope{value: raw}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(raw, envelopePrefix), " ", 3)
+	freshUntil, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) < 2 {
+		return envelope{value: raw}
+	}
+
+	env := envelope{freshUntil: time.UnixMilli(freshUntil), negative: parts[1] == "n"}
+	if len(parts) == 3 {
+		env.value = parts[2]
+	}
+
+	return env
+}
+
+func (env envelope) isFresh(now time.Time) bool {
+	return env.freshUntil.IsZero() || now.Before(env.freshUntil)
+}
+
+func (env envelope) result() (string, error) {
+	if env.negative {
+		return "", errorutil.ErrKeyNotFound
+	}
+
+	return env.value, nil
+}
+
+// flightGroup runs a single load per key at a time, the callers that arrive during a load share its result
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// start runs fn unless a load of the key is already running, it doesn't wait for the result
+func (g *flightGroup) start(key string, fn func() (string, error)) *flight {
+	g.lock.Lock()
+	if f, exists := g.flights[key]; exists {
+		g.lock.Unlock()
+		return f
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.lock.Unlock()
+
+	go func() {
+		f.value, f.err = fn()
+
+		g.lock.Lock()
+		delete(g.flights, key)
+		g.lock.Unlock()
+
+		close(f.done)
+	}()
+
+	return f
+}
+
+// GetOrLoad returns the value of the key and calls loader on a miss. The concurrent loads of a key are deduplicated in
+// the process and, with a LockTTL, across the processes. A stale value is served while one caller refreshes it
+func (c *Client) GetOrLoad(ctx context.Context, key string, loader Loader, opts LoadOptions) (string, error) {
+	if opts.TTL < time.Millisecond {
+		return "", fmt.Errorf("the TTL of GetOrLoad should be at least 1ms")
+	}
+
+	raw, err := c.GetContext(ctx, key)
+	switch {
+	case err == nil:
+		env := decodeEnvelope(raw)
+		if !env.isFresh(time.Now()) {
+			c.logger.Debug("GetOrLoad: serving a stale value of " + key + " while it is refreshed")
+			c.loads.start(key, func() (string, error) {
+				return c.load(context.Background(), key, loader, opts)
+			})
+		}
+		return env.result()
+
+	case errors.Is(err, errorutil.ErrKeyNotFound):
+
+	case contextErr(ctx) != nil:
+		return "", err
+
+	default:
+		// the cache is not available, the value is still loaded but it might not be stored
+		c.logger.Warn("GetOrLoad: failed to get " + key + ": " + err.Error())
+	}
+
+	// the load is shared so it must not be cancelled by the caller that started it
+	f := c.loads.start(key, func() (string, error) {
+		return c.load(context.WithoutCancel(ctx), key, loader, opts)
+	})
+
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *Client) load(ctx context.Context, key string, loader Loader, opts LoadOptions) (string, error) {
+	if opts.LockTTL > 0 {
+		owner, err := newRandomId()
+		if err != nil {
+			return "", err
+		}
+
+		acquired, err := c.tryLock(ctx, key, opts.LockTTL, owner)
+		switch {
+		case err != nil:
+			// the lease is an optimization, the key is loaded without it
+			c.logger.Warn("GetOrLoad: failed to lock " + key + ": " + err.Error())
+		case acquired:
+			defer c.unlock(ctx, key, owner)
+		default:
+			if value, done, err := c.waitForLoad(ctx, key, opts.LockTTL); done {
+				return value, err
+			}
+			c.logger.Warn("GetOrLoad: the lease of " + key + " expired without a value, loading it")
+		}
+	}
+
+	value, err := loader(ctx, key)
+	if errors.Is(err, errorutil.ErrKeyNotFound) {
+		if opts.NegativeTTL > 0 {
+			env := envelope{freshUntil: time.Now().Add(opts.NegativeTTL), negative: true}
+			c.storeEnvelope(ctx, key, env, opts.NegativeTTL)
+		}
+		return "", errorutil.ErrKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	env := envelope{freshUntil: time.Now().Add(opts.TTL), value: value}
+	c.storeEnvelope(ctx, key, env, opts.TTL+opts.StaleTTL)
+
+	return value, nil
+}
+
+// storeEnvelope keeps the value on the server until the stale period ends, a failure only costs a load
+func (c *Client) storeEnvelope(ctx context.Context, key string, env envelope, ttl time.Duration) {
+	if _, err := c.SetWithTTLContext(ctx, key, encodeEnvelope(env), ttl); err != nil {
+		c.logger.Warn("GetOrLoad: failed to store " + key + ": " + err.Error())
+	}
+}
+
+// waitForLoad polls the primary for the value of the process that holds the lease, it returns false if the lease
+// expired without a fresh value
+func (c *Client) waitForLoad(ctx context.Context, key string, lockTTL time.Duration) (string, bool, error) {
+	deadline := time.Now().Add(lockTTL)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return "", true, ctx.Err()
+		case <-time.After(loadPollInterval):
+		}
+
+		raw, err := c.GetContext(ctx, key, WithConsistency(ConsistencyPrimary))
+		if err != nil {
+			continue
+		}
+
+		if env := decodeEnvelope(raw); env.isFresh(time.Now()) {
+			value, err := env.result()
+			return value, true, err
+		}
+	}
+
+	return "", false, nil
+}
+
+// loadLease is the name of the lease of a load, apart from the names of the Locker. It lives on the primary of the key
+func loadLease(key string) string {
+	return "load:" + key
+}
+
+// tryLock takes a lease on the primary of the key, it returns false if another owner holds it
+func (c *Client) tryLock(ctx context.Context, key string, ttl time.Duration, owner string) (bool, error) {
+	_, _, err := c.acquireLock(ctx, key, loadLease(key), owner, ttl)
+	if errors.Is(err, ErrLocked) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (c *Client) unlock(ctx context.Context, key string, owner string) {
+	if err := c.releaseLock(ctx, key, loadLease(key), owner); err != nil {
+		c.logger.Debug("failed to unlock " + key + ": " + err.Error())
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+func TestEnvelope(t *testing.T) {
+	freshUntil := time.UnixMilli(time.Now().Add(time.Minute).UnixMilli())
+
+	env := decodeEnvelope(encodeEnvelope(envelope{freshUntil: freshUntil, value: "a value ~cg1 1 n"}))
+	if value, err := env.result(); err != nil || value != "a value ~cg1 1 n" || !env.freshUntil.Equal(freshUntil) {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+
+	env = decodeEnvelope(encodeEnvelope(envelope{freshUntil: freshUntil, negative: true}))
+	if _, err := env.result(); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected a cached not found, got %v", err)
+	}
+
+	// a value of a plain Set is always fresh
+	env = decodeEnvelope("plain value")
+	if value, _ := env.result(); value != "plain value" || !env.isFresh(time.Now()) {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12354, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12354)
+	ctx := context.Background()
+
+	var loads atomic.Int64
+	loader := func(ctx context.Context, key string) (string, error) {
+		loads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		if key == "missing" {
+			return "", errorutil.ErrKeyNotFound
+		}
+		return "value of " + key, nil
+	}
+	opts := LoadOptions{TTL: time.Minute, NegativeTTL: time.Minute}
+
+	// the concurrent misses share a single load
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := client.GetOrLoad(ctx, "key", loader, opts); err != nil || value != "value of key" {
+				t.Errorf("GetOrLoad failed: value=%s, err=%v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads.Load() != 1 {
+		t.Errorf("expected a single load, got %d", loads.Load())
+	}
+
+	// the value is stored on the server
+	if value, err := client.GetOrLoad(ctx, "key", loader, opts); err != nil || value != "value of key" || loads.Load() != 1 {
+		t.Errorf("expected the stored value, got value=%s, err=%v, loads=%d", value, err, loads.Load())
+	}
+
+	// a not found is cached too
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetOrLoad(ctx, "missing", loader, opts); !errors.Is(err, errorutil.ErrKeyNotFound) {
+			t.Errorf("expected not found, got %v", err)
+		}
+	}
+	if loads.Load() != 2 {
+		t.Errorf("expected the not found to be loaded once, got %d loads", loads.Load())
+	}
+}
+
+func TestGetOrLoadServesStaleValue(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12355, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12355)
+	ctx := context.Background()
+
+	var version atomic.Int64
+	loader := func(ctx context.Context, key string) (string, error) {
+		if version.Add(1) > 1 {
+			time.Sleep(100 * time.Millisecond)
+			return "new", nil
+		}
+		return "old", nil
+	}
+	opts := LoadOptions{TTL: 50 * time.Millisecond, StaleTTL: time.Minute}
+
+	if value, err := client.GetOrLoad(ctx, "key", loader, opts); err != nil || value != "old" {
+		t.Fatalf("GetOrLoad failed: value=%s, err=%v", value, err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	// the stale value is served without waiting for the refresh
+	start := time.Now()
+	if value, err := client.GetOrLoad(ctx, "key", loader, opts); err != nil || value != "old" {
+		t.Errorf("expected the stale value, got value=%s, err=%v", value, err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("the stale value was served after %s", elapsed)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if value, err := client.GetOrLoad(ctx, "key", loader, opts); err != nil || value != "new" {
+		t.Errorf("expected the refreshed value, got value=%s, err=%v", value, err)
+	}
+	if version.Load() != 2 {
+		t.Errorf("expected a single refresh, got %d loads", version.Load())
+	}
+}
+
+func TestGetOrLoadAcrossProcesses(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12356, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	// every client has its own in process deduplication, only the lease on the server is shared
+	var loads atomic.Int64
+	loader := func(ctx context.Context, key string) (string, error) {
+		loads.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return "value", nil
+	}
+	opts := LoadOptions{TTL: time.Minute, LockTTL: time.Second}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newSingleNodeClient(12356)
+			if value, err := client.GetOrLoad(context.Background(), "key", loader, opts); err != nil || value != "value" {
+				t.Errorf("GetOrLoad failed: value=%s, err=%v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Errorf("expected a single load across the clients, got %d", loads.Load())
+	}
+	// a lock of the Locker with the name of the key does not hold the load back
+	client := newSingleNodeClient(12356)
+	locker, err := client.NewLocker(LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := locker.TryLock(context.Background(), "locked")
+	if err != nil {
+		t.Fatalf("TryLock failed: %v", err)
+	}
+	defer lock.Unlock(context.Background())
+
+	start := time.Now()
+	if value, err := client.GetOrLoad(context.Background(), "locked", loader, opts); err != nil || value != "value" {
+		t.Errorf("GetOrLoad failed: value=%s, err=%v", value, err)
+	}
+	if elapsed := time.Since(start); elapsed >= opts.LockTTL {
+		t.Errorf("expected the load to skip the lock of the Locker, it took %s", elapsed)
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrLocked is returned by TryLock when another owner holds the lock
+	ErrLocked = errors.New("the lock is held by another owner")
+	// ErrLockLost is the cause of the context of a Lock whose lease could not be renewed in time or was taken over
+	ErrLockLost = errors.New("the lock was lost")
+	// ErrLockNotHeld is returned when the lease to renew or release expired or belongs to another owner
+	ErrLockNotHeld = errors.New("the lock is not held")
+
+	// the cause of the context of a Lock after Unlock
+	errUnlocked = errors.New("the lock was released")
+)
+
+// LockOptions configures a Locker
+type LockOptions struct {
+	// how long a lock is held without a renewal, 10s by default. A held lock is renewed every third of it
+	Lease time.Duration
+	// how often Lock tries again while another owner holds the lock, 100ms by default
+	RetryInterval time.Duration
+}
+
+// Locker takes named locks with a lease on the primary of the name, so the locks that share a {tag} live together.
+//
+// While the primary of a name is up at most one owner holds its lock. The locks are not replicated, a failover or a
+// restart of the primary frees them, and a process that pauses longer than its lease can still believe it holds a
+// lock that someone else took. Every lock comes with a fencing token that is greater than the tokens granted before,
+// pass it along with the writes that the lock protects and have the storage reject a token that is smaller than one it
+// has seen. The tokens come from the clock of the server, they keep growing across a failover as long as the clocks of
+// the servers are closer than the time it takes.
+type Locker struct {
+	client *Client
+	opts   LockOptions
+}
+
+// NewLocker returns a Locker for the options, zero values take the defaults
+func (c *Client) NewLocker(opts LockOptions) (*Locker, error) {
+	if opts.Lease == 0 {
+		opts.Lease = 10 * time.Second
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = 100 * time.Millisecond
+	}
+	if opts.Lease < 3*time.Millisecond || opts.RetryInterval < 0 {
+		return nil, fmt.Errorf("invalid lock options, the lease must be at least 3ms and the retry interval positive")
+	}
+
+	return &Locker{client: c, opts: opts}, nil
+}
+
+// Lock is a held lock, it is renewed in the background until Unlock or until it is lost
+type Lock struct {
+	Name string
+	// the fencing token of the lock
+	Token uint64
+
+	locker  *Locker
+	owner   string
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	renewed chan struct{}
+}
+
+// TryLock takes the lock if it is free, otherwise it fails with ErrLocked
+func (l *Locker) TryLock(ctx context.Context, name string) (*Lock, error) {
+	owner, err := newRandomId()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, _, err := l.acquire(ctx, name, owner)
+
+	return lock, err
+}
+
+// Lock waits until it takes the lock or ctx is done
+func (l *Locker) Lock(ctx context.Context, name string) (*Lock, error) {
+	// the same owner on every attempt, if the reply of a LOCK is lost the next one gets the lock
+	owner, err := newRandomId()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		lock, wait, err := l.acquire(ctx, name, owner)
+		if !errors.Is(err, ErrLocked) {
+			return lock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(wait, l.opts.RetryInterval)):
+		}
+	}
+}
+
+// acquire takes the lock and starts its renewal, it returns the time until the lease of another holder expires
+func (l *Locker) acquire(ctx context.Context, name string, owner string) (*Lock, time.Duration, error) {
+	sent := time.Now()
+	token, wait, err := l.client.acquireLock(ctx, name, name, owner, l.opts.Lease)
+	if err != nil {
+		return nil, wait, err
+	}
+
+	lockCtx, cancel := context.WithCancelCause(context.Background())
+	lock := &Lock{Name: name, Token: token, locker: l, owner: owner, ctx: lockCtx, cancel: cancel, renewed: make(chan struct{})}
+	// the lease started on the server after the request was sent, so it is counted from then
+	go lock.renew(sent.Add(l.opts.Lease))
+
+	return lock, 0, nil
+}
+
+// Context is cancelled when the lock is lost or released, a job that the lock protects should stop then.
+// context.Cause returns ErrLockLost for a lost lock
+func (lock *Lock) Context() context.Context {
+	return lock.ctx
+}
+
+// renew extends the lease every third of it. A renewal that fails is tried again until the lease expires, then the
+// lock is lost
+func (lock *Lock) renew(validUntil time.Time) {
+	defer close(lock.renewed)
+
+	lease := lock.locker.opts.Lease
+	wait := lease / 3
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-lock.ctx.Done():
+			timer.Stop()
+			return
+		case <-lock.locker.client.done:
+			timer.Stop()
+			lock.cancel(ErrClientClosed)
+			return
+		case <-timer.C:
+		}
+
+		if !time.Now().Before(validUntil) {
+			lock.cancel(ErrLockLost)
+			return
+		}
+
+		sent := time.Now()
+		ctx, cancel := context.WithDeadline(lock.ctx, validUntil)
+		err := lock.locker.client.extendLock(ctx, lock.Name, lock.Name, lock.owner, lease)
+		cancel()
+
+		switch {
+		case err == nil:
+			validUntil = sent.Add(lease)
+			wait = lease / 3
+		case errors.Is(err, ErrLockNotHeld):
+			lock.cancel(ErrLockLost)
+			return
+		default:
+			lock.locker.client.logger.Warn("failed to renew the lock " + lock.Name + ": " + err.Error())
+			wait = max(min(lock.locker.opts.RetryInterval, time.Until(validUntil)), 0)
+		}
+	}
+}
+
+// Unlock stops the renewal and releases the lock. It returns ErrLockLost if the lock was lost before
+func (lock *Lock) Unlock(ctx context.Context) error {
+	lost := context.Cause(lock.ctx)
+	lock.cancel(errUnlocked)
+	<-lock.renewed
+
+	if lost != nil {
+		return lost
+	}
+
+	return lock.locker.client.releaseLock(ctx, lock.Name, lock.Name, lock.owner)
+}
+
+// acquireLock sends LOCK <name> <owner> <milliseconds> to the primary of key and returns the fencing token, or
+// ErrLocked and the time until the lease of the holder expires
+func (c *Client) acquireLock(ctx context.Context, key string, name string, owner string, lease time.Duration) (uint64, time.Duration, error) {
+	primaryNode, err := c.ring.GetNode(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	resp, err := c.sendCommandContext(ctx, primaryNode, fmt.Sprintf("LOCK %s %s %d", name, owner, lease.Milliseconds()))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if wait, found := strings.CutPrefix(resp, "LOCKED "); found {
+		ms, err := strconv.ParseInt(wait, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unexpected reply to LOCK: %s", resp)
+		}
+		return 0, time.Duration(ms) * time.Millisecond, ErrLocked
+	}
+
+	token, err := strconv.ParseUint(resp, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected reply to LOCK: %s", resp)
+	}
+
+	return token, 0, nil
+}
+
+// extendLock renews the lease of the owner, ErrLockNotHeld if it expired or another owner holds the lock
+func (c *Client) extendLock(ctx context.Context, key string, name string, owner string, lease time.Duration) error {
+	return c.lockCommand(ctx, key, fmt.Sprintf("EXTEND %s %s %d", name, owner, lease.Milliseconds()))
+}
+
+// releaseLock releases the lock of the owner, ErrLockNotHeld if it expired or another owner holds the lock
+func (c *Client) releaseLock(ctx context.Context, key string, name string, owner string) error {
+	return c.lockCommand(ctx, key, fmt.Sprintf("UNLOCK %s %s", name, owner))
+}
+
+func (c *Client) lockCommand(ctx context.Context, key string, cmd string) error {
+	primaryNode, err := c.ring.GetNode(key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.sendCommandContext(ctx, primaryNode, cmd)
+	if err != nil {
+		if err.Error() == "ERROR: Lock not held" {
+			return ErrLockNotHeld
+		}
+		return err
+	}
+	if resp != "OK" {
+		return fmt.Errorf("unexpected reply: %s", resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocker(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12371, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12371"), WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.NewLocker(LockOptions{Lease: time.Millisecond}); err == nil {
+		t.Errorf("expected an error for a lease shorter than 3ms")
+	}
+
+	locker, err := client.NewLocker(LockOptions{Lease: 150 * time.Millisecond, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := locker.TryLock(ctx, "job")
+	if err != nil {
+		t.Fatalf("TryLock failed: %v", err)
+	}
+	if first.Token == 0 {
+		t.Errorf("expected a fencing token")
+	}
+
+	if _, err := locker.TryLock(ctx, "job"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	// the renewal keeps the lock past its lease
+	time.Sleep(400 * time.Millisecond)
+	if err := first.Context().Err(); err != nil {
+		t.Fatalf("the lock was lost: %v", context.Cause(first.Context()))
+	}
+	if _, err := locker.TryLock(ctx, "job"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked after the lease, got %v", err)
+	}
+
+	// Lock waits for the holder
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Unlock(ctx)
+		close(released)
+	}()
+	second, err := locker.Lock(ctx, "job")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	<-released
+	if second.Token <= first.Token {
+		t.Errorf("expected a greater token, got %d after %d", second.Token, first.Token)
+	}
+	if first.Context().Err() == nil {
+		t.Errorf("expected the context of a released lock to be cancelled")
+	}
+
+	// a lock that another owner took over is lost
+	if err := client.releaseLock(ctx, "job", "job", second.owner); err != nil {
+		t.Fatalf("releaseLock failed: %v", err)
+	}
+	if _, err := locker.TryLock(ctx, "job"); err != nil {
+		t.Fatalf("TryLock failed: %v", err)
+	}
+	select {
+	case <-second.Context().Done():
+		if cause := context.Cause(second.Context()); !errors.Is(cause, ErrLockLost) {
+			t.Errorf("expected ErrLockLost, got %v", cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the lock to be lost")
+	}
+	if err := second.Unlock(ctx); !errors.Is(err, ErrLockLost) {
+		t.Errorf("expected ErrLockLost from Unlock, got %v", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := locker.Lock(waitCtx, "job"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
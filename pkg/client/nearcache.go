@@ -0,0 +1,239 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+// NearCacheOptions configures the in-process cache of the client
+type NearCacheOptions struct {
+	// maximum number of keys kept in the process
+	Size int
+	// how long a value is served from the process without asking the server, zero means until the server invalidates it
+	TTL time.Duration
+	// subscribe to the invalidations of the servers, without it a value can be stale for up to TTL
+	Tracking bool
+}
+
+// nearCache keeps the values that were read in the process. With tracking the servers remember which keys were read
+// and push an INVALIDATE <key> on a dedicated connection when they change
+type nearCache struct {
+	store      cache.Cache
+	ttl        time.Duration
+	tracking   bool
+	trackingId string
+	// protects inflight, dirty and ready, it is always taken before the lock of the store
+	lock sync.Mutex
+	// a key that is invalidated while it is read from the server must not be stored with the value of that read
+	inflight map[string]int
+	dirty    map[string]struct{}
+	// nodes with a working invalidation connection, the values read from the rest are not kept
+	ready  map[string]bool
+	done   chan struct{}
+	logger logger.Logger
+}
+
+func newNearCache(opts NearCacheOptions) (*nearCache, error) {
+	if opts.Size < 1 {
+		return nil, fmt.Errorf("the size of the near cache should be at least 1")
+	}
+
+	if !opts.Tracking && opts.TTL <= 0 {
+		return nil, fmt.Errorf("a TTL is required when the tracking is disabled")
+	}
+
+	trackingId, err := newRandomId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nearCache{
+		store:      cache.NewLRUCache(opts.Size),
+		ttl:        opts.TTL,
+		tracking:   opts.Tracking,
+		trackingId: trackingId,
+		inflight:   make(map[string]int),
+		dirty:      make(map[string]struct{}),
+		ready:      make(map[string]bool),
+		done:       make(chan struct{}),
+		logger:     &NoOpLogger{},
+	}, nil
+}
+
+// EnableNearCache keeps the values that are read in the process, it should be called before the client is used
+func (c *Client) EnableNearCache(opts NearCacheOptions) error {
+	nc, err := newNearCache(opts)
+	if err != nil {
+		return err
+	}
+	nc.logger = c.logger
+
+	if nc.tracking {
+		for _, node := range c.nodes() {
+			node.ConnPool.setOnConnect(nc.enableTracking)
+			go nc.listen(node)
+		}
+	}
+
+	c.nearCache = nc
+
+	return nil
+}
+
+func (nc *nearCache) get(key string) (string, bool) {
+	return nc.store.Get(key)
+}
+
+func (nc *nearCache) beginRead(key string) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	nc.inflight[key]++
+}
+
+// endRead keeps the value unless the key was invalidated during the read
+func (nc *nearCache) endRead(key string, value string, node *CacheNode, found bool) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	_, invalidated := nc.dirty[key]
+
+	nc.inflight[key]--
+	if nc.inflight[key] <= 0 {
+		delete(nc.inflight, key)
+		delete(nc.dirty, key)
+	}
+
+	if !found || invalidated || (nc.tracking && !nc.ready[node.ID]) {
+		return
+	}
+
+	entry := cache.Entry{Value: value}
+	if nc.ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(nc.ttl)
+	}
+	nc.store.SetEntry(key, entry)
+}
+
+func (nc *nearCache) invalidate(key string) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if nc.inflight[key] > 0 {
+		nc.dirty[key] = struct{}{}
+	}
+	nc.store.Delete(key)
+}
+
+func (nc *nearCache) flush() {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	for key := range nc.inflight {
+		nc.dirty[key] = struct{}{}
+	}
+	nc.store.Flush()
+}
+
+func (nc *nearCache) setReady(nodeId string, ready bool) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	nc.ready[nodeId] = ready
+}
+
+// enableTracking runs on every new data connection
+func (nc *nearCache) enableTracking(poolConn *PoolConn) error {
+	if _, err := fmt.Fprintf(poolConn.conn, "TRACKING %s\n", nc.trackingId); err != nil {
+		return err
+	}
+
+	if !poolConn.scanner.Scan() {
+		return fmt.Errorf("no response to TRACKING")
+	}
+	if poolConn.scanner.Text() != "OK" {
+		return fmt.Errorf("failed to enable tracking: %s", poolConn.scanner.Text())
+	}
+
+	return nil
+}
+
+// listen keeps the invalidation connection to a node alive
+func (nc *nearCache) listen(node *CacheNode) {
+	for attempt := 0; ; attempt++ {
+		if err := nc.receiveInvalidations(node); err != nil {
+			nc.logger.Warn("invalidation connection to " + node.ID + " failed: " + err.Error())
+		}
+
+		// the invalidations of the node might be lost, nothing that was read from it can be trusted
+		nc.setReady(node.ID, false)
+		nc.flush()
+
+		if attempt > 5 {
+			attempt = 5
+		}
+		select {
+		case <-nc.done:
+			return
+		case <-time.After(time.Duration(1<<attempt) * 100 * time.Millisecond):
+		}
+	}
+}
+
+func (nc *nearCache) receiveInvalidations(node *CacheNode) error {
+	conn, err := net.Dial("tcp", node.ConnPool.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-nc.done:
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	if _, err := fmt.Fprintf(conn, "INVALIDATIONS %s\n", nc.trackingId); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(protocol.ScanLines)
+	if !scanner.Scan() {
+		return fmt.Errorf("no response to INVALIDATIONS")
+	}
+	if scanner.Text() != "OK" {
+		return fmt.Errorf("failed to subscribe to invalidations: %s", scanner.Text())
+	}
+
+	nc.setReady(node.ID, true)
+	nc.logger.Debug("invalidation connection to " + node.ID + " is ready")
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "INVALIDATEALL":
+			nc.flush()
+		case strings.HasPrefix(line, "INVALIDATE "):
+			nc.invalidate(strings.TrimPrefix(line, "INVALIDATE "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("connection closed by the server")
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/logger"
+)
+
+const (
+	defaultPoolSize    = 5
+	defaultDialRetries = 2
+)
+
+// Option customizes a client created with New
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	poolSize          int
+	minIdle           int
+	poolWaitTimeout   time.Duration
+	idleCheckInterval time.Duration
+	dialTimeout       time.Duration
+	retries           int
+	logger            logger.Logger
+	ring              HashRing
+	// empty means the strategy of the configuration
+	readStrategy ReadStrategy
+}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		poolSize:          defaultPoolSize,
+		poolWaitTimeout:   defaultPoolWaitTimeout,
+		idleCheckInterval: defaultIdleCheckInterval,
+		retries:           defaultDialRetries,
+		ring:              NewHashRing(),
+		logger:            &NoOpLogger{},
+	}
+}
+
+func (o clientOptions) validate() error {
+	if o.poolSize < 1 {
+		return fmt.Errorf("the pool size should be at least 1")
+	}
+
+	if o.minIdle < 0 || o.minIdle > o.poolSize {
+		return fmt.Errorf("the min idle connections should be between 0 and the pool size")
+	}
+
+	if o.dialTimeout < 0 || o.retries < 0 || o.poolWaitTimeout < 0 {
+		return fmt.Errorf("the timeouts and the retries can't be negative")
+	}
+
+	if o.idleCheckInterval <= 0 {
+		return fmt.Errorf("the idle check interval should be positive")
+	}
+
+	if o.ring == nil {
+		return fmt.Errorf("the hash ring can't be nil")
+	}
+
+	if o.readStrategy != "" {
+		if _, err := parseReadStrategy(string(o.readStrategy)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WithPoolSize sets the maximum number of open connections per node, default 5
+func WithPoolSize(size int) Option {
+	return func(o *clientOptions) {
+		o.poolSize = size
+	}
+}
+
+// WithMinIdle keeps n idle connections per node, they are dialed when the client is created
+func WithMinIdle(n int) Option {
+	return func(o *clientOptions) {
+		o.minIdle = n
+	}
+}
+
+// WithPoolWaitTimeout sets how long a request waits for a connection when every connection of the node is in use,
+// default 5s. Zero means until the context of the request is done
+func WithPoolWaitTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.poolWaitTimeout = timeout
+	}
+}
+
+// WithIdleCheckInterval sets how often the idle connections are checked and closed if they expired or the server
+// closed them, default 30s
+func WithIdleCheckInterval(interval time.Duration) Option {
+	return func(o *clientOptions) {
+		o.idleCheckInterval = interval
+	}
+}
+
+// WithDialTimeout limits every dial attempt, by default only the context of the request does
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed dial is retried with a backoff, default 2
+func WithRetries(retries int) Option {
+	return func(o *clientOptions) {
+		o.retries = retries
+	}
+}
+
+// WithLogger sets the logger of the client and of its connection pools
+func WithLogger(l logger.Logger) Option {
+	return func(o *clientOptions) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithHashRing distributes the keys with ring instead of the default SimpleHashRing, the ring should be empty
+func WithHashRing(ring HashRing) Option {
+	return func(o *clientOptions) {
+		o.ring = ring
+	}
+}
+
+// WithReadStrategy overrides the read strategy of the configuration
+func WithReadStrategy(strategy ReadStrategy) Option {
+	return func(o *clientOptions) {
+		o.readStrategy = strategy
+	}
+}
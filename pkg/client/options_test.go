@@ -0,0 +1,161 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+// countingRing records the nodes that are added to it
+type countingRing struct {
+	HashRing
+	added int
+}
+
+func (r *countingRing) AddNode(node *CacheNode) {
+	r.added++
+	r.HashRing.AddNode(node)
+}
+
+// recordingLogger keeps the debug messages
+type recordingLogger struct {
+	NoOpLogger
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debug(msg string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) contains(msg string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestConfig(port string) *config.Configuration {
+	return &config.Configuration{
+		ClientConfig: config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15, UnHealthyInterval: 1},
+		Servers: []config.ServerConfig{
+			{ID: "primary", Address: "localhost:" + port, Role: "PRIMARY"},
+			{ID: "secondary", Address: "localhost:" + port, Role: "SECONDARY", Primary: "primary"},
+		},
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12359, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	ring := &countingRing{HashRing: NewHashRing()}
+	client, err := New(newTestConfig("12359"),
+		WithPoolSize(3),
+		WithMinIdle(2),
+		WithDialTimeout(time.Second),
+		WithRetries(0),
+		WithHashRing(ring),
+		WithReadStrategy(LeastOutstanding),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if ring.added != 1 {
+		t.Errorf("expected the primary to be added to the ring, got %d nodes", ring.added)
+	}
+
+	balancer := client.balancers["primary"]
+	if balancer.getStrategy() != LeastOutstanding || len(balancer.nodes) != 2 {
+		t.Errorf("unexpected balancer: strategy=%s, nodes=%d", balancer.getStrategy(), len(balancer.nodes))
+	}
+
+	for _, node := range client.nodes() {
+		if cap(node.pool) != 3 || node.dialTimeout != time.Second || node.dialAttempts != 1 {
+			t.Errorf("unexpected pool of %s: size=%d, timeout=%s, attempts=%d", node.ID, cap(node.pool), node.dialTimeout, node.dialAttempts)
+		}
+	}
+
+	// the idle connections are dialed in the background
+	time.Sleep(200 * time.Millisecond)
+	for _, node := range client.nodes() {
+		if len(node.pool) != 2 {
+			t.Errorf("expected 2 idle connections to %s, got %d", node.ID, len(node.pool))
+		}
+	}
+
+	if _, err := client.Set("key", "value"); err != nil {
+		t.Errorf("Set failed: %v", err)
+	}
+	if value, err := client.Get("key"); err != nil || value != "value" {
+		t.Errorf("Get failed: value=%s, err=%v", value, err)
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	cfg := newTestConfig("12360")
+
+	for name, opt := range map[string]Option{
+		"pool size":     WithPoolSize(0),
+		"min idle":      WithMinIdle(10),
+		"retries":       WithRetries(-1),
+		"ring":          WithHashRing(nil),
+		"read strategy": WithReadStrategy("random"),
+	} {
+		if _, err := New(cfg, opt); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	cfg.Servers[1].Primary = "unknown"
+	if _, err := New(cfg); err == nil {
+		t.Error("expected an error for a secondary of an unknown primary")
+	}
+}
+
+func TestEveryClientHasItsOwnLogger(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12373, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	first, second := &recordingLogger{}, &recordingLogger{}
+	firstClient, err := New(newTestConfig("12373"), WithLogger(first))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer firstClient.Close()
+	secondClient, err := New(newTestConfig("12373"), WithLogger(second))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer secondClient.Close()
+
+	if _, err := firstClient.Set("first", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if _, err := secondClient.Set("second", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if !first.contains("SET first") || first.contains("SET second") {
+		t.Errorf("unexpected messages of the first client: %v", first.messages)
+	}
+	if !second.contains("SET second") || second.contains("SET first") {
+		t.Errorf("unexpected messages of the second client: %v", second.messages)
+	}
+}
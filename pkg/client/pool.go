@@ -0,0 +1,405 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+var ErrPoolTimeout = errors.New("timed out waiting for a connection")
+
+const (
+	defaultPoolWaitTimeout   = 5 * time.Second
+	defaultIdleCheckInterval = 30 * time.Second
+	// how long an idle connection is given to show that it was closed by the server
+	aliveCheckTimeout = time.Millisecond
+)
+
+type PoolConn struct {
+	conn      net.Conn
+	scanner   *bufio.Scanner
+	createdAt time.Time
+	logger    logger.Logger
+}
+
+// ConnPool keeps up to size open connections to a node, the callers wait for a connection when every one is in use
+type ConnPool struct {
+	pool    chan *PoolConn
+	address string
+	cfg     config.ClientConfig
+	// a token per open connection, idle, in use or being dialed
+	slots chan struct{}
+	// how long a caller waits for a connection when the pool is exhausted, zero means until its context is done
+	waitTimeout time.Duration
+	// zero means no timeout other than the one of the context
+	dialTimeout  time.Duration
+	dialAttempts int
+	// protects onConnect and the pushes to pool against Close
+	lock sync.Mutex
+	// runs on every new connection before it is used, e.g. to enable the tracking of the near cache
+	onConnect func(*PoolConn) error
+	closed    bool
+	// closed by Close, it wakes up the waiting callers and stops the maintenance
+	stop   chan struct{}
+	stats  poolStats
+	logger logger.Logger
+}
+
+func (pc *PoolConn) isExpired(timeout int) bool {
+	maxValidTime := time.Duration(timeout) * time.Second
+	pc.logger.Debug("isExpired timeout: " + maxValidTime.String())
+	return time.Since(pc.createdAt) > maxValidTime
+}
+
+// isAlive checks that the server didn't close an idle connection, nothing should be readable from it
+func (pc *PoolConn) isAlive() bool {
+	pc.conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout))
+	defer pc.conn.SetReadDeadline(time.Time{})
+
+	var buf [1]byte
+	_, err := pc.conn.Read(buf[:])
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (pc *PoolConn) Close() {
+	pc.conn.Close()
+}
+
+func NewConnPool(size int, address string, cfg config.ClientConfig) *ConnPool {
+	return &ConnPool{
+		pool:         make(chan *PoolConn, size),
+		address:      address,
+		cfg:          cfg,
+		slots:        make(chan struct{}, size),
+		waitTimeout:  defaultPoolWaitTimeout,
+		dialAttempts: defaultDialRetries + 1,
+		stop:         make(chan struct{}),
+		logger:       &NoOpLogger{},
+	}
+}
+
+// maintain keeps minIdle connections ready and closes the idle ones that expired or were closed by the server,
+// until the pool is closed
+func (cp *ConnPool) maintain(interval time.Duration, minIdle int) {
+	cp.warmUp(minIdle)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case <-ticker.C:
+			cp.validateIdle()
+			cp.warmUp(minIdle)
+		}
+	}
+}
+
+// warmUp dials connections until n are idle, so the requests don't pay for the dial
+func (cp *ConnPool) warmUp(n int) {
+	for len(cp.pool) < n && !cp.isClosed() {
+		select {
+		case cp.slots <- struct{}{}:
+		default:
+			// every connection is open already
+			return
+		}
+
+		poolConn, err := cp.dialWithBackOff(context.Background())
+		if err != nil {
+			<-cp.slots
+			cp.logger.Warn("failed to warm up the pool of " + cp.address + ": " + err.Error())
+			return
+		}
+		cp.putIdle(poolConn)
+	}
+}
+
+// validateIdle checks every idle connection once
+func (cp *ConnPool) validateIdle() {
+	for i := len(cp.pool); i > 0; i-- {
+		select {
+		case poolConn := <-cp.pool:
+			if poolConn.isExpired(cp.cfg.ConnectionTimeout) {
+				cp.stats.expiredCloses.Add(1)
+				cp.closeConn(poolConn)
+				continue
+			}
+
+			if !poolConn.isAlive() {
+				cp.logger.Debug("closing a broken idle connection to " + cp.address)
+				cp.stats.brokenCloses.Add(1)
+				cp.closeConn(poolConn)
+				continue
+			}
+
+			cp.putIdle(poolConn)
+		default:
+			return
+		}
+	}
+}
+
+// setOnConnect sets the hook of the new connections and closes the idle ones so every connection runs it
+func (cp *ConnPool) setOnConnect(onConnect func(*PoolConn) error) {
+	cp.lock.Lock()
+	cp.onConnect = onConnect
+	cp.lock.Unlock()
+
+	for {
+		select {
+		case poolConn := <-cp.pool:
+			cp.closeConn(poolConn)
+		default:
+			return
+		}
+	}
+}
+
+func (cp *ConnPool) Get() (*PoolConn, error) {
+	return cp.GetContext(context.Background())
+}
+
+// GetContext returns an idle connection or dials a new one. When every connection is in use it waits for one
+// until the wait timeout of the pool passes or ctx is done
+func (cp *ConnPool) GetContext(ctx context.Context) (*PoolConn, error) {
+	cp.logger.Debug("Get connection from pool called")
+
+	start := time.Now()
+	defer func() {
+		cp.stats.waitTime.Add(int64(time.Since(start)))
+	}()
+
+	waiting := false
+	var timeout <-chan time.Time
+
+	for {
+		if cp.isClosed() {
+			return nil, ErrClientClosed
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// an idle connection is preferred over a new one
+		select {
+		case poolConn := <-cp.pool:
+			if cp.checkOut(poolConn) {
+				return poolConn, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case cp.slots <- struct{}{}:
+			return cp.dial(ctx)
+		default:
+		}
+
+		// every connection is in use
+		if !waiting {
+			waiting = true
+			cp.stats.waits.Add(1)
+
+			if cp.waitTimeout > 0 {
+				timer := time.NewTimer(cp.waitTimeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		}
+
+		select {
+		case poolConn := <-cp.pool:
+			if cp.checkOut(poolConn) {
+				return poolConn, nil
+			}
+		case cp.slots <- struct{}{}:
+			return cp.dial(ctx)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			cp.stats.waitTimeouts.Add(1)
+			return nil, fmt.Errorf("%w to %s after %s", ErrPoolTimeout, cp.address, cp.waitTimeout)
+		case <-cp.stop:
+			return nil, ErrClientClosed
+		}
+	}
+}
+
+// checkOut hands out an idle connection unless it expired
+func (cp *ConnPool) checkOut(poolConn *PoolConn) bool {
+	if poolConn.isExpired(cp.cfg.ConnectionTimeout) {
+		cp.logger.Debug("isExpired or is invalid")
+		cp.stats.expiredCloses.Add(1)
+		cp.closeConn(poolConn)
+		return false
+	}
+
+	cp.logger.Debug("found poolConn")
+	cp.stats.inUse.Add(1)
+	return true
+}
+
+// dial opens a connection with a slot that the caller took
+func (cp *ConnPool) dial(ctx context.Context) (*PoolConn, error) {
+	poolConn, err := cp.dialWithBackOff(ctx)
+	if err != nil {
+		<-cp.slots
+		return nil, err
+	}
+
+	cp.stats.inUse.Add(1)
+	return poolConn, nil
+}
+
+func (cp *ConnPool) dialWithBackOff(ctx context.Context) (*PoolConn, error) {
+	cp.logger.Debug(" dialWithBackOff")
+	maxAttempts := cp.dialAttempts
+	baseTime := 100 * time.Millisecond
+	maxBackoff := 1 * time.Second
+
+	var conn net.Conn
+	var err error
+	dialer := net.Dialer{Timeout: cp.dialTimeout}
+
+	cp.lock.Lock()
+	onConnect := cp.onConnect
+	cp.lock.Unlock()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+
+		conn, err = dialer.DialContext(ctx, "tcp", cp.address)
+		cp.stats.dials.Add(1)
+		if err != nil {
+			cp.stats.dialFailures.Add(1)
+		}
+
+		if err == nil {
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				cp.logger.Debug("Connection is not TCP type")
+				err = fmt.Errorf("expected TCP connection, got different type")
+				continue
+
+			}
+
+			// disable Nagle's Algorithm
+			// if err := tcpConn.SetNoDelay(true); err != nil {
+			// 	return nil, fmt.Errorf("failed to set TCP_NODELAY: %s", err)
+			// }
+
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(time.Duration(cp.cfg.KeepAliveInterval) * time.Second)
+			cp.logger.Debug("KeepAlive: " + fmt.Sprint(cp.cfg.KeepAliveInterval))
+
+			poolConn := &PoolConn{conn: tcpConn, scanner: bufio.NewScanner(tcpConn), createdAt: time.Now(), logger: cp.logger}
+			poolConn.scanner.Split(protocol.ScanLines)
+			if onConnect != nil {
+				if err := onConnect(poolConn); err != nil {
+					poolConn.Close()
+					return nil, err
+				}
+			}
+			cp.logger.Debug("Successfully Created poolConn")
+			return poolConn, nil
+		}
+
+		// consider adding a more sophisticated jitter approach
+		jitter := time.Duration(rand.Int63n(100)) * time.Millisecond
+		delay := time.Duration(1<<attempt)*baseTime + jitter
+
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	return nil, err
+
+}
+
+func (cp *ConnPool) Return(poolConn *PoolConn) error {
+	cp.stats.inUse.Add(-1)
+	cp.putIdle(poolConn)
+
+	return nil
+}
+
+// discard closes a connection that was taken from the pool and can't be reused
+func (cp *ConnPool) discard(poolConn *PoolConn) {
+	cp.stats.inUse.Add(-1)
+	cp.closeConn(poolConn)
+}
+
+// closeConn closes an open connection and frees its slot
+func (cp *ConnPool) closeConn(poolConn *PoolConn) {
+	poolConn.Close()
+	<-cp.slots
+}
+
+func (cp *ConnPool) putIdle(poolConn *PoolConn) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.closed {
+		cp.closeConn(poolConn)
+		return
+	}
+
+	select {
+	case cp.pool <- poolConn:
+	// return the connection to the pool
+	default:
+		// pool is full so drop it
+		cp.closeConn(poolConn)
+	}
+}
+
+func (cp *ConnPool) isClosed() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.closed
+}
+
+// Close closes the idle connections, the connections in use are closed when they are returned
+func (cp *ConnPool) Close() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.closed {
+		return
+	}
+
+	cp.closed = true
+	close(cp.stop)
+
+	for {
+		select {
+		case poolConn := <-cp.pool:
+			cp.closeConn(poolConn)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+)
+
+var poolConf = config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15}
+
+func TestPoolIsBounded(t *testing.T) {
+	listener := startHungServer(t)
+	defer listener.Close()
+
+	pool := NewConnPool(2, listener.Addr().String(), poolConf)
+	pool.waitTimeout = 100 * time.Millisecond
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every connection is in use
+	if _, err := pool.Get(); !errors.Is(err, ErrPoolTimeout) {
+		t.Errorf("expected ErrPoolTimeout, got %v", err)
+	}
+
+	// a waiting caller gets the connection that is returned
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Return(first)
+	}()
+	if poolConn, err := pool.Get(); err != nil || poolConn != first {
+		t.Errorf("expected the returned connection, got %v", err)
+	}
+
+	// the context is honoured while waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pool.waitTimeout = 0
+	if _, err := pool.GetContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	if pool.stats.dials.Load() != 2 || pool.stats.waits.Load() != 3 || pool.stats.waitTimeouts.Load() != 1 {
+		t.Errorf("unexpected stats: dials=%d, waits=%d, timeouts=%d",
+			pool.stats.dials.Load(), pool.stats.waits.Load(), pool.stats.waitTimeouts.Load())
+	}
+
+	// a closed connection frees its slot
+	pool.discard(first)
+	if _, err := pool.Get(); err != nil {
+		t.Errorf("expected a new connection, got %v", err)
+	}
+}
+
+func TestPoolWarmUpAndValidation(t *testing.T) {
+	listener := startHungServer(t)
+	defer listener.Close()
+
+	pool := NewConnPool(3, listener.Addr().String(), poolConf)
+	go pool.maintain(time.Hour, 2)
+	defer pool.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	if len(pool.pool) != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", len(pool.pool))
+	}
+
+	// the live idle connections are kept
+	pool.validateIdle()
+	if len(pool.pool) != 2 || pool.stats.brokenCloses.Load() != 0 {
+		t.Fatalf("expected the idle connections to be kept, got %d", len(pool.pool))
+	}
+
+	// the server closes the connections when it sees the end of their input
+	for i := 0; i < 2; i++ {
+		poolConn := <-pool.pool
+		poolConn.conn.(*net.TCPConn).CloseWrite()
+		pool.pool <- poolConn
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	pool.validateIdle()
+	if len(pool.pool) != 0 || pool.stats.brokenCloses.Load() != 2 {
+		t.Errorf("expected the broken connections to be closed, idle=%d, broken=%d", len(pool.pool), pool.stats.brokenCloses.Load())
+	}
+}
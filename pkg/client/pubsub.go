@@ -0,0 +1,279 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+// the number of messages that wait for the receiver of a subscription, the server drops a subscriber that falls
+// further behind
+const subscriptionBufferSize = 100
+
+// Message is a message that was published to a channel
+type Message struct {
+	Channel string
+	// the pattern that matched the channel, empty for a subscription to the channel itself
+	Pattern string
+	Payload string
+}
+
+// Publish sends a message to the subscribers of the channel and returns how many received it. A channel lives on the
+// primary of its name, like a key, so the publishers and the subscribers meet there. The messages are not stored, a
+// channel without subscribers drops them
+func (c *Client) Publish(ctx context.Context, channel, message string) (int, error) {
+	c.logger.Debug("PUBLISH " + channel)
+	primaryNode, err := c.ring.GetNode(channel)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.sendCommandContext(ctx, primaryNode, fmt.Sprintf("PUBLISH %s %s", channel, message))
+	if err != nil {
+		return 0, err
+	}
+
+	received, err := strconv.Atoi(resp)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply to PUBLISH: %s", resp)
+	}
+
+	return received, nil
+}
+
+// Subscribe receives the messages of the channels until ctx is done or the client is closed, then the returned
+// channel is closed. It returns once the subscriptions are confirmed. A lost connection is opened again in the
+// background, the messages that are published in the meantime are lost and so are the ones of a receiver that is
+// so slow that the server drops it. The keyspace notifications are subscribed where the servers publish them,
+// __keyspace__:<key> on the primary of the key and __keyevent__:<event> on every primary
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	byNode := map[*CacheNode][]string{}
+	for _, channel := range channels {
+		nodes, err := c.channelNodes(channel)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			byNode[node] = append(byNode[node], channel)
+		}
+	}
+
+	return c.subscribe(ctx, "SUBSCRIBE", byNode)
+}
+
+// channelNodes returns the nodes that a channel is subscribed on
+func (c *Client) channelNodes(channel string) ([]*CacheNode, error) {
+	if strings.HasPrefix(channel, "__keyevent__:") {
+		return c.primaries(), nil
+	}
+
+	name := channel
+	if key, found := strings.CutPrefix(channel, "__keyspace__:"); found {
+		name = key
+	}
+	node, err := c.ring.GetNode(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*CacheNode{node}, nil
+}
+
+// PSubscribe is like Subscribe for the channels that match the glob patterns. Since a matching channel can live on
+// any shard it subscribes on every primary
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (<-chan Message, error) {
+	byNode := map[*CacheNode][]string{}
+	for _, node := range c.primaries() {
+		byNode[node] = patterns
+	}
+
+	return c.subscribe(ctx, "PSUBSCRIBE", byNode)
+}
+
+func (c *Client) subscribe(ctx context.Context, cmd string, byNode map[*CacheNode][]string) (<-chan Message, error) {
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	if len(byNode) == 0 {
+		return nil, fmt.Errorf("%s needs at least one name", cmd)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	out := make(chan Message, subscriptionBufferSize)
+	var wg sync.WaitGroup
+	for node, names := range byNode {
+		sub := &subscription{node: node, cmd: cmd, names: names, out: out, logger: c.logger}
+		if err := sub.connect(ctx); err != nil {
+			cancel()
+			wg.Wait()
+			return nil, err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub.receive(ctx)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// subscription is the connection of a Subscribe or a PSubscribe to a node
+type subscription struct {
+	node  *CacheNode
+	cmd   string
+	names []string
+	out   chan<- Message
+
+	conn    net.Conn
+	scanner *bufio.Scanner
+	stop    func() bool
+	// the messages that arrived along with the confirmations
+	pending []Message
+	logger  logger.Logger
+}
+
+// connect opens the connection and waits for every name to be confirmed
+func (sub *subscription) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", sub.node.ConnPool.address)
+	if err != nil {
+		return err
+	}
+	// the connection is closed when ctx is done, that also stops a read that is waiting
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	fail := func(err error) error {
+		stop()
+		conn.Close()
+		return err
+	}
+
+	if err := protocol.WriteLine(conn, sub.cmd+" "+strings.Join(sub.names, " ")); err != nil {
+		return fail(err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(protocol.ScanLines)
+	for confirmed := 0; confirmed < len(sub.names); {
+		if !scanner.Scan() {
+			return fail(fmt.Errorf("no response to %s from %s", sub.cmd, sub.node.ID))
+		}
+		line := scanner.Text()
+
+		if msg, ok := parseMessage(line); ok {
+			sub.pending = append(sub.pending, msg)
+			continue
+		}
+		if !strings.HasPrefix(line, sub.cmd+" ") {
+			return fail(fmt.Errorf("failed to %s on %s: %s", sub.cmd, sub.node.ID, line))
+		}
+		confirmed++
+	}
+
+	sub.conn, sub.scanner, sub.stop = conn, scanner, stop
+	sub.logger.Debug(sub.cmd + " connection to " + sub.node.ID + " is ready")
+
+	return nil
+}
+
+// receive delivers the messages and opens the connection again when it is lost, until ctx is done
+func (sub *subscription) receive(ctx context.Context) {
+	for attempt := 0; ; {
+		if sub.conn != nil {
+			err := sub.deliver(ctx)
+			sub.stop()
+			sub.conn.Close()
+			sub.conn = nil
+			if ctx.Err() != nil {
+				return
+			}
+			sub.logger.Warn(sub.cmd + " connection to " + sub.node.ID + " failed: " + err.Error())
+		}
+
+		if attempt > 5 {
+			attempt = 5
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(1<<attempt) * 100 * time.Millisecond):
+		}
+
+		if err := sub.connect(ctx); err != nil {
+			attempt++
+			continue
+		}
+		attempt = 0
+	}
+}
+
+func (sub *subscription) deliver(ctx context.Context) error {
+	send := func(msg Message) bool {
+		select {
+		case sub.out <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for _, msg := range sub.pending {
+		if !send(msg) {
+			return ctx.Err()
+		}
+	}
+	sub.pending = nil
+
+	for sub.scanner.Scan() {
+		if msg, ok := parseMessage(sub.scanner.Text()); ok && !send(msg) {
+			return ctx.Err()
+		}
+	}
+
+	if err := sub.scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("connection closed by the server")
+}
+
+// parseMessage parses MESSAGE <channel> <payload> and PMESSAGE <pattern> <channel> <payload>
+func parseMessage(line string) (Message, bool) {
+	if rest, found := strings.CutPrefix(line, "MESSAGE "); found {
+		channel, payload, ok := strings.Cut(rest, " ")
+		return Message{Channel: channel, Payload: payload}, ok
+	}
+	if rest, found := strings.CutPrefix(line, "PMESSAGE "); found {
+		parts := strings.SplitN(rest, " ", 3)
+		if len(parts) != 3 {
+			return Message{}, false
+		}
+		return Message{Pattern: parts[0], Channel: parts[1], Payload: parts[2]}, true
+	}
+
+	return Message{}, false
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12369, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12369"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	receive := func(messages <-chan Message) (Message, bool) {
+		select {
+		case msg, ok := <-messages:
+			return msg, ok
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for a message")
+			return Message{}, false
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := client.Subscribe(ctx, "config", "deploys")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	patternMessages, err := client.PSubscribe(ctx, "user:*")
+	if err != nil {
+		t.Fatalf("PSubscribe failed: %v", err)
+	}
+
+	if received, err := client.Publish(ctx, "config", "reload now"); err != nil || received != 1 {
+		t.Errorf("Publish failed: received=%d, err=%v", received, err)
+	}
+	if msg, _ := receive(messages); msg != (Message{Channel: "config", Payload: "reload now"}) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	if received, err := client.Publish(ctx, "user:42", "logged in"); err != nil || received != 1 {
+		t.Errorf("Publish failed: received=%d, err=%v", received, err)
+	}
+	if msg, _ := receive(patternMessages); msg != (Message{Pattern: "user:*", Channel: "user:42", Payload: "logged in"}) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	if received, err := client.Publish(ctx, "nobody", "hello"); err != nil || received != 0 {
+		t.Errorf("expected no receivers: received=%d, err=%v", received, err)
+	}
+
+	// the channels are closed when ctx is done
+	cancel()
+	for _, ch := range []<-chan Message{messages, patternMessages} {
+		for {
+			if _, ok := receive(ch); !ok {
+				break
+			}
+		}
+	}
+
+	if _, err := client.PSubscribe(context.Background(), "[a-"); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+}
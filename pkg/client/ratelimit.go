@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is the decision of Throttle or SlidingWindow
+type RateLimit struct {
+	Allowed bool
+	// the requests of cost 1 that are left
+	Remaining int64
+	// how long to wait before the same cost is allowed, 0 for an allowed request
+	RetryAfter time.Duration
+}
+
+// Throttle takes cost tokens from the token bucket of the key. A new bucket holds capacity tokens and refills at
+// refillPerSecond tokens per second up to capacity. The decision is taken on the primary of the key, so every client
+// shares the bucket. A cost of 0 reads the bucket without taking anything
+func (c *Client) Throttle(ctx context.Context, key string, capacity int64, refillPerSecond float64, cost int64) (RateLimit, error) {
+	return c.rateLimit(ctx, key, fmt.Sprintf("THROTTLE %s %d %s %d", key, capacity, strconv.FormatFloat(refillPerSecond, 'f', -1, 64), cost))
+}
+
+// SlidingWindow allows up to limit requests of the key in any window of the given length, cost counts as that many
+// requests. The count is an approximation that weighs the previous fixed window by its part in the sliding window.
+// The window is rounded down to milliseconds
+func (c *Client) SlidingWindow(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (RateLimit, error) {
+	return c.rateLimit(ctx, key, fmt.Sprintf("WINDOW %s %d %d %d", key, limit, window.Milliseconds(), cost))
+}
+
+func (c *Client) rateLimit(ctx context.Context, key string, cmd string) (RateLimit, error) {
+	resp, err := c.counter(ctx, key, cmd)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	fields := strings.Split(resp, " ")
+	if len(fields) != 3 || fields[0] != "ALLOWED" && fields[0] != "DENIED" {
+		return RateLimit{}, fmt.Errorf("unexpected reply: %s", resp)
+	}
+	remaining, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("unexpected reply: %s", resp)
+	}
+	retryAfter, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("unexpected reply: %s", resp)
+	}
+
+	return RateLimit{Allowed: fields[0] == "ALLOWED", Remaining: remaining, RetryAfter: time.Duration(retryAfter) * time.Millisecond}, nil
+}
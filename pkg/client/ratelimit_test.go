@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12372, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12372"), WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	for i := int64(1); i >= 0; i-- {
+		limit, err := client.Throttle(ctx, "api", 2, 0.5, 1)
+		if err != nil || !limit.Allowed || limit.Remaining != i || limit.RetryAfter != 0 {
+			t.Fatalf("expected an allowed request with %d remaining, got %+v, %v", i, limit, err)
+		}
+	}
+	limit, err := client.Throttle(ctx, "api", 2, 0.5, 1)
+	if err != nil || limit.Allowed || limit.RetryAfter <= time.Second || limit.RetryAfter > 2*time.Second {
+		t.Errorf("expected a denied request to retry within 2s, got %+v, %v", limit, err)
+	}
+
+	limit, err = client.SlidingWindow(ctx, "login", 1, time.Minute, 1)
+	if err != nil || !limit.Allowed || limit.Remaining != 0 {
+		t.Errorf("expected an allowed request, got %+v, %v", limit, err)
+	}
+	limit, err = client.SlidingWindow(ctx, "login", 1, time.Minute, 1)
+	if err != nil || limit.Allowed || limit.RetryAfter <= 0 || limit.RetryAfter > 2*time.Minute {
+		t.Errorf("expected a denied request, got %+v, %v", limit, err)
+	}
+
+	if _, err := client.Throttle(ctx, "api", 2, 0.5, 3); err == nil {
+		t.Errorf("expected an error for a cost above the capacity")
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// poolStats counts the activity of a ConnPool
+type poolStats struct {
+	inUse         atomic.Int64
+	dials         atomic.Uint64
+	dialFailures  atomic.Uint64
+	expiredCloses atomic.Uint64
+	brokenCloses  atomic.Uint64
+	// the callers that found every connection in use and the ones that gave up waiting
+	waits        atomic.Uint64
+	waitTimeouts atomic.Uint64
+	// nanoseconds that the callers waited for a connection, the dials included
+	waitTime atomic.Int64
+}
+
+// NodeStats is a snapshot of the counters of a node, the counters only grow for the life of the client
+type NodeStats struct {
+	ID        string
+	IsPrimary bool
+	State     BreakerState
+	// connections taken from the pool and not returned yet
+	InUse int64
+	// connections waiting in the pool
+	Idle          int
+	Dials         uint64
+	DialFailures  uint64
+	ExpiredCloses uint64
+	// idle connections that were closed by the server
+	BrokenCloses uint64
+	// the requests that found every connection in use and the ones that gave up waiting
+	Waits        uint64
+	WaitTimeouts uint64
+	// the total time that the requests waited for a connection
+	WaitTime time.Duration
+	// the commands that are waiting for a reply
+	Outstanding int64
+	// the moving average and the percentiles of the latencies of the recent commands that got a reply
+	LatencyEWMA time.Duration
+	LatencyP50  time.Duration
+	LatencyP99  time.Duration
+}
+
+// Stats returns the counters of every node by its ID
+func (c *Client) Stats() map[string]NodeStats {
+	stats := map[string]NodeStats{}
+
+	for _, node := range c.nodes() {
+		nodeStats := NodeStats{
+			ID:            node.ID,
+			IsPrimary:     node.IsPrimary,
+			State:         node.State(),
+			InUse:         node.ConnPool.stats.inUse.Load(),
+			Idle:          len(node.ConnPool.pool),
+			Dials:         node.ConnPool.stats.dials.Load(),
+			DialFailures:  node.ConnPool.stats.dialFailures.Load(),
+			ExpiredCloses: node.ConnPool.stats.expiredCloses.Load(),
+			BrokenCloses:  node.ConnPool.stats.brokenCloses.Load(),
+			Waits:         node.ConnPool.stats.waits.Load(),
+			WaitTimeouts:  node.ConnPool.stats.waitTimeouts.Load(),
+			WaitTime:      time.Duration(node.ConnPool.stats.waitTime.Load()),
+			Outstanding:   node.stats.outstanding.Load(),
+		}
+
+		node.stats.lock.Lock()
+		nodeStats.LatencyEWMA = time.Duration(node.stats.ewma)
+		node.stats.lock.Unlock()
+
+		if latencies := node.stats.latencies(); len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			nodeStats.LatencyP50 = latencies[(len(latencies)-1)*50/100]
+			nodeStats.LatencyP99 = latencies[(len(latencies)-1)*99/100]
+		}
+
+		stats[node.ID] = nodeStats
+	}
+
+	return stats
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStatsAndClose(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12361, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12361)
+	if err := client.EnableNearCache(NearCacheOptions{Size: 10, Tracking: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := client.Set("key", "value"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	stats := client.Stats()["testNode"]
+	if stats.Dials == 0 || stats.Idle != 1 || stats.InUse != 0 || stats.DialFailures != 0 {
+		t.Errorf("unexpected pool stats: %+v", stats)
+	}
+	if stats.LatencyEWMA <= 0 || stats.LatencyP50 <= 0 || stats.LatencyP99 < stats.LatencyP50 || stats.WaitTime <= 0 {
+		t.Errorf("unexpected latency stats: %+v", stats)
+	}
+
+	client.Close()
+	client.Close()
+
+	if _, err := client.Get("key"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if _, err := client.Set("key", "value"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if stats := client.Stats()["testNode"]; stats.Idle != 0 {
+		t.Errorf("expected the idle connections to be closed, got %d", stats.Idle)
+	}
+}
+
+func TestStatsDialFailures(t *testing.T) {
+	// nothing listens on the port
+	client := newSingleNodeClient(12362)
+	client.nodes()[0].ConnPool.dialAttempts = 2
+
+	if _, err := client.Get("key"); err == nil {
+		t.Fatal("expected the Get to fail")
+	}
+
+	stats := client.Stats()["testNode"]
+	if stats.Dials != 2 || stats.DialFailures != 2 || stats.InUse != 0 || stats.WaitTime < 100*time.Millisecond {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,299 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+// the attempts of a Tx before it gives up with ErrTxConflict
+const txMaxAttempts = 10
+
+var (
+	// ErrTxConflict is returned by Tx when a watched key was changed by someone else in every attempt
+	ErrTxConflict = errors.New("transaction conflict, the watched keys kept changing")
+	// ErrTxCrossNode is returned by Tx when its keys live on more than one primary, there is no coordination between
+	// the primaries so a transaction runs on a single one
+	ErrTxCrossNode = errors.New("the keys of a transaction live on different primaries")
+)
+
+// Tx queues the writes of a transaction, it is passed to the function of Client.Tx
+type Tx struct {
+	ctx    context.Context
+	client *Client
+	node   *CacheNode
+	conn   *PoolConn
+	// set when the connection can't go back to the pool
+	broken bool
+	queued []string
+	keys   []string
+	// the first command that could not be queued
+	err error
+}
+
+// Tx runs fn as an optimistic transaction. The keys are watched, fn reads them with tx.Get and queues its writes,
+// which run together with MULTI/EXEC once fn returns. If one of the keys was changed by someone else in the meantime
+// nothing is written and fn runs again, up to 10 times before ErrTxConflict. An error of fn ends the transaction
+// without writing anything.
+//
+// Every key that the transaction reads or writes must live on the same primary, otherwise it fails with
+// ErrTxCrossNode. The replies of the queued writes are returned in order, a write that the server rejects doesn't
+// undo the others, the error of the first one is returned along with the replies
+//
+//	_, err := c.Tx(ctx, func(tx *client.Tx) error {
+//		doc, err := tx.Get("doc")
+//		...
+//		tx.Set("doc", edit(doc))
+//		tx.SAdd("index", "doc")
+//		return nil
+//	}, "doc", "index")
+func (c *Client) Tx(ctx context.Context, fn func(tx *Tx) error, keys ...string) ([]string, error) {
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("a transaction needs at least one key")
+	}
+
+	node, err := c.ring.GetNode(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys[1:] {
+		if other, err := c.ring.GetNode(key); err != nil || other != node {
+			return nil, fmt.Errorf("%w: %s and %s", ErrTxCrossNode, keys[0], key)
+		}
+	}
+
+	for attempt := 0; attempt < txMaxAttempts; attempt++ {
+		replies, committed, err := c.runTx(ctx, node, fn, keys)
+		if err != nil || committed {
+			return replies, err
+		}
+		c.logger.Debug("transaction on " + node.ID + " aborted, a watched key changed")
+	}
+
+	return nil, ErrTxConflict
+}
+
+// runTx makes one attempt of a transaction, it reports false if EXEC was aborted
+func (c *Client) runTx(ctx context.Context, node *CacheNode, fn func(tx *Tx) error, keys []string) ([]string, bool, error) {
+	conn, err := node.ConnPool.GetContext(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tx := &Tx{ctx: ctx, client: c, node: node, conn: conn}
+	defer func() {
+		// a connection that stopped in the middle of a transaction still has its state on the server
+		if tx.broken {
+			node.ConnPool.discard(conn)
+		} else {
+			node.ConnPool.Return(conn)
+		}
+	}()
+
+	if _, err := tx.reply("WATCH " + strings.Join(keys, " ")); err != nil {
+		tx.broken = true
+		return nil, false, err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.broken = true
+		return nil, false, err
+	}
+	if tx.err != nil {
+		tx.broken = true
+		return nil, false, tx.err
+	}
+	if len(tx.queued) == 0 {
+		if _, err := tx.reply("UNWATCH"); err != nil {
+			tx.broken = true
+			return nil, false, err
+		}
+		return []string{}, true, nil
+	}
+
+	replies, committed, err := tx.commit()
+	if committed && c.nearCache != nil {
+		for _, key := range tx.keys {
+			c.nearCache.invalidate(key)
+		}
+	}
+	if err != nil || !committed {
+		return replies, committed, err
+	}
+
+	return replies, true, tx.firstError(replies)
+}
+
+// commit sends MULTI, the queued writes and EXEC. The offset of the write becomes the session token of the shard
+func (tx *Tx) commit() ([]string, bool, error) {
+	var cmds strings.Builder
+	cmds.WriteString("MULTI\n")
+	for _, cmd := range tx.queued {
+		cmds.WriteString(protocol.Format(cmd))
+	}
+	queued, err := tx.roundTrip(cmds.String(), len(tx.queued)+1, false)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, resp := range queued {
+		if i == 0 && resp != "OK" || i > 0 && resp != "QUEUED" {
+			tx.broken = true
+			_, err := parseReply(resp)
+			if err == nil {
+				err = fmt.Errorf("unexpected reply: %s", resp)
+			}
+			return nil, false, err
+		}
+	}
+
+	resp, err := tx.roundTrip("EXEC\nOFFSET\n", 2, true)
+	if err != nil {
+		return nil, false, err
+	}
+	result, offset := resp[:len(resp)-1], resp[len(resp)-1]
+	tx.client.session.observeReply(tx.node.ID, offset)
+
+	if result[0] == "ABORTED" {
+		return nil, false, nil
+	}
+	if _, isHeader := parseLinesHeader(result[0]); !isHeader {
+		_, err := parseReply(result[0])
+		if err == nil {
+			err = fmt.Errorf("unexpected reply to EXEC: %s", result[0])
+		}
+		return nil, false, err
+	}
+
+	return result[1:], true, nil
+}
+
+// firstError returns the error of the first reply that is one, with the write that caused it
+func (tx *Tx) firstError(replies []string) error {
+	for i, resp := range replies {
+		if _, err := parseReply(resp); err != nil {
+			return fmt.Errorf("%s: %w", tx.queued[i], err)
+		}
+	}
+
+	return nil
+}
+
+// reply sends a command on the connection of the transaction and returns its reply
+func (tx *Tx) reply(cmd string) (string, error) {
+	resp, err := tx.roundTrip(protocol.Format(cmd), 1, false)
+	if err != nil {
+		return "", err
+	}
+
+	return parseReply(resp[0])
+}
+
+func (tx *Tx) roundTrip(cmds string, replies int, multiLine bool) ([]string, error) {
+	resp, reusable, err := tx.conn.roundTrip(tx.ctx, []byte(cmds), replies, multiLine)
+	if err != nil || !reusable {
+		tx.broken = true
+	}
+	if err != nil {
+		if ctxErr := contextErr(tx.ctx); ctxErr != nil {
+			return nil, fmt.Errorf("%w: %s", ctxErr, err.Error())
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Get reads the current value of a key of the transaction, errorutil.ErrKeyNotFound if it doesn't exist
+func (tx *Tx) Get(key string) (string, error) {
+	if err := tx.checkKey(key); err != nil {
+		return "", err
+	}
+
+	return tx.reply("GET " + key)
+}
+
+// Set queues a SET of the key
+func (tx *Tx) Set(key, value string) {
+	tx.queue(key, "SET "+key+" "+value)
+}
+
+// Delete queues a DELETE of the key, its reply is an error if the key doesn't exist
+func (tx *Tx) Delete(key string) {
+	tx.queue(key, "DELETE "+key)
+}
+
+// IncrBy queues an INCRBY of the key, its reply is the new value
+func (tx *Tx) IncrBy(key string, delta int64) {
+	tx.queue(key, fmt.Sprintf("INCRBY %s %d", key, delta))
+}
+
+// HSet queues an HSET of a field of a hash
+func (tx *Tx) HSet(key, field, value string) {
+	tx.queue(key, "HSET "+key+" "+field+" "+value)
+}
+
+// HDel queues an HDEL of fields of a hash
+func (tx *Tx) HDel(key string, fields ...string) {
+	tx.queue(key, "HDEL "+key+" "+strings.Join(fields, " "))
+}
+
+// RPush queues an RPUSH of a value to a list
+func (tx *Tx) RPush(key, value string) {
+	tx.queue(key, "RPUSH "+key+" "+value)
+}
+
+// SAdd queues an SADD of members to a set
+func (tx *Tx) SAdd(key string, members ...string) {
+	tx.queue(key, "SADD "+key+" "+strings.Join(members, " "))
+}
+
+// SRem queues an SREM of members from a set
+func (tx *Tx) SRem(key string, members ...string) {
+	tx.queue(key, "SREM "+key+" "+strings.Join(members, " "))
+}
+
+// ZAdd queues a ZADD of members to a sorted set
+func (tx *Tx) ZAdd(key string, members ...ZMember) {
+	args := make([]string, 0, 2*len(members))
+	for _, member := range members {
+		args = append(args, formatScore(member.Score), member.Member)
+	}
+
+	tx.queue(key, "ZADD "+key+" "+strings.Join(args, " "))
+}
+
+func (tx *Tx) queue(key string, cmd string) {
+	if tx.err != nil {
+		return
+	}
+	if err := tx.checkKey(key); err != nil {
+		tx.err = err
+		return
+	}
+	if err := validateCommand([]byte(protocol.Format(cmd))); err != nil {
+		tx.err = err
+		return
+	}
+
+	tx.queued = append(tx.queued, cmd)
+	tx.keys = append(tx.keys, key)
+}
+
+// checkKey fails for a key that lives on another primary than the transaction
+func (tx *Tx) checkKey(key string) error {
+	node, err := tx.client.ring.GetNode(key)
+	if err != nil {
+		return err
+	}
+	if node != tx.node {
+		return fmt.Errorf("%w: %s", ErrTxCrossNode, key)
+	}
+
+	return nil
+}
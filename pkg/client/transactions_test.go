@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+func TestTx(t *testing.T) {
+	listener, err := startTestServer(t, 1000, 12370, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12370"), WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	replies, err := client.Tx(ctx, func(tx *Tx) error {
+		if _, err := tx.Get("doc"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+			t.Errorf("expected ErrKeyNotFound, got %v", err)
+		}
+		tx.Set("doc", "first version")
+		tx.SAdd("index", "doc")
+		tx.IncrBy("docs", 1)
+		return nil
+	}, "doc", "index", "docs")
+	if err != nil || len(replies) != 3 || replies[0] != "OK" || replies[1] != "1" || replies[2] != "1" {
+		t.Fatalf("Tx failed: replies=%v, err=%v", replies, err)
+	}
+	if value, _ := client.Get("doc"); value != "first version" {
+		t.Errorf("expected the document to be written, got %q", value)
+	}
+
+	// a change of a watched key runs fn again
+	attempts := 0
+	_, err = client.Tx(ctx, func(tx *Tx) error {
+		attempts++
+		doc, err := tx.Get("doc")
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			client.Set("doc", "changed meanwhile")
+		}
+		tx.Set("doc", doc+" edited")
+		return nil
+	}, "doc")
+	if err != nil || attempts != 2 {
+		t.Errorf("expected a retry: attempts=%d, err=%v", attempts, err)
+	}
+	if value, _ := client.Get("doc"); value != "changed meanwhile edited" {
+		t.Errorf("expected the edit of the latest value, got %q", value)
+	}
+
+	// a key that keeps changing gives up
+	_, err = client.Tx(ctx, func(tx *Tx) error {
+		client.Set("doc", "again")
+		tx.Set("doc", "never")
+		return nil
+	}, "doc")
+	if !errors.Is(err, ErrTxConflict) {
+		t.Errorf("expected ErrTxConflict, got %v", err)
+	}
+
+	// an error of fn writes nothing
+	failure := errors.New("validation failed")
+	if _, err := client.Tx(ctx, func(tx *Tx) error {
+		tx.Set("doc", "invalid")
+		return failure
+	}, "doc"); !errors.Is(err, failure) {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+	if value, _ := client.Get("doc"); value != "again" {
+		t.Errorf("expected the document to be unchanged, got %q", value)
+	}
+
+	// a rejected write doesn't undo the others
+	replies, err = client.Tx(ctx, func(tx *Tx) error {
+		tx.IncrBy("doc", 1)
+		tx.Set("doc2", "written")
+		return nil
+	}, "doc")
+	if err == nil || len(replies) != 2 || replies[1] != "OK" {
+		t.Errorf("expected the error of INCRBY with the replies: replies=%v, err=%v", replies, err)
+	}
+
+	// concurrent transactions don't lose an update
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				_, err := client.Tx(ctx, func(tx *Tx) error {
+					value, err := tx.Get("counter")
+					if err != nil && !errors.Is(err, errorutil.ErrKeyNotFound) {
+						return err
+					}
+					n, _ := strconv.Atoi(value)
+					tx.Set("counter", strconv.Itoa(n+1))
+					tx.RPush("history", strconv.Itoa(n+1))
+					return nil
+				}, "counter")
+				if err != nil && !errors.Is(err, ErrTxConflict) {
+					t.Errorf("Tx failed: %v", err)
+					return
+				}
+				if errors.Is(err, ErrTxConflict) {
+					j--
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := client.Get("counter"); value != "100" {
+		t.Errorf("expected 100, got %s", value)
+	}
+	if history, _ := client.LRange(ctx, "history", 0, -1); len(history) != 100 {
+		t.Errorf("expected a push per transaction, got %d", len(history))
+	}
+}
+
+func TestTxKeysOnOnePrimary(t *testing.T) {
+	cfg := &config.Configuration{
+		ClientConfig: config.ClientConfig{ConnectionTimeout: 300, KeepAliveInterval: 15, UnHealthyInterval: 1},
+		Servers: []config.ServerConfig{
+			{ID: "shard1", Address: "localhost:1", Role: "PRIMARY"},
+			{ID: "shard2", Address: "localhost:2", Role: "PRIMARY"},
+		},
+	}
+	client, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	first, _ := client.ring.GetNode("key0")
+	other := ""
+	for i := 1; other == ""; i++ {
+		if node, _ := client.ring.GetNode("key" + strconv.Itoa(i)); node != first {
+			other = "key" + strconv.Itoa(i)
+		}
+	}
+
+	if _, err := client.Tx(context.Background(), func(tx *Tx) error { return nil }, "key0", other); !errors.Is(err, ErrTxCrossNode) {
+		t.Errorf("expected ErrTxCrossNode, got %v", err)
+	}
+
+	// the keys that share a hash tag live together, whatever the rest of the key is
+	for i := 0; i < 20; i++ {
+		tag := "{" + strconv.Itoa(i) + "}"
+		profile, _ := client.ring.GetNode("user:" + tag + ":profile")
+		settings, _ := client.ring.GetNode("user:" + tag + ":settings")
+		bare, _ := client.ring.GetNode(strconv.Itoa(i))
+		if profile != settings || profile != bare {
+			t.Errorf("expected the keys of the tag %s on the same primary", tag)
+		}
+	}
+}
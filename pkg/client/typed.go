@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Codec converts the values of a Typed client to bytes and back
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec encodes the values with encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec encodes the values with encoding/gob, it is faster than JSON but only Go clients can read the values
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// RawCodec stores the bytes as they are
+type RawCodec struct{}
+
+func (RawCodec) Encode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (RawCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// TypedOptions configures a Typed client
+type TypedOptions struct {
+	// the encoded values that are larger than this many bytes are compressed with gzip, zero disables the compression
+	CompressAbove int
+}
+
+// The encoded values are stored as they are behind a prefix that tells if they are compressed, the protocol sends a value
+// with a newline or another byte that a line can't hold as a bulk line
+const (
+	typedPlainPrefix      = "b:"
+	typedCompressedPrefix = "z:"
+)
+
+// Typed stores values of type T through a Client
+type Typed[T any] struct {
+	client *Client
+	codec  Codec[T]
+	opts   TypedOptions
+}
+
+// NewTyped returns a typed view of the client, e.g. NewTyped[User](c, JSONCodec[User]{}, TypedOptions{})
+func NewTyped[T any](c *Client, codec Codec[T], opts TypedOptions) *Typed[T] {
+	return &Typed[T]{
+		client: c,
+		codec:  codec,
+		opts:   opts,
+	}
+}
+
+func (t *Typed[T]) Set(ctx context.Context, key string, value T) error {
+	encoded, err := t.encode(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.client.SetContext(ctx, key, encoded)
+	return err
+}
+
+// SetWithTTL is like Set but the server removes the key when ttl passes
+func (t *Typed[T]) SetWithTTL(ctx context.Context, key string, value T, ttl time.Duration) error {
+	encoded, err := t.encode(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.client.SetWithTTLContext(ctx, key, encoded, ttl)
+	return err
+}
+
+// Get returns errorutil.ErrKeyNotFound if the key doesn't exist and an error if it wasn't stored by a Typed client
+func (t *Typed[T]) Get(ctx context.Context, key string, opts ...GetOption) (T, error) {
+	var zero T
+
+	resp, err := t.client.GetContext(ctx, key, opts...)
+	if err != nil {
+		return zero, err
+	}
+
+	return t.decode(resp)
+}
+
+func (t *Typed[T]) encode(value T) (string, error) {
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the value: %w", err)
+	}
+
+	if t.opts.CompressAbove > 0 && len(data) > t.opts.CompressAbove {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return "", err
+		}
+		if err := writer.Close(); err != nil {
+			return "", err
+		}
+
+		// keep the compressed form only if it is smaller
+		if buf.Len() < len(data) {
+			return typedCompressedPrefix + buf.String(), nil
+		}
+	}
+
+	return typedPlainPrefix + string(data), nil
+}
+
+func (t *Typed[T]) decode(resp string) (T, error) {
+	var zero T
+
+	compressed := strings.HasPrefix(resp, typedCompressedPrefix)
+	if !compressed && !strings.HasPrefix(resp, typedPlainPrefix) {
+		return zero, fmt.Errorf("the value was not stored by a typed client")
+	}
+
+	data := []byte(resp[len(typedPlainPrefix):])
+	if compressed {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return zero, fmt.Errorf("failed to decompress the value: %w", err)
+		}
+		defer reader.Close()
+
+		if data, err = io.ReadAll(reader); err != nil {
+			return zero, fmt.Errorf("failed to decompress the value: %w", err)
+		}
+	}
+
+	value, err := t.codec.Decode(data)
+	if err != nil {
+		return zero, fmt.Errorf("failed to decode the value: %w", err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+type typedUser struct {
+	Name  string
+	Bio   string
+	Roles []string
+}
+
+func TestTypedValues(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12357, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12357)
+	ctx := context.Background()
+
+	user := typedUser{Name: "gopher", Bio: "line one\nline two", Roles: []string{"admin"}}
+
+	for name, users := range map[string]*Typed[typedUser]{
+		"json": NewTyped[typedUser](client, JSONCodec[typedUser]{}, TypedOptions{}),
+		"gob":  NewTyped[typedUser](client, GobCodec[typedUser]{}, TypedOptions{}),
+	} {
+		if err := users.Set(ctx, "user:"+name, user); err != nil {
+			t.Fatalf("%s: Set failed: %v", name, err)
+		}
+		got, err := users.Get(ctx, "user:"+name)
+		if err != nil || got.Name != user.Name || got.Bio != user.Bio || len(got.Roles) != 1 {
+			t.Errorf("%s: Get failed: got=%+v, err=%v", name, got, err)
+		}
+	}
+
+	raw := NewTyped[[]byte](client, RawCodec{}, TypedOptions{})
+	data := []byte{0, '\n', 255, '\r', 'a', ' ', '\t'}
+	if err := raw.Set(ctx, "raw", data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := raw.Get(ctx, "raw"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get failed: got=%v, err=%v", got, err)
+	}
+
+	if _, err := raw.Get(ctx, "missing"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// the plain values are binary safe too
+	if _, err := client.Set("multiline", "$3\nline two "); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Get("multiline"); err != nil || got != "$3\nline two " {
+		t.Errorf("Get failed: got=%q, err=%v", got, err)
+	}
+
+	// a value of a plain Set can't be decoded
+	client.Set("plain", "value")
+	if _, err := raw.Get(ctx, "plain"); err == nil {
+		t.Error("expected an error for a value that was not stored by a typed client")
+	}
+}
+
+func TestTypedCompression(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12358, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client := newSingleNodeClient(12358)
+	ctx := context.Background()
+	texts := NewTyped[string](client, JSONCodec[string]{}, TypedOptions{CompressAbove: 1024})
+
+	// larger than the 64KB limit of a command before the compression
+	large := strings.Repeat("a long and repetitive text\n", 5000)
+	if err := texts.Set(ctx, "large", large); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	stored, _ := client.Get("large")
+	if !strings.HasPrefix(stored, typedCompressedPrefix) {
+		t.Errorf("expected the value to be compressed, got %d bytes", len(stored))
+	}
+	if got, err := texts.Get(ctx, "large"); err != nil || got != large {
+		t.Errorf("Get failed: %d bytes, err=%v", len(got), err)
+	}
+
+	// a small value is not compressed
+	texts.Set(ctx, "small", "tiny")
+	if stored, _ := client.Get("small"); !strings.HasPrefix(stored, typedPlainPrefix) {
+		t.Errorf("expected the small value to be stored plain, got %s", stored)
+	}
+}
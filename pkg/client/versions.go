@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrVersionMismatch is returned by CompareAndSet when the key was changed after its version was read
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// GetWithVersion returns the value of the key along with its version, the version is passed to CompareAndSet
+func (c *Client) GetWithVersion(k string) (string, uint64, error) {
+	return c.GetWithVersionContext(context.Background(), k)
+}
+
+// GetWithVersionContext is like GetWithVersion but gives up when ctx is done. The value is read from the primary
+// since a CompareAndSet with the version of a secondary that is behind would fail anyway
+func (c *Client) GetWithVersionContext(ctx context.Context, k string) (string, uint64, error) {
+	c.logger.Debug("GETS " + k)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
+		return "", 0, err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+
+	resp, err := c.sendCommandContext(ctx, primaryNode, "GETS "+k)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// <version> <value>
+	parts := strings.SplitN(resp, " ", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("unexpected reply to GETS: %s", resp)
+	}
+	version, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected reply to GETS: %s", resp)
+	}
+
+	return parts[1], version, nil
+}
+
+// CompareAndSet sets the value only if the version of the key is still version, zero for a key that doesn't exist,
+// and returns the new version. It fails with ErrVersionMismatch if the key was changed or deleted in the meantime
+//
+//	for {
+//		value, version, err := c.GetWithVersion("config")
+//		...
+//		if _, err = c.CompareAndSet("config", edit(value), version); !errors.Is(err, client.ErrVersionMismatch) {
+//			break
+//		}
+//	}
+func (c *Client) CompareAndSet(k, v string, version uint64) (uint64, error) {
+	return c.CompareAndSetContext(context.Background(), k, v, version)
+}
+
+// CompareAndSetContext is like CompareAndSet but gives up when ctx is done
+func (c *Client) CompareAndSetContext(ctx context.Context, k, v string, version uint64) (uint64, error) {
+	c.logger.Debug("CAS " + k + " " + v)
+	cmd := fmt.Sprintf("CAS %s %d %s", k, version, v)
+	primaryNode, err := c.ring.GetNode(k)
+	if err != nil {
+		return 0, err
+	}
+	c.logger.Debug("node selected to send the request: " + primaryNode.ID)
+	resp, err := c.write(ctx, primaryNode, cmd)
+
+	if c.nearCache != nil {
+		c.nearCache.invalidate(k)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	if resp == "CONFLICT" {
+		return 0, ErrVersionMismatch
+	}
+
+	stored, err := strconv.ParseUint(resp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply to CAS: %s", resp)
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+func TestCompareAndSet(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12366, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12366"), WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, _, err := client.GetWithVersion("config"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	version, err := client.CompareAndSet("config", "a b", 0)
+	if err != nil {
+		t.Fatalf("CompareAndSet failed: %v", err)
+	}
+	if _, err := client.CompareAndSet("config", "c", 0); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch for a key that exists, got %v", err)
+	}
+
+	value, read, err := client.GetWithVersion("config")
+	if err != nil || value != "a b" || read != version {
+		t.Errorf("GetWithVersion failed: value=%s, version=%d (expected %d), err=%v", value, read, version, err)
+	}
+
+	client.Set("config", "changed")
+	if _, err := client.CompareAndSet("config", "c", version); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch after a SET, got %v", err)
+	}
+
+	// concurrent read-modify-write loops don't lose an update
+	client.Set("counter", "0")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				for {
+					value, version, err := client.GetWithVersion("counter")
+					if err != nil {
+						t.Errorf("GetWithVersion failed: %v", err)
+						return
+					}
+					n, _ := strconv.Atoi(value)
+					_, err = client.CompareAndSet("counter", strconv.Itoa(n+1), version)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrVersionMismatch) {
+						t.Errorf("CompareAndSet failed: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _, _ := client.GetWithVersion("counter"); value != "100" {
+		t.Errorf("expected 100, got %s", value)
+	}
+}
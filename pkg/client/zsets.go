@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ZMember is a member of a sorted set with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd sets the scores of members of a sorted set and returns how many were new. A key that holds another type
+// fails with errorutil.ErrWrongType, like every method of the sorted sets
+func (c *Client) ZAdd(ctx context.Context, key string, members ...ZMember) (int, error) {
+	args := make([]string, 0, 2*len(members))
+	for _, member := range members {
+		args = append(args, formatScore(member.Score), member.Member)
+	}
+
+	return c.collectionCount(ctx, key, "ZADD "+key+" "+strings.Join(args, " "))
+}
+
+// ZIncrBy adds increment to the score of a member, a missing member starts from zero, and returns the new score
+func (c *Client) ZIncrBy(ctx context.Context, key, member string, increment float64) (float64, error) {
+	resp, err := c.collectionWrite(ctx, key, fmt.Sprintf("ZINCRBY %s %s %s", key, formatScore(increment), member))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseScore(resp)
+}
+
+// ZRem removes members of a sorted set and returns how many existed, the key is removed with its last member
+func (c *Client) ZRem(ctx context.Context, key string, members ...string) (int, error) {
+	return c.collectionCount(ctx, key, "ZREM "+key+" "+strings.Join(members, " "))
+}
+
+// ZRange returns the members of a sorted set from start to stop by rank in ascending order, both included. A
+// negative index counts from the end, so 0, -1 returns the whole set
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int) ([]ZMember, error) {
+	return c.zmembers(ctx, key, fmt.Sprintf("ZRANGE %s %d %d WITHSCORES", key, start, stop))
+}
+
+// ZRevRange is like ZRange but the ranks count from the highest score, so 0, 9 returns the top ten
+func (c *Client) ZRevRange(ctx context.Context, key string, start, stop int) ([]ZMember, error) {
+	return c.zmembers(ctx, key, fmt.Sprintf("ZREVRANGE %s %d %d WITHSCORES", key, start, stop))
+}
+
+// ZRangeByScore returns the members of a sorted set with a score from min to max, both included, in ascending
+// order. math.Inf can be passed for an open range. The first offset members are skipped and at most count are
+// returned, a count below 1 returns all of them
+func (c *Client) ZRangeByScore(ctx context.Context, key string, min, max float64, offset, count int) ([]ZMember, error) {
+	return c.zmembers(ctx, key, fmt.Sprintf("ZRANGEBYSCORE %s %s %s WITHSCORES LIMIT %d %d", key, formatScore(min), formatScore(max), offset, count))
+}
+
+// ZRank returns the rank of a member in ascending order starting from zero, errorutil.ErrKeyNotFound if the key or
+// the member doesn't exist
+func (c *Client) ZRank(ctx context.Context, key, member string) (int, error) {
+	resp, err := c.collectionRead(ctx, key, fmt.Sprintf("ZRANK %s %s", key, member))
+	if err != nil {
+		return 0, err
+	}
+
+	rank, err := strconv.Atoi(resp)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply: %s", resp)
+	}
+
+	return rank, nil
+}
+
+// ZScore returns the score of a member, errorutil.ErrKeyNotFound if the key or the member doesn't exist
+func (c *Client) ZScore(ctx context.Context, key, member string) (float64, error) {
+	resp, err := c.collectionRead(ctx, key, fmt.Sprintf("ZSCORE %s %s", key, member))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseScore(resp)
+}
+
+// zmembers reads a reply of members, each followed by its score
+func (c *Client) zmembers(ctx context.Context, key string, cmd string) ([]ZMember, error) {
+	lines, err := c.collectionReadLines(ctx, key, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply: %d lines", len(lines))
+	}
+
+	members := make([]ZMember, 0, len(lines)/2)
+	for i := 0; i < len(lines); i += 2 {
+		score, err := parseScore(lines[i+1])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ZMember{Member: lines[i], Score: score})
+	}
+
+	return members, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func parseScore(resp string) (float64, error) {
+	score, err := strconv.ParseFloat(resp, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected reply: %s", resp)
+	}
+
+	return score, nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+)
+
+func TestSortedSets(t *testing.T) {
+	listener, err := startTestServer(t, 100, 12368, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (listener).Stop()
+
+	client, err := New(newTestConfig("12368"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	added, err := client.ZAdd(ctx, "board", ZMember{"alice", 10}, ZMember{"bob", 20}, ZMember{"carol", 15})
+	if err != nil || added != 3 {
+		t.Errorf("ZAdd failed: added=%d, err=%v", added, err)
+	}
+	if score, err := client.ZIncrBy(ctx, "board", "alice", 12.5); err != nil || score != 22.5 {
+		t.Errorf("ZIncrBy failed: score=%v, err=%v", score, err)
+	}
+	if score, err := client.ZScore(ctx, "board", "alice"); err != nil || score != 22.5 {
+		t.Errorf("ZScore failed: score=%v, err=%v", score, err)
+	}
+
+	expected := []ZMember{{"alice", 22.5}, {"bob", 20}}
+	if top, err := client.ZRevRange(ctx, "board", 0, 1); err != nil || !reflect.DeepEqual(top, expected) {
+		t.Errorf("ZRevRange failed: members=%v, err=%v", top, err)
+	}
+	expected = []ZMember{{"carol", 15}, {"bob", 20}, {"alice", 22.5}}
+	if all, err := client.ZRange(ctx, "board", 0, -1); err != nil || !reflect.DeepEqual(all, expected) {
+		t.Errorf("ZRange failed: members=%v, err=%v", all, err)
+	}
+	expected = []ZMember{{"bob", 20}, {"alice", 22.5}}
+	if members, err := client.ZRangeByScore(ctx, "board", 16, math.Inf(1), 0, 0); err != nil || !reflect.DeepEqual(members, expected) {
+		t.Errorf("ZRangeByScore failed: members=%v, err=%v", members, err)
+	}
+	if members, err := client.ZRangeByScore(ctx, "board", math.Inf(-1), math.Inf(1), 1, 1); err != nil || !reflect.DeepEqual(members, []ZMember{{"bob", 20}}) {
+		t.Errorf("ZRangeByScore with a limit failed: members=%v, err=%v", members, err)
+	}
+
+	if rank, err := client.ZRank(ctx, "board", "bob"); err != nil || rank != 1 {
+		t.Errorf("ZRank failed: rank=%d, err=%v", rank, err)
+	}
+	if removed, err := client.ZRem(ctx, "board", "bob", "dave"); err != nil || removed != 1 {
+		t.Errorf("ZRem failed: removed=%d, err=%v", removed, err)
+	}
+	if _, err := client.ZRank(ctx, "board", "bob"); !errors.Is(err, errorutil.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	client.SAdd(ctx, "tags", "go")
+	if _, err := client.ZAdd(ctx, "tags", ZMember{"go", 1}); !errors.Is(err, errorutil.ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+	if _, err := client.ZRange(ctx, "tags", 0, -1); !errors.Is(err, errorutil.ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+}
@@ -5,12 +5,18 @@ type Configuration struct {
 	Common       Common         `json:"common"`
 	Servers      []ServerConfig `json:"servers"`
 	Logging      LoggingConfig  `json:"logging"`
+	// links to other clusters that receive the writes of this cluster
+	CrossCluster []CrossClusterConfig `json:"crossCluster,omitempty"`
 }
 
 type Common struct {
 	Production     bool   `json:"production"`
 	MaxSize        int    `json:"max_size"`
 	EvictionPolicy string `json:"eviction_policy"`
+	// identifies the cluster in the cross cluster replication, it must be unique among the linked clusters
+	ClusterId string `json:"cluster_id,omitempty"`
+	// the classes of the keyspace notifications that are published, set, del, evicted, expired, flush or all
+	KeyspaceEvents []string `json:"keyspace_events,omitempty"`
 }
 
 type ServerConfig struct {
@@ -31,4 +37,23 @@ type ClientConfig struct {
 	ConnectionTimeout int `json:"connectionTimeout"`
 	KeepAliveInterval int `json:"keepAliveInterval"`
 	UnHealthyInterval int `json:"unHealthyInterval"`
+	// how often every node is PINGed, zero disables the health checks
+	HealthCheckInterval int `json:"healthCheckInterval,omitempty"`
+	// the breaker of a node opens when BreakerFailureRate of the last BreakerWindow requests failed,
+	// but not before BreakerMinRequests requests are counted
+	BreakerWindow      int     `json:"breakerWindow,omitempty"`
+	BreakerMinRequests int     `json:"breakerMinRequests,omitempty"`
+	BreakerFailureRate float64 `json:"breakerFailureRate,omitempty"`
+	// round-robin (default), least-outstanding, ewma, primary-preferred or hedged
+	ReadStrategy string `json:"readStrategy,omitempty"`
+	// the percentile of the recent latencies that a hedged read waits before it asks a second node, default 95
+	HedgePercentile float64 `json:"hedgePercentile,omitempty"`
+	// eventual (default), primary or session, the default consistency of the reads
+	Consistency string `json:"consistency,omitempty"`
+}
+
+type CrossClusterConfig struct {
+	Name string `json:"name"`
+	// the configuration file with the topology of the remote cluster
+	Config string `json:"config"`
 }
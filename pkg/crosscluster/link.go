@@ -0,0 +1,235 @@
+package crosscluster
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/replication"
+)
+
+// A cross cluster link tails the write stream of a primary and forwards the writes that originated in the local cluster
+// to a remote cluster. The remote primary keeps a write only if its timestamp is newer than the value it already has
+// (last-writer-wins on hybrid logical clock timestamps), so the order of arrival doesn't matter and a resend is harmless.
+//
+// Loop prevention: a forwarded write keeps its origin on the remote cluster, and a link only forwards the writes whose
+// origin is its own cluster, so a write never travels back.
+//
+// A key keeps its expiration, the absolute time is forwarded so it expires at the same moment in both clusters.
+//
+// Limitations: a deleted key leaves no tombstone, so a delete that races with an older write of the other cluster may be
+// undone. Only the strings are forwarded, a server with cross cluster links rejects the writes of collections and FLUSH
+
+// Forwarder applies writes on the remote cluster, it is implemented by client.Client
+type Forwarder interface {
+	SetIfNewer(key, value string, expiresAt time.Time, timestamp uint64, origin string) (string, error)
+	DeleteIfNewer(key string, timestamp uint64, origin string) (string, error)
+}
+
+// Stats are the lag metrics of a link
+type Stats struct {
+	Name string
+	// writes applied (or rejected as stale) by the remote cluster
+	Forwarded uint64
+	// writes that originated from another cluster and were not sent back
+	Skipped uint64
+	// failed attempts, the write is retried until it succeeds
+	Failed uint64
+	// full state transfers, one on start and one every time the link fell behind the write stream
+	Resyncs uint64
+	// writes waiting to be forwarded
+	Pending int
+	// time between the last forwarded write and the moment it reached the remote cluster
+	Lag time.Duration
+	// time since the last forwarded write
+	SinceLastForward time.Duration
+	LastError        string
+}
+
+const (
+	linkBufferSize = 10000
+
+	retryBaseBackoff = 100 * time.Millisecond
+	retryMaxBackoff  = 5 * time.Second
+
+	// how often the stats of a link are written in the log
+	statsInterval = time.Minute
+)
+
+type Link struct {
+	name      string
+	clusterId string
+	remote    Forwarder
+	logger    logger.Logger
+	// returns the local writes of the current state, used to catch up
+	state    func() []replication.WriteEvent
+	events   <-chan replication.WriteEvent
+	resyncCh chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	statsLock     sync.Mutex
+	stats         Stats
+	lastForwardAt time.Time
+}
+
+func NewLink(name string, clusterId string, remote Forwarder, state func() []replication.WriteEvent, logger logger.Logger) *Link {
+	return &Link{
+		name:      name,
+		clusterId: clusterId,
+		remote:    remote,
+		logger:    logger,
+		state:     state,
+		resyncCh:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stats:     Stats{Name: name},
+	}
+}
+
+// Start subscribes the link to the write stream of the replicator and starts forwarding
+func (l *Link) Start(replicator *replication.Replicator) {
+	l.events = replicator.Tail(linkBufferSize, l.requestResync)
+	l.requestResync()
+
+	go l.run()
+}
+
+func (l *Link) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+// requestResync is called by the replicator when the write stream had to drop events for this link
+func (l *Link) requestResync() {
+	select {
+	case l.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Link) run() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.logger.Info("Cross cluster link stats: " + l.Stats().String())
+		case <-l.resyncCh:
+			l.resync()
+		case we := <-l.events:
+			l.forward(we)
+		}
+	}
+}
+
+func (l *Link) resync() {
+	l.logger.Info("Cross cluster link " + l.name + ": sending the local state")
+
+	l.statsLock.Lock()
+	l.stats.Resyncs++
+	l.statsLock.Unlock()
+
+	for _, we := range l.state() {
+		if !l.forward(we) {
+			return
+		}
+	}
+}
+
+// forward retries until the write reaches the remote cluster, it returns false only if the link was stopped
+func (l *Link) forward(we replication.WriteEvent) bool {
+	// the remote cluster applies the writes of a transaction one by one, last-writer-wins decides per key
+	if we.Cmd == "MULTI" {
+		for _, write := range we.Batch {
+			if !l.forward(write) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if we.Origin != l.clusterId {
+		l.statsLock.Lock()
+		l.stats.Skipped++
+		l.statsLock.Unlock()
+		return true
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := l.send(we)
+		if err == nil {
+			l.statsLock.Lock()
+			l.stats.Forwarded++
+			l.lastForwardAt = time.Now()
+			l.stats.Lag = time.Since(replication.PhysicalTime(we.Timestamp))
+			l.statsLock.Unlock()
+			return true
+		}
+
+		l.logger.Error(errorutil.Wrap(err, "cross cluster link "+l.name+" failed to forward "+we.Key).Error())
+		l.statsLock.Lock()
+		l.stats.Failed++
+		l.stats.LastError = err.Error()
+		l.statsLock.Unlock()
+
+		select {
+		case <-l.done:
+			return false
+		case <-time.After(retryBackoff(attempt)):
+		}
+	}
+}
+
+func (l *Link) send(we replication.WriteEvent) error {
+	var err error
+
+	switch we.Cmd {
+	case "SET":
+		_, err = l.remote.SetIfNewer(we.Key, we.Value, we.ExpiresAt, we.Timestamp, we.Origin)
+	case "DELETE":
+		_, err = l.remote.DeleteIfNewer(we.Key, we.Timestamp, we.Origin)
+	default:
+		// there is nothing else in the stream, a server with cross cluster links rejects the writes of collections
+		// and FLUSH (Server.EnableCrossCluster)
+		return nil
+	}
+
+	return err
+}
+
+func retryBackoff(attempt int) time.Duration {
+	if attempt > 6 {
+		attempt = 6
+	}
+	delay := time.Duration(1<<attempt) * retryBaseBackoff
+	if delay > retryMaxBackoff {
+		delay = retryMaxBackoff
+	}
+
+	return delay
+}
+
+// Stats returns a copy of the lag metrics of the link
+func (l *Link) Stats() Stats {
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+
+	stats := l.stats
+	stats.Pending = len(l.events)
+	if !l.lastForwardAt.IsZero() {
+		stats.SinceLastForward = time.Since(l.lastForwardAt)
+	}
+
+	return stats
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("name=%s,forwarded=%d,skipped=%d,failed=%d,resyncs=%d,pending=%d,lag_ms=%d,since_last_forward_ms=%d,last_error=%s",
+		s.Name, s.Forwarded, s.Skipped, s.Failed, s.Resyncs, s.Pending, s.Lag.Milliseconds(), s.SinceLastForward.Milliseconds(), s.LastError)
+}
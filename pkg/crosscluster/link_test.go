@@ -0,0 +1,115 @@
+package crosscluster
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/replication"
+)
+
+type mockForwarder struct {
+	lock     sync.Mutex
+	sets     map[string]string
+	expires  map[string]time.Time
+	deletes  []string
+	failures int
+}
+
+func (m *mockForwarder) SetIfNewer(key, value string, expiresAt time.Time, timestamp uint64, origin string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.failures > 0 {
+		m.failures--
+		return "", fmt.Errorf("remote cluster is down")
+	}
+	m.sets[key] = value
+	m.expires[key] = expiresAt
+	return "OK", nil
+}
+
+func (m *mockForwarder) DeleteIfNewer(key string, timestamp uint64, origin string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deletes = append(m.deletes, key)
+	return "OK", nil
+}
+
+func (m *mockForwarder) get(key string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	v, ok := m.sets[key]
+	return v, ok
+}
+
+func (m *mockForwarder) expiresAt(key string) time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.expires[key]
+}
+
+func newTestReplicator(t *testing.T) *replication.Replicator {
+	cfg := &config.Configuration{Servers: []config.ServerConfig{{ID: "primary", Address: "localhost:0", Role: "PRIMARY"}}}
+	replicator, err := replication.NewReplicator("primary", cfg, logger.SetupDebugLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replicator
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestLinkForwardsOnlyLocalWrites(t *testing.T) {
+	replicator := newTestReplicator(t)
+	defer replicator.Stop()
+	remote := &mockForwarder{sets: map[string]string{}, expires: map[string]time.Time{}, failures: 2}
+	clock := replication.NewHLC()
+
+	state := func() []replication.WriteEvent {
+		return []replication.WriteEvent{{Cmd: "SET", Key: "existing", Value: "value", Timestamp: clock.Now(), Origin: "eu"}}
+	}
+
+	link := NewLink("us", "eu", remote, state, logger.SetupDebugLogger())
+	link.Start(replicator)
+	defer link.Stop()
+
+	replicator.AddWriteEvent(replication.WriteEvent{Cmd: "SET", Key: "local", Value: "value", Timestamp: clock.Now(), Origin: "eu"})
+	replicator.AddWriteEvent(replication.WriteEvent{Cmd: "SET", Key: "remote", Value: "value", Timestamp: clock.Now(), Origin: "us"})
+	replicator.AddWriteEvent(replication.WriteEvent{Cmd: "DELETE", Key: "local", Timestamp: clock.Now(), Origin: "eu"})
+	expiresAt := time.UnixMilli(time.Now().Add(time.Minute).UnixMilli())
+	replicator.AddWriteEvent(replication.WriteEvent{Cmd: "SET", Key: "ttl", Value: "value", ExpiresAt: expiresAt, Timestamp: clock.Now(), Origin: "eu"})
+
+	if !waitFor(func() bool { return link.Stats().Forwarded == 4 }) {
+		t.Fatalf("Expected 4 forwarded writes, got %+v", link.Stats())
+	}
+
+	if _, ok := remote.get("existing"); !ok {
+		t.Error("Expected the initial state to be forwarded")
+	}
+	if _, ok := remote.get("remote"); ok {
+		t.Error("A write of the remote cluster must not be sent back")
+	}
+	if !remote.expiresAt("ttl").Equal(expiresAt) || !remote.expiresAt("existing").IsZero() {
+		t.Errorf("Expected the expiration to be forwarded, got %v", remote.expiresAt("ttl"))
+	}
+
+	stats := link.Stats()
+	if stats.Skipped != 1 || stats.Failed != 2 || stats.Resyncs != 1 || stats.LastError == "" {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
@@ -59,3 +59,16 @@ func (e *KeyNotFoundError) Is(target error) bool {
 	_, ok := target.(*KeyNotFoundError)
 	return ok
 }
+
+type WrongTypeError struct{}
+
+var ErrWrongType = &WrongTypeError{}
+
+func (e *WrongTypeError) Error() string {
+	return "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"
+}
+
+func (e *WrongTypeError) Is(target error) bool {
+	_, ok := target.(*WrongTypeError)
+	return ok
+}
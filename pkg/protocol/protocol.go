@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The framing of the lines of the protocol, the commands, the replies and the replication stream alike. A line is sent
+// as it is with a newline at the end, unless it would not come out the same: a line that contains a newline or a
+// carriage return, starts with $ or starts or ends with a space is sent as a bulk line, a $<n> header line followed by
+// the n bytes of the line and a newline. So a value can hold any byte, e.g.
+//
+//	$11
+//	SET key a
+//	b
+//
+// sets the value of key to a, a newline and b. The readers split the input with ScanLines or a Scanner, a line and
+// its header count against the size limit of the reader together.
+
+// Format returns the line as it is sent, with the header of a bulk line and the newline at the end
+func Format(line string) string {
+	if !isBulk(line) {
+		return line + "\n"
+	}
+
+	return "$" + strconv.Itoa(len(line)) + "\n" + line + "\n"
+}
+
+// WriteLine sends a line
+func WriteLine(w io.Writer, line string) error {
+	_, err := io.WriteString(w, Format(line))
+	return err
+}
+
+// isBulk reports if the line would change on the way as a plain line
+func isBulk(line string) bool {
+	return strings.ContainsAny(line, "\r\n") || strings.HasPrefix(line, "$") || strings.TrimSpace(line) != line
+}
+
+// ScanLines is a bufio.SplitFunc that returns the lines without their framing. A line that starts with $ but is not a
+// valid header is a plain line, so a person can still type anything
+func ScanLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, _, err := scanLine(data, atEOF)
+	return advance, token, err
+}
+
+func scanLine(data []byte, atEOF bool) (int, []byte, bool, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 || len(data) < 2 || data[0] != '$' {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		return advance, token, false, err
+	}
+
+	size, err := strconv.Atoi(string(bytes.TrimSuffix(data[1:end], []byte("\r"))))
+	if err != nil || size < 0 {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		return advance, token, false, err
+	}
+
+	// the line and its newline follow the header
+	start := end + 1
+	if len(data) < start+size+1 {
+		if atEOF {
+			return 0, nil, false, io.ErrUnexpectedEOF
+		}
+		return 0, nil, false, nil
+	}
+
+	return start + size + 1, data[start : start+size], true, nil
+}
+
+// Scanner reads the lines of a connection and tells which ones were bulk lines
+type Scanner struct {
+	*bufio.Scanner
+	bulk bool
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	s := &Scanner{Scanner: bufio.NewScanner(r)}
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, bulk, err := scanLine(data, atEOF)
+		if token != nil {
+			s.bulk = bulk
+		}
+		return advance, token, err
+	})
+
+	return s
+}
+
+// Bulk reports if the last line was a bulk line, it is meant to be used exactly as it is
+func (s *Scanner) Bulk() bool {
+	return s.bulk
+}
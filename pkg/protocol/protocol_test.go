@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"SET key value", "SET key value\n"},
+		{"", "\n"},
+		{"SET key a\nb", "$11\nSET key a\nb\n"},
+		{"SET key value\r", "$14\nSET key value\r\n"},
+		{"$5", "$2\n$5\n"},
+		{"SET key value ", "$14\nSET key value \n"},
+		{" GET key", "$8\n GET key\n"},
+	}
+
+	for _, tt := range tests {
+		if formatted := Format(tt.line); formatted != tt.expected {
+			t.Errorf("Format(%q): expected %q, got %q", tt.line, tt.expected, formatted)
+		}
+	}
+}
+
+func TestScanner(t *testing.T) {
+	lines := []string{"SET key value", "SET key a\nb", "$5", "GET key", "", "value\r\n\x00\xff ", "*2"}
+
+	var input strings.Builder
+	for _, line := range lines {
+		WriteLine(&input, line)
+	}
+	// a person that types a $ line
+	input.WriteString("$abc\r\nPING\n")
+
+	scanner := NewScanner(strings.NewReader(input.String()))
+	expected := append(lines, "$abc", "PING")
+	bulk := []bool{false, true, true, false, false, true, false, false, false}
+	for i, line := range expected {
+		if !scanner.Scan() {
+			t.Fatalf("expected the line %q, got %v", line, scanner.Err())
+		}
+		if scanner.Text() != line || scanner.Bulk() != bulk[i] {
+			t.Errorf("expected %q with bulk=%t, got %q with bulk=%t", line, bulk[i], scanner.Text(), scanner.Bulk())
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected line %q", scanner.Text())
+	}
+}
+
+func TestScanLinesWaitsForTheWholeLine(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("$11\nSET key"))
+		writer.Write([]byte(" a\nb"))
+		writer.Write([]byte("\n"))
+		writer.Close()
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(ScanLines)
+	if !scanner.Scan() || scanner.Text() != "SET key a\nb" {
+		t.Errorf("expected the bulk line, got %q, %v", scanner.Text(), scanner.Err())
+	}
+
+	// a connection that closes in the middle of a bulk line
+	scanner = bufio.NewScanner(strings.NewReader("$11\nSET key"))
+	scanner.Split(ScanLines)
+	if scanner.Scan() || !errors.Is(scanner.Err(), io.ErrUnexpectedEOF) {
+		t.Errorf("expected an unexpected EOF, got %q, %v", scanner.Text(), scanner.Err())
+	}
+}
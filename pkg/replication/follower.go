@@ -0,0 +1,246 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/errorutil"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+// followerStatus is the state of the link of a secondary to its primary
+type followerStatus struct {
+	lock sync.Mutex
+	// connecting, syncing or connected
+	state string
+	// the replication id of the primary that the offset belongs to, empty until the first full state is received
+	replId      string
+	offset      uint64
+	lastContact time.Time
+	attempts    int
+	lastError   string
+}
+
+func (fs *followerStatus) setState(state string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.state = state
+	fs.lastContact = time.Now()
+	// the state is replaced, the offset of the old one says nothing about it
+	if state == "syncing" {
+		fs.replId = ""
+	}
+}
+
+// synced is called when the full state of the primary with the replication id was received
+func (fs *followerStatus) synced(replId string, offset uint64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.state = "connected"
+	fs.replId = replId
+	fs.offset = offset
+	fs.lastContact = time.Now()
+}
+
+func (fs *followerStatus) contact(offset uint64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.offset = offset
+	fs.lastContact = time.Now()
+}
+
+func (fs *followerStatus) failed(err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.state = "connecting"
+	fs.lastError = err.Error()
+}
+
+// StartFollower connects a secondary to its primary and keeps the connection alive, the start order of the servers doesn't matter
+func (r *Replicator) StartFollower(applier Applier) {
+	if r.isPrimary {
+		return
+	}
+
+	go r.follow(applier)
+}
+
+func (r *Replicator) follow(applier Applier) {
+	attempt := 0
+
+	for {
+		r.follower.lock.Lock()
+		r.follower.attempts++
+		r.follower.state = "connecting"
+		r.follower.lock.Unlock()
+
+		synced, err := r.syncWithPrimary(applier)
+		if err != nil {
+			r.follower.failed(err)
+			r.logger.Error(errorutil.Wrap(err, "replication link to primary "+r.primaryAddress+" failed").Error())
+		}
+
+		if synced {
+			attempt = 0
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-time.After(followerBackoff(attempt)):
+		}
+
+		attempt++
+	}
+}
+
+func followerBackoff(attempt int) time.Duration {
+	if attempt > 6 {
+		attempt = 6
+	}
+	jitter := time.Duration(rand.Int63n(100)) * time.Millisecond
+	delay := time.Duration(1<<attempt)*followerBaseBackoff + jitter
+
+	if delay > followerMaxBackoff {
+		delay = followerMaxBackoff
+	}
+
+	return delay
+}
+
+// syncWithPrimary runs one REPLCONF/SYNC session, it returns true if the full state was received
+func (r *Replicator) syncWithPrimary(applier Applier) (bool, error) {
+	replConn, err := establishConnection(r.primaryAddress)
+	if err != nil {
+		return false, err
+	}
+	defer replConn.Conn.Close()
+
+	// close the connection on Stop so the blocking read returns
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-r.done:
+			replConn.Conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	if _, err := fmt.Fprintf(replConn.Conn, "REPLCONF %s\n", r.serverId); err != nil {
+		return false, err
+	}
+	if err := replConn.checkConnResp(); err != nil {
+		return false, err
+	}
+
+	if _, err := fmt.Fprintf(replConn.Conn, "SYNC\n"); err != nil {
+		return false, err
+	}
+
+	// the primary replies with its replication id and the offset that the state corresponds to
+	if !replConn.Scanner.Scan() {
+		return false, fmt.Errorf("no response to SYNC")
+	}
+	header := strings.Split(replConn.Scanner.Text(), " ")
+	if len(header) != 3 || header[0] != "FULLSYNC" {
+		return false, fmt.Errorf("unexpected response to SYNC: %s", replConn.Scanner.Text())
+	}
+	replId := header[1]
+	offset, err := strconv.ParseUint(header[2], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid offset in FULLSYNC: %s", header[2])
+	}
+
+	r.follower.setState("syncing")
+	r.logger.Info("Connected to primary " + r.primaryAddress + ", receiving full state")
+
+	keys := make(map[string]struct{})
+	synced := false
+
+	for replConn.Scanner.Scan() {
+		line := replConn.Scanner.Text()
+
+		if !synced {
+			if line == "SYNCEND" {
+				applier.KeepOnly(keys)
+				synced = true
+				r.follower.synced(replId, offset)
+				r.logger.Info("Full state received from primary " + r.primaryAddress)
+				continue
+			}
+
+			cmd := strings.SplitN(line, " ", 3)
+			if strings.HasPrefix(line, "ERROR") {
+				return false, fmt.Errorf("%s", line)
+			}
+			if err := applier.ApplyReplicated(cmd); err != nil {
+				return false, err
+			}
+			if len(cmd) > 1 {
+				keys[cmd[1]] = struct{}{}
+			}
+			continue
+		}
+
+		// heartbeat of an idle primary
+		if line == "PING" {
+			r.follower.contact(offset)
+			if _, err := fmt.Fprintf(replConn.Conn, "OK\n"); err != nil {
+				return synced, err
+			}
+			continue
+		}
+
+		if count, isBatch := strings.CutPrefix(line, "MULTI "); isBatch {
+			err = applyBatch(applier, replConn.Scanner, count)
+		} else {
+			err = applier.ApplyReplicated(strings.SplitN(line, " ", 3))
+		}
+		if err != nil {
+			protocol.WriteLine(replConn.Conn, "ERROR: "+err.Error())
+			return synced, err
+		}
+
+		// every event that is streamed after the state has the next offset
+		offset++
+		r.follower.contact(offset)
+
+		if _, err := fmt.Fprintf(replConn.Conn, "OK\n"); err != nil {
+			return synced, err
+		}
+	}
+
+	if err := replConn.Scanner.Err(); err != nil {
+		return synced, err
+	}
+
+	return synced, fmt.Errorf("connection closed by primary")
+}
+
+// applyBatch reads the writes of a transaction that follow MULTI <count> and applies them together
+func applyBatch(applier Applier, scanner *bufio.Scanner, count string) error {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid MULTI count: %s", count)
+	}
+
+	cmds := make([][]string, 0, n)
+	for len(cmds) < n {
+		if !scanner.Scan() {
+			return fmt.Errorf("transaction ended after %d of %d writes", len(cmds), n)
+		}
+		cmds = append(cmds, strings.SplitN(scanner.Text(), " ", 3))
+	}
+
+	return applier.ApplyReplicatedBatch(cmds)
+}
@@ -0,0 +1,67 @@
+package replication
+
+import (
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock. A timestamp keeps the wall clock in milliseconds in the high 48 bits and a logical
+// counter in the low 16 bits, so timestamps are comparable as plain integers and stay close to the physical time
+type HLC struct {
+	last uint64
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+const hlcLogicalBits = 16
+
+func NewHLC() *HLC {
+	return &HLC{now: time.Now}
+}
+
+// Now returns a timestamp that is greater than every timestamp returned or observed before
+func (c *HLC) Now() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.tick()
+}
+
+// Update merges a timestamp received from another cluster so the next local write is ordered after it
+func (c *HLC) Update(remote uint64) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if remote > c.last {
+		c.last = remote
+	}
+
+	return c.tick()
+}
+
+// tick
+// Note: This method does not handle synchronization and expects the caller to manage locking
+func (c *HLC) tick() uint64 {
+	wall := uint64(c.now().UnixMilli()) << hlcLogicalBits
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+
+	return c.last
+}
+
+// PhysicalTime returns the wall clock part of a timestamp
+func PhysicalTime(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> hlcLogicalBits))
+}
+
+// IsNewer is the last-writer-wins rule, the origin breaks the ties so every cluster picks the same winner
+func IsNewer(ts uint64, origin string, currentTs uint64, currentOrigin string) bool {
+	if ts != currentTs {
+		return ts > currentTs
+	}
+
+	return origin > currentOrigin
+}
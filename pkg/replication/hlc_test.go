@@ -0,0 +1,54 @@
+package replication
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLCIsMonotonic(t *testing.T) {
+	wall := time.UnixMilli(1000)
+	clock := &HLC{now: func() time.Time { return wall }}
+
+	first := clock.Now()
+	second := clock.Now()
+	if second <= first {
+		t.Fatalf("Expected %d to be after %d", second, first)
+	}
+
+	// the wall clock goes backwards but the clock must not
+	wall = time.UnixMilli(500)
+	if third := clock.Now(); third <= second {
+		t.Fatalf("Expected %d to be after %d", third, second)
+	}
+
+	if PhysicalTime(first).UnixMilli() != 1000 {
+		t.Errorf("Expected the physical time to be 1000, got %d", PhysicalTime(first).UnixMilli())
+	}
+}
+
+func TestHLCUpdateFromRemote(t *testing.T) {
+	clock := &HLC{now: func() time.Time { return time.UnixMilli(1000) }}
+	remote := uint64(5000) << hlcLogicalBits
+
+	if ts := clock.Update(remote); ts <= remote {
+		t.Fatalf("Expected %d to be after the remote timestamp %d", ts, remote)
+	}
+	if ts := clock.Now(); ts <= remote {
+		t.Fatalf("Expected local writes to be ordered after the remote timestamp, got %d", ts)
+	}
+}
+
+func TestIsNewer(t *testing.T) {
+	if !IsNewer(2, "a", 1, "b") {
+		t.Error("Expected the greater timestamp to win")
+	}
+	if IsNewer(1, "b", 2, "a") {
+		t.Error("Expected the smaller timestamp to lose")
+	}
+	if !IsNewer(1, "b", 1, "a") || IsNewer(1, "a", 1, "b") {
+		t.Error("Expected the origin to break the tie")
+	}
+	if IsNewer(1, "a", 1, "a") {
+		t.Error("Expected the same write not to be newer than itself")
+	}
+}
@@ -0,0 +1,118 @@
+package replication
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Offset returns the replication id and the position in the write stream of the primary, on a secondary it is the
+// last applied one. On a primary it includes the writes that are not dispatched yet, so a client that asks for it
+// after a write gets an offset that covers the write. A secondary that is not in sync returns its own id, no client
+// has an offset of that stream
+func (r *Replicator) Offset() (string, uint64) {
+	if r.isPrimary {
+		return r.replId, r.queued.Load()
+	}
+
+	r.follower.lock.Lock()
+	defer r.follower.lock.Unlock()
+
+	if r.follower.replId == "" {
+		return r.replId, r.follower.offset
+	}
+
+	return r.follower.replId, r.follower.offset
+}
+
+// Info returns the replication health as key:value lines, like the INFO command of redis
+func (r *Replicator) Info() []string {
+	if r.isPrimary {
+		return r.primaryInfo()
+	}
+
+	return r.secondaryInfo()
+}
+
+func (r *Replicator) primaryInfo() []string {
+	offset := r.offset.Load()
+
+	// collect the queue depths first, the links lock is never taken while the status lock is held
+	queues := make(map[string]int)
+	r.linksLock.RLock()
+	for id, link := range r.links {
+		queues[id] = len(link.events)
+	}
+	r.linksLock.RUnlock()
+
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+
+	ids := make([]string, 0, len(r.statuses))
+	connected := 0
+	for id, status := range r.statuses {
+		ids = append(ids, id)
+		if status.state == "online" {
+			connected++
+		}
+	}
+	sort.Strings(ids)
+
+	lines := []string{
+		"role:primary",
+		"replication_id:" + r.replId,
+		fmt.Sprintf("offset:%d", offset),
+		fmt.Sprintf("connected_secondaries:%d", connected),
+	}
+
+	for _, id := range ids {
+		status := r.statuses[id]
+
+		lag := uint64(0)
+		if offset > status.ackedOffset {
+			lag = offset - status.ackedOffset
+		}
+
+		lines = append(lines, fmt.Sprintf("secondary:id=%s,address=%s,state=%s,acked_offset=%d,lag=%d,last_ack_seconds=%d,queue=%d,reconnects=%d,last_error=%s",
+			id, status.address, status.state, status.ackedOffset, lag, secondsSince(status.lastAck), queues[id], status.connects-1, status.lastError))
+	}
+
+	return lines
+}
+
+func (r *Replicator) secondaryInfo() []string {
+	r.follower.lock.Lock()
+	defer r.follower.lock.Unlock()
+
+	linkStatus := "down"
+	if r.follower.state == "connected" {
+		linkStatus = "up"
+	} else if r.follower.state == "syncing" {
+		linkStatus = "sync"
+	}
+
+	reconnects := r.follower.attempts - 1
+	if reconnects < 0 {
+		reconnects = 0
+	}
+
+	return []string{
+		"role:secondary",
+		"primary_address:" + r.primaryAddress,
+		"link_status:" + linkStatus,
+		fmt.Sprintf("last_contact_seconds:%d", secondsSince(r.follower.lastContact)),
+		"replication_id:" + r.follower.replId,
+		fmt.Sprintf("offset:%d", r.follower.offset),
+		fmt.Sprintf("reconnects:%d", reconnects),
+		"last_error:" + r.follower.lastError,
+	}
+}
+
+// secondsSince returns -1 if there was never a contact
+func secondsSince(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+
+	return int64(time.Since(t).Seconds())
+}
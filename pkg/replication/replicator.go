@@ -2,14 +2,21 @@ package replication
 
 import (
 	"bufio"
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/voukatas/CacheGopher/pkg/config"
 	"github.com/voukatas/CacheGopher/pkg/errorutil"
 	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 )
 
 // only for testing
@@ -26,12 +33,39 @@ func (mr *MockReplicator) GetSecondaryConn(id string) (*ReplConn, error) {
 }
 func (mr *MockReplicator) RemoveConn(id string) {
 }
+func (mr *MockReplicator) ServeSecondary(id string, replConn *ReplConn, sendState func(io.Writer) error) error {
+	return nil
+}
+func (mr *MockReplicator) StartFollower(applier Applier) {
+}
+func (mr *MockReplicator) Stop() {
+}
+func (mr *MockReplicator) Info() []string {
+	return []string{"role:primary"}
+}
+func (mr *MockReplicator) Offset() (string, uint64) {
+	return "mock", 0
+}
 
 type ReplicationService interface {
 	AddWriteEvent(WriteEvent)
 	IsPrimary() bool
 	GetSecondaryConn(string) (*ReplConn, error)
 	RemoveConn(string)
+	ServeSecondary(string, *ReplConn, func(io.Writer) error) error
+	StartFollower(Applier)
+	Stop()
+	Info() []string
+	Offset() (string, uint64)
+}
+
+// Applier is implemented by the server of a secondary node, it receives the commands that the primary streams
+type Applier interface {
+	ApplyReplicated(cmd []string) error
+	// ApplyReplicatedBatch applies the writes of a transaction of the primary at once
+	ApplyReplicatedBatch(cmds [][]string) error
+	// KeepOnly removes every key that was not part of the full state sent by the primary
+	KeepOnly(keys map[string]struct{})
 }
 
 type ReplConn struct {
@@ -43,84 +77,380 @@ type WriteEvent struct {
 	Cmd   string
 	Key   string
 	Value string
+	// hybrid logical clock timestamp and origin cluster of the write, they are used by the cross cluster links
+	Timestamp uint64
+	Origin    string
+	// position of the event in the write stream of the primary, set when the event is dispatched
+	Offset uint64
+	// the moment a SET expires, zero means never. The cross cluster links ignore it
+	ExpiresAt time.Time
+	// the version of the value of a SET on the primary, the secondaries store the same one. The cross cluster links ignore it
+	Version uint64
+	// the writes of a transaction, the Cmd is MULTI. The secondaries apply them at once
+	Batch []WriteEvent
+}
+
+const (
+	// number of write events a secondary can fall behind before the primary drops its link and forces a full resync
+	linkBufferSize = 1000
+
+	followerBaseBackoff = 100 * time.Millisecond
+	followerMaxBackoff  = 5 * time.Second
+
+	// an idle primary pings its secondaries so both sides know that the link is alive
+	heartbeatInterval = 5 * time.Second
+)
+
+// secondaryLink is the primary side of the connection that a secondary opened with REPLCONF/SYNC
+type secondaryLink struct {
+	id        string
+	replConn  *ReplConn
+	events    chan WriteEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+	status    *secondaryStatus
+}
+
+// secondaryStatus is kept by the primary for every secondary that ever connected, it survives the reconnections
+type secondaryStatus struct {
+	address string
+	// sync, online or offline
+	state       string
+	ackedOffset uint64
+	lastAck     time.Time
+	connects    int
+	lastError   string
+}
+
+// tail is a local subscriber of the write stream, like a cross cluster link
+type tail struct {
+	events   chan WriteEvent
+	overflow func()
+}
+
+func newSecondaryLink(id string, replConn *ReplConn) *secondaryLink {
+	return &secondaryLink{
+		id:       id,
+		replConn: replConn,
+		events:   make(chan WriteEvent, linkBufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *secondaryLink) close(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+		l.replConn.Conn.Close()
+	})
 }
 
 type Replicator struct {
-	connMap     map[string]*ReplConn
-	connMapLock sync.RWMutex
+	serverId string
+	// a random id of the write stream of this run of the server, its offsets start from zero on every start. A
+	// secondary reports the id of its primary once it is in sync
+	replId         string
+	isPrimary      bool
+	primaryAddress string
+	// the secondaries known from the configuration, they are only used when a primary recovers its state
 	secondaries []config.ServerConfig
+	links       map[string]*secondaryLink
+	tails       []*tail
+	linksLock   sync.RWMutex
+	// the offset of the last dispatched write event
+	offset atomic.Uint64
+	// the offset of the last queued write event, the dispatcher assigns the offsets in the same order
+	queued      atomic.Uint64
+	enqueueLock sync.Mutex
+	statuses    map[string]*secondaryStatus
+	statusLock  sync.Mutex
+	follower    *followerStatus
 	writeCh     chan WriteEvent
 	logger      logger.Logger
-	isPrimary   bool
+	done        chan struct{}
+	stopOnce    sync.Once
 }
 
 func NewReplicator(currentServerId string, cfg *config.Configuration, logger logger.Logger) (*Replicator, error) {
 
-	connMap := make(map[string]*ReplConn)
+	var myConfig *config.ServerConfig
 	secondariesConfig := make([]config.ServerConfig, 0)
-	writeCh := make(chan WriteEvent, 100)
-	isPrimary := false
 
-	for _, server := range cfg.Servers {
-		// open connections to all the secondary servers
+	for i, server := range cfg.Servers {
+		if server.ID == currentServerId {
+			myConfig = &cfg.Servers[i]
+		}
 		if currentServerId == server.Primary {
-			isPrimary = true
-
 			secondariesConfig = append(secondariesConfig, server)
-
-			conn, err := establishConnection(server.Address)
-			if err != nil {
-				logger.Error(errorutil.Wrap(err, "failed to establish connection").Error())
-				continue
-			}
-			connMap[server.ID] = conn
 		}
 	}
 
-	// i should refactor this for the case that is not primary, no need to keep the references and waste resources
+	if myConfig == nil {
+		return nil, fmt.Errorf("no configuration found for server %s", currentServerId)
+	}
+
+	replId, err := newReplicationId()
+	if err != nil {
+		return nil, err
+	}
 
 	rep := &Replicator{
-		connMap:     connMap,
+		serverId:    currentServerId,
+		replId:      replId,
+		isPrimary:   strings.ToUpper(myConfig.Role) == "PRIMARY",
 		secondaries: secondariesConfig,
-		writeCh:     writeCh,
+		links:       make(map[string]*secondaryLink),
+		statuses:    make(map[string]*secondaryStatus),
+		follower:    &followerStatus{state: "connecting"},
+		writeCh:     make(chan WriteEvent, 100),
 		logger:      logger,
-		isPrimary:   isPrimary,
+		done:        make(chan struct{}),
 	}
 
-	// Single goroutine to keep the order as much as possible
-	// Might be performance bottleneck though....
-	// In case this is replaced from multiple goroutines then I need to lock the connMap
-	go func() {
-		for we := range writeCh {
+	if !rep.isPrimary {
+		primaryAddress, err := config.GetPrimaryServerAddress(cfg, myConfig.Primary)
+		if err != nil {
+			return nil, err
+		}
+		rep.primaryAddress = primaryAddress
+	}
 
-			rep.replicateTask(we)
+	// Single goroutine to keep the order of the events, every link has its own buffer so a slow secondary doesn't block the rest
+	go func() {
+		for we := range rep.writeCh {
+			rep.dispatch(we)
 		}
 	}()
 
 	return rep, nil
 }
 
+func (rp *Replicator) IsPrimary() bool {
+	return rp.isPrimary
+}
+
+// RemoveConn drops the link of a secondary, the secondary will reconnect and resync on its own
 func (rp *Replicator) RemoveConn(serverId string) {
-	rp.connMapLock.Lock()
-	defer rp.connMapLock.Unlock()
+	rp.linksLock.Lock()
+	defer rp.linksLock.Unlock()
 	rp.logger.Debug("inside RemoveConn")
 
-	delete(rp.connMap, serverId)
+	if link, exists := rp.links[serverId]; exists {
+		link.close(fmt.Errorf("link removed"))
+		delete(rp.links, serverId)
+	}
 }
 
+// GetSecondaryConn opens a new connection to a secondary that is known from the configuration, the caller owns the connection
 func (rp *Replicator) GetSecondaryConn(id string) (*ReplConn, error) {
-	rp.connMapLock.RLock()
-	defer rp.connMapLock.RUnlock()
+	for _, server := range rp.secondaries {
+		if server.ID == id {
+			return establishConnection(server.Address)
+		}
+	}
+
+	return nil, fmt.Errorf("secondary server %s not found", id)
+}
+
+func (r *Replicator) AddWriteEvent(we WriteEvent) {
+	r.enqueueLock.Lock()
+	defer r.enqueueLock.Unlock()
+
+	r.queued.Add(1)
+	r.writeCh <- we
+}
+
+func (r *Replicator) dispatch(we WriteEvent) {
+	r.linksLock.RLock()
+	defer r.linksLock.RUnlock()
+
+	// the offset moves while the read lock is held, so a new link sees either the event or the new offset
+	we.Offset = r.offset.Add(1)
+
+	for _, link := range r.links {
+		select {
+		case link.events <- we:
+		default:
+			// the secondary can't keep up, drop it and let it resync from scratch
+			r.logger.Error("replication buffer is full for " + link.id + ", dropping the link")
+			link.close(fmt.Errorf("replication buffer is full"))
+		}
+	}
 
-	replConn, exists := rp.connMap[id]
+	for _, t := range r.tails {
+		select {
+		case t.events <- we:
+		default:
+			t.overflow()
+		}
+	}
+}
+
+// Tail returns a channel that receives every write event of this server. The replication never blocks on a tail,
+// if the channel is full the event is dropped and overflow is called so the subscriber can catch up in another way
+func (r *Replicator) Tail(size int, overflow func()) <-chan WriteEvent {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	t := &tail{events: make(chan WriteEvent, size), overflow: overflow}
+	r.tails = append(r.tails, t)
+
+	return t.events
+}
+
+// addLink registers the link and returns the offset after which the link receives every event
+func (r *Replicator) addLink(link *secondaryLink) uint64 {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	if old, exists := r.links[link.id]; exists {
+		old.close(fmt.Errorf("replaced by a new link"))
+	}
+	r.links[link.id] = link
+
+	return r.offset.Load()
+}
+
+func (r *Replicator) getStatus(id string) *secondaryStatus {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+
+	status, exists := r.statuses[id]
 	if !exists {
-		return nil, fmt.Errorf("connection to server not found")
+		status = &secondaryStatus{}
+		r.statuses[id] = status
 	}
-	return replConn, nil
+
+	return status
 }
 
-func (rp *Replicator) IsPrimary() bool {
-	return rp.isPrimary
+func (r *Replicator) updateStatus(status *secondaryStatus, update func(status *secondaryStatus)) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+
+	update(status)
+}
+
+func (r *Replicator) removeLink(link *secondaryLink) {
+	r.linksLock.Lock()
+	defer r.linksLock.Unlock()
+
+	if current, exists := r.links[link.id]; exists && current == link {
+		delete(r.links, link.id)
+	}
+}
+
+// ServeSecondary is called by the primary when a secondary sends SYNC. The link is registered before the state is taken
+// so every write that is not part of the state is buffered and streamed right after it. An event that is both in the
+// state and in the buffer arrives twice, the secondary applies a write of a collection once since it carries the version
+// of the entry, the other writes are absolute values (SET and DELETE) so applying them again is harmless.
+// It blocks until the link breaks.
+func (r *Replicator) ServeSecondary(id string, replConn *ReplConn, sendState func(io.Writer) error) (err error) {
+	if !r.isPrimary {
+		return fmt.Errorf("only a primary can serve secondaries")
+	}
+
+	link := newSecondaryLink(id, replConn)
+	link.status = r.getStatus(id)
+	offset := r.addLink(link)
+	defer r.removeLink(link)
+	defer link.close(nil)
+
+	r.updateStatus(link.status, func(status *secondaryStatus) {
+		status.address = replConn.Conn.RemoteAddr().String()
+		status.state = "sync"
+		status.connects++
+	})
+	defer func() {
+		r.updateStatus(link.status, func(status *secondaryStatus) {
+			status.state = "offline"
+			if err != nil {
+				status.lastError = err.Error()
+			}
+		})
+	}()
+
+	r.logger.Info("Secondary " + id + " connected, sending full state")
+
+	if _, err := fmt.Fprintf(replConn.Conn, "FULLSYNC %s %d\n", r.replId, offset); err != nil {
+		return errorutil.Wrap(err, "failed to send state to "+id)
+	}
+
+	if err := sendState(replConn.Conn); err != nil {
+		return errorutil.Wrap(err, "failed to send state to "+id)
+	}
+
+	if _, err := fmt.Fprintf(replConn.Conn, "SYNCEND\n"); err != nil {
+		return errorutil.Wrap(err, "failed to send state to "+id)
+	}
+
+	r.updateStatus(link.status, func(status *secondaryStatus) {
+		status.state = "online"
+		status.ackedOffset = offset
+		status.lastAck = time.Now()
+	})
+
+	r.logger.Info("Secondary " + id + " is in sync, streaming writes")
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-link.done:
+			return link.err
+		case <-r.done:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(replConn.Conn, "PING\n"); err != nil {
+				return errorutil.Wrap(err, "failed to ping "+id)
+			}
+			if err := r.checkResponse(replConn); err != nil {
+				return errorutil.Wrap(err, "failed to ping "+id)
+			}
+			r.updateStatus(link.status, func(status *secondaryStatus) {
+				status.lastAck = time.Now()
+			})
+		case we := <-link.events:
+			if err := sendCommand(replConn, we); err != nil {
+				return errorutil.Wrap(err, "failed to replicate to "+id)
+			}
+			if err := r.checkResponse(replConn); err != nil {
+				return errorutil.Wrap(err, "failed to replicate to "+id)
+			}
+			r.updateStatus(link.status, func(status *secondaryStatus) {
+				status.ackedOffset = we.Offset
+				status.lastAck = time.Now()
+			})
+			// the heartbeat is needed only when there are no writes
+			heartbeat.Reset(heartbeatInterval)
+		}
+	}
+}
+
+// Stop terminates the link to the primary and the links of the secondaries
+func (r *Replicator) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+
+		r.linksLock.Lock()
+		defer r.linksLock.Unlock()
+		for id, link := range r.links {
+			link.close(fmt.Errorf("replicator stopped"))
+			delete(r.links, id)
+		}
+	})
+}
+
+// newReplicationId returns a random hex string, the offsets of two streams with different ids can't be compared
+func newReplicationId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := crand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
 }
 
 func establishConnection(address string) (*ReplConn, error) {
@@ -130,6 +460,7 @@ func establishConnection(address string) (*ReplConn, error) {
 	}
 
 	scanner := bufio.NewScanner(conn)
+	scanner.Split(protocol.ScanLines)
 	return &ReplConn{Conn: conn, Scanner: scanner}, nil
 
 }
@@ -140,7 +471,7 @@ func (r *Replicator) checkResponse(conn *ReplConn) error {
 		r.logger.Error(err.Error())
 		return err
 	}
-	r.logger.Info("Task replicated")
+	r.logger.Debug("Task replicated")
 	return nil
 
 }
@@ -149,113 +480,105 @@ func (rc *ReplConn) checkConnResp() error {
 	if rc.Scanner.Scan() {
 
 		if rc.Scanner.Text() != "OK" {
-			return fmt.Errorf("received: " + rc.Scanner.Text() + " instead of OK")
+			return fmt.Errorf("received: %s instead of OK", rc.Scanner.Text())
 		}
 	} else {
+		if err := rc.Scanner.Err(); err != nil {
+			return err
+		}
 		return fmt.Errorf("No response received")
 	}
 
-	if err := rc.Scanner.Err(); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func (r *Replicator) AddWriteEvent(we WriteEvent) {
-	r.writeCh <- we
+// VersionedSet formats VSET <key> <version> <unix ms, 0 for never> <timestamp> <origin> <value>, a SET that keeps the
+// version, the expiration, the timestamp and the origin of the primary
+func VersionedSet(key string, version uint64, expiresAt time.Time, timestamp uint64, origin string, value string) string {
+	expires := int64(0)
+	if !expiresAt.IsZero() {
+		expires = expiresAt.UnixMilli()
+	}
+
+	return fmt.Sprintf("VSET %s %d %d %s %s", key, version, expires, stamp(timestamp, origin), value)
 }
 
-func sendCommand(replConn *ReplConn, we WriteEvent) error {
+// VersionedWrite formats <cmd> <key> <version> <timestamp> <origin> [arguments], a write of a hash, a list or a set
+// that the secondary repeats on its copy and stores with the version of the primary
+func VersionedWrite(cmd string, key string, version uint64, timestamp uint64, origin string, args string) string {
+	if args == "" {
+		return fmt.Sprintf("%s %s %d %s", cmd, key, version, stamp(timestamp, origin))
+	}
 
-	var cmd string
+	return fmt.Sprintf("%s %s %d %s %s", cmd, key, version, stamp(timestamp, origin), args)
+}
 
-	switch we.Cmd {
-	case "SET":
-		cmd = fmt.Sprintf("%s %s %s\n", we.Cmd, we.Key, we.Value)
-	case "DELETE":
-		cmd = fmt.Sprintf("%s %s\n", we.Cmd, we.Key)
+// stamp formats the timestamp and the origin of a write, an empty origin is sent as - so the fields keep their places
+func stamp(timestamp uint64, origin string) string {
+	if origin == "" {
+		origin = "-"
 	}
-	_, err := replConn.Conn.Write([]byte(cmd))
-	return err
-}
 
-func reEstablishConnection(address string) (*ReplConn, error) {
-	time.Sleep(2 * time.Second)
-	return establishConnection(address)
+	return strconv.FormatUint(timestamp, 10) + " " + origin
 }
 
-// ToDo: THIS THING NEEDS REFACTOR
-// Maybe refactor this using a granular locking where a sync.Map keeps the locks or an actor model approach to increase performance and avoid memory sharing
+// ParseStamp parses the <timestamp> <origin> fields of a replicated write
+func ParseStamp(timestamp string, origin string) (uint64, string, error) {
+	ts, err := strconv.ParseUint(timestamp, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid timestamp: %s", timestamp)
+	}
+	if origin == "-" {
+		origin = ""
+	}
 
-// If one secondary server fails continue trying with the others
-func (r *Replicator) replicateTask(we WriteEvent) {
-	r.connMapLock.Lock()
-	defer r.connMapLock.Unlock()
+	return ts, origin, nil
+}
 
-	for _, server := range r.secondaries {
-		replConn, exists := r.connMap[server.ID]
-		if !exists {
-			conn, err := establishConnection(server.Address)
-			if err != nil {
-				//r.logger.Error("failed to establish connection" + err.Error())
-				r.logger.Error(errorutil.Wrap(err, "failed to establish connection").Error())
-				continue
-			}
-			r.connMap[server.ID] = conn
+func sendCommand(replConn *ReplConn, we WriteEvent) error {
+	cmd, err := formatCommand(we)
+	if err != nil {
+		return err
+	}
 
-			replConn = conn
+	_, err = replConn.Conn.Write([]byte(cmd))
+	return err
+}
 
+// formatCommand formats the lines that replicate a write event, framed by the protocol so the values can hold any byte. A transaction is MULTI <n> followed by its n writes,
+// the secondary acknowledges them together
+func formatCommand(we WriteEvent) (string, error) {
+	switch we.Cmd {
+	case "SET":
+		if we.Version != 0 {
+			return protocol.Format(VersionedSet(we.Key, we.Version, we.ExpiresAt, we.Timestamp, we.Origin, we.Value)), nil
 		}
-
-		// There is a case where the connection drop is not detected immediatelly so no error is returned, we will handle it at the end
-		err := sendCommand(replConn, we)
-		currentConn := replConn
-
-		if err != nil {
-			replConn.Conn.Close()
-
-			newConn, err := reEstablishConnection(server.Address)
-			if err != nil {
-				r.logger.Error(errorutil.Wrap(err, "failed to establish connection").Error())
-				continue
-			}
-
-			r.connMap[server.ID] = newConn
-
-			err = sendCommand(newConn, we)
-
-			if err != nil {
-				newConn.Conn.Close()
-				r.logger.Error(errorutil.Wrap(err, "").Error())
-				continue
-			}
-
-			currentConn = newConn
-
+		if !we.ExpiresAt.IsZero() {
+			// the absolute time, so the secondary expires the key at the same moment
+			return protocol.Format(fmt.Sprintf("PSETEXAT %s %d %s %s", we.Key, we.ExpiresAt.UnixMilli(), stamp(we.Timestamp, we.Origin), we.Value)), nil
 		}
-
-		if err := r.checkResponse(currentConn); err != nil {
-			r.logger.Error(fmt.Sprintf("Response check failed for %s: %v", server.ID, err.Error()))
-			r.logger.Error(fmt.Sprintf("Retry one more time to connect to %s", server.ID))
-
-			// This is for the case that the dropped connection is not imediatelly detected
-
-			conn, err := establishConnection(server.Address)
-			if err != nil {
-				r.logger.Error(errorutil.Wrap(err, "failed to establish connection").Error())
-				return
+		return protocol.Format(fmt.Sprintf("SET %s %s %s", we.Key, stamp(we.Timestamp, we.Origin), we.Value)), nil
+	case "DELETE":
+		return protocol.Format(we.Cmd + " " + we.Key), nil
+	case "FLUSH":
+		return "FLUSH\n", nil
+	case "HSET", "HDEL", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM":
+		return protocol.Format(VersionedWrite(we.Cmd, we.Key, we.Version, we.Timestamp, we.Origin, we.Value)), nil
+	case "MULTI":
+		var b strings.Builder
+		fmt.Fprintf(&b, "MULTI %d\n", len(we.Batch))
+		for _, write := range we.Batch {
+			if write.Cmd == "MULTI" || write.Cmd == "FLUSH" {
+				return "", fmt.Errorf("%s can't be part of a replicated transaction", write.Cmd)
 			}
-			r.connMap[server.ID] = conn
-			err = sendCommand(conn, we)
+			line, err := formatCommand(write)
 			if err != nil {
-				conn.Conn.Close()
-				r.logger.Error(err.Error())
-				continue
+				return "", err
 			}
-
+			b.WriteString(line)
 		}
-
+		return b.String(), nil
 	}
 
+	return "", fmt.Errorf("unknown replication command: %s", we.Cmd)
 }
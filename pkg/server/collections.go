@@ -0,0 +1,533 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/replication"
+)
+
+var (
+	errWrongType   = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errKeyNotFound = errors.New("Key not found")
+	// the cross cluster links forward only the strings
+	errCrossClusterCollection = errors.New("collections are not supported with cross cluster replication")
+	errCrossClusterFlush      = errors.New("FLUSH is not supported with cross cluster replication")
+	errScoreNaN               = errors.New("Resulting score is not a number")
+)
+
+// collectionUsage is the usage of the writes of the hashes, the lists, the sets and the sorted sets
+var collectionUsage = map[string]string{
+	"HSET":    "HSET <key> <field> <value>",
+	"HDEL":    "HDEL <key> <field> [field ...]",
+	"LPUSH":   "LPUSH <key> <value>",
+	"RPUSH":   "RPUSH <key> <value>",
+	"LPOP":    "LPOP <key>",
+	"RPOP":    "RPOP <key>",
+	"SADD":    "SADD <key> <member> [member ...]",
+	"SREM":    "SREM <key> <member> [member ...]",
+	"ZADD":    "ZADD <key> <score> <member> [score member ...]",
+	"ZINCRBY": "ZINCRBY <key> <increment> <member>",
+	"ZREM":    "ZREM <key> <member> [member ...]",
+}
+
+// collectionKind is the kind of the value that a write of a collection works on
+func collectionKind(cmd string) cache.Kind {
+	switch cmd {
+	case "HSET", "HDEL":
+		return cache.KindHash
+	case "LPUSH", "RPUSH", "LPOP", "RPOP":
+		return cache.KindList
+	case "ZADD", "ZINCRBY", "ZREM":
+		return cache.KindZSet
+	}
+
+	return cache.KindSet
+}
+
+// parseCollectionArgs splits the arguments of a write of a collection, it reports false if they don't match the usage.
+// A field, a member or a key can't contain a space, a value can
+func parseCollectionArgs(cmd string, args string) ([]string, bool) {
+	switch cmd {
+	case "HSET":
+		parts := strings.SplitN(args, " ", 2)
+		return parts, len(parts) == 2
+	case "LPUSH", "RPUSH":
+		return []string{args}, args != ""
+	case "LPOP", "RPOP":
+		return nil, args == ""
+	case "ZADD":
+		// <score> <member> pairs
+		fields := strings.Fields(args)
+		if len(fields) == 0 || len(fields)%2 != 0 {
+			return nil, false
+		}
+		for i := 0; i < len(fields); i += 2 {
+			if _, err := parseScore(fields[i]); err != nil {
+				return nil, false
+			}
+		}
+		return fields, true
+	case "ZINCRBY":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			return nil, false
+		}
+		_, err := parseScore(fields[0])
+		return fields, err == nil
+	}
+
+	fields := strings.Fields(args)
+	return fields, len(fields) > 0
+}
+
+// parseRange parses the <start> <stop> indexes of LRANGE
+func parseRange(args string) (int, int, bool) {
+	fields := strings.Split(args, " ")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	stop, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return start, stop, true
+}
+
+// collection returns the entry of the key if it holds a value of the kind, a missing key is an empty collection
+func collection(st cache.Store, key string, kind cache.Kind) (cache.Entry, error) {
+	entry, exists := st.Get(key)
+	if exists && entry.Kind != kind {
+		return cache.Entry{}, errWrongType
+	}
+
+	if !exists {
+		entry = cache.Entry{Kind: kind}
+		switch kind {
+		case cache.KindHash:
+			entry.Hash = map[string]string{}
+		case cache.KindSet:
+			entry.Members = map[string]struct{}{}
+		case cache.KindZSet:
+			entry.ZSet = cache.NewZSet()
+		}
+	}
+
+	return entry, nil
+}
+
+// collectionLen is the number of elements of a collection
+func collectionLen(entry cache.Entry) int {
+	switch entry.Kind {
+	case cache.KindHash:
+		return len(entry.Hash)
+	case cache.KindList:
+		return len(entry.List)
+	case cache.KindSet:
+		return len(entry.Members)
+	case cache.KindZSet:
+		return entry.ZSet.Len()
+	}
+
+	return 0
+}
+
+// applyCollectionWrite runs a write of a hash, a list, a set or a sorted set and returns its reply. The collection is stored with
+// the timestamp, the origin and the version of meta, a zero version assigns the next one, and the stored version is
+// returned. An emptied collection is removed. It reports false if the write had no effect, so there is nothing to
+// replicate. The primary and the secondaries run the same writes with it
+func applyCollectionWrite(st cache.Store, cmd string, key string, args []string, meta cache.Entry) (string, uint64, bool, error) {
+	entry, err := collection(st, key, collectionKind(cmd))
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	reply := ""
+	changed := true
+
+	switch cmd {
+	case "HSET":
+		_, found := entry.Hash[args[0]]
+		entry.Hash[args[0]] = args[1]
+		reply = countReply(!found)
+	case "HDEL":
+		removed := 0
+		for _, field := range args {
+			if _, found := entry.Hash[field]; found {
+				delete(entry.Hash, field)
+				removed++
+			}
+		}
+		reply = strconv.Itoa(removed)
+		changed = removed > 0
+	case "LPUSH":
+		entry.List = append([]string{args[0]}, entry.List...)
+		reply = strconv.Itoa(len(entry.List))
+	case "RPUSH":
+		entry.List = append(entry.List, args[0])
+		reply = strconv.Itoa(len(entry.List))
+	case "LPOP", "RPOP":
+		if len(entry.List) == 0 {
+			return "", 0, false, errKeyNotFound
+		}
+		if cmd == "LPOP" {
+			reply, entry.List = entry.List[0], entry.List[1:]
+		} else {
+			last := len(entry.List) - 1
+			reply, entry.List = entry.List[last], entry.List[:last]
+		}
+	case "SADD":
+		added := 0
+		for _, member := range args {
+			if _, found := entry.Members[member]; !found {
+				entry.Members[member] = struct{}{}
+				added++
+			}
+		}
+		reply = strconv.Itoa(added)
+		changed = added > 0
+	case "SREM":
+		removed := 0
+		for _, member := range args {
+			if _, found := entry.Members[member]; found {
+				delete(entry.Members, member)
+				removed++
+			}
+		}
+		reply = strconv.Itoa(removed)
+		changed = removed > 0
+	case "ZADD":
+		// the reply counts the new members, a new score of a member is a change too
+		added, updated := 0, 0
+		for i := 0; i < len(args); i += 2 {
+			score, _ := parseScore(args[i])
+			old, found := entry.ZSet.Score(args[i+1])
+			entry.ZSet.Add(args[i+1], score)
+			if !found {
+				added++
+			} else if old != score {
+				updated++
+			}
+		}
+		reply = strconv.Itoa(added)
+		changed = added+updated > 0
+	case "ZINCRBY":
+		increment, _ := parseScore(args[0])
+		old, found := entry.ZSet.Score(args[1])
+		score := old + increment
+		if math.IsNaN(score) {
+			return "", 0, false, errScoreNaN
+		}
+		entry.ZSet.Add(args[1], score)
+		reply = formatScore(score)
+		changed = !found || score != old
+	case "ZREM":
+		removed := 0
+		for _, member := range args {
+			if entry.ZSet.Remove(member) {
+				removed++
+			}
+		}
+		reply = strconv.Itoa(removed)
+		changed = removed > 0
+	}
+
+	if !changed {
+		return reply, entry.Version, false, nil
+	}
+
+	if collectionLen(entry) == 0 {
+		st.Delete(key)
+		return reply, 0, true, nil
+	}
+
+	entry.Timestamp, entry.Origin, entry.Version = meta.Timestamp, meta.Origin, meta.Version
+	return reply, st.Set(key, entry), true, nil
+}
+
+func countReply(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// writeCollection runs a write of a collection that was parsed by parseCollectionArgs and replicates it with the
+// version that was stored. The arguments are replicated as they were received, except a ZINCRBY that is replicated
+// as a ZADD of the new score, like the counters, so a write that is replayed doesn't add the increment twice
+func (s *Server) writeCollection(cmd string, key string, args string, parsed []string) (string, error) {
+	var reply string
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		reply, err = s.writeCollectionLocked(st, s.replicator, cmd, key, args, parsed)
+	})
+
+	return reply, err
+}
+
+// writeCollectionLocked is writeCollection while the lock of the cache is held
+func (s *Server) writeCollectionLocked(st cache.Store, sink eventSink, cmd string, key string, args string, parsed []string) (string, error) {
+	if s.crossCluster {
+		return "", errCrossClusterCollection
+	}
+
+	ts := s.clock.Now()
+
+	reply, version, changed, err := applyCollectionWrite(st, cmd, key, parsed, cache.Entry{Timestamp: ts, Origin: s.clusterId})
+	if err != nil || !changed {
+		return reply, err
+	}
+
+	// a write that emptied the collection removed the key and has no version, it is replicated as the removal so that
+	// the secondaries never assign a version of their own
+	if version == 0 {
+		sink.AddWriteEvent(replication.WriteEvent{Key: key, Cmd: "DELETE", Timestamp: ts, Origin: s.clusterId})
+		s.IsRecovering([]string{"DELETE", key})
+		return reply, nil
+	}
+
+	replCmd, replArgs := cmd, args
+	if cmd == "ZINCRBY" {
+		replCmd, replArgs = "ZADD", reply+" "+parsed[1]
+	}
+
+	sink.AddWriteEvent(replication.WriteEvent{Cmd: replCmd, Key: key, Value: replArgs, Timestamp: ts, Origin: s.clusterId, Version: version})
+	s.IsRecovering(strings.SplitN(replication.VersionedWrite(replCmd, key, version, ts, s.clusterId, replArgs), " ", 3))
+
+	return reply, nil
+}
+
+// applyReplicatedCollection applies <cmd> <key> <version> <timestamp> <origin> [arguments] that was received from the
+// primary. A write that is both in the state and in the stream of a new secondary, or of a recovery, arrives twice and
+// is applied once: an entry that already has its version, or a newer one, has it. A write that emptied a collection
+// is replicated as a DELETE, so every replicated write carries the version of the primary. A replayed pop of a list
+// that is not in the state does nothing, the list was removed later and its DELETE follows
+func (s *Server) applyReplicatedCollection(st cache.Store, cmd []string) error {
+	meta, parsed, err := s.parseReplicatedCollection(cmd[0], cmd)
+	if err != nil {
+		return err
+	}
+
+	if current, exists := st.Get(cmd[1]); exists && current.Version >= meta.Version {
+		return nil
+	}
+
+	_, _, _, err = applyCollectionWrite(st, cmd[0], cmd[1], parsed, meta)
+	if err == errKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// applyRebuild applies REBUILD <key> <version> <timestamp> <origin> <cmd> [arguments], an element of a collection in
+// the state that is sent to a secondary. Every element of the collection has the version of the collection, so unlike
+// a replicated write it is always applied, the state starts with a DELETE of the old copy
+func (s *Server) applyRebuild(st cache.Store, cmd []string) error {
+	if len(cmd) != 3 {
+		return errors.New("failed to parse replicated REBUILD")
+	}
+
+	// move the command in front of the key, like a replicated write
+	fields := strings.SplitN(cmd[2], " ", 5)
+	if len(fields) < 4 {
+		return errors.New("failed to parse replicated REBUILD")
+	}
+	if _, ok := collectionUsage[fields[3]]; !ok {
+		return errors.New("unknown replicated REBUILD command: " + fields[3])
+	}
+	write := []string{fields[3], cmd[1], strings.Join(append(fields[:3:3], fields[4:]...), " ")}
+
+	meta, parsed, err := s.parseReplicatedCollection(write[0], write)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = applyCollectionWrite(st, write[0], write[1], parsed, meta)
+
+	return err
+}
+
+// parseReplicatedCollection parses the <version> <timestamp> <origin> [arguments] of a replicated write of a collection
+func (s *Server) parseReplicatedCollection(name string, cmd []string) (cache.Entry, []string, error) {
+	if len(cmd) != 3 {
+		return cache.Entry{}, nil, errors.New("failed to parse replicated " + name)
+	}
+
+	fields := strings.SplitN(cmd[2], " ", 4)
+	if len(fields) < 3 {
+		return cache.Entry{}, nil, errors.New("failed to parse replicated " + name)
+	}
+	version, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return cache.Entry{}, nil, errors.New("invalid version: " + fields[0])
+	}
+	meta, err := s.replicatedEntry(fields[1], fields[2])
+	if err != nil {
+		return cache.Entry{}, nil, err
+	}
+	args := ""
+	if len(fields) == 4 {
+		args = fields[3]
+	}
+	parsed, ok := parseCollectionArgs(cmd[0], args)
+	if !ok {
+		return cache.Entry{}, nil, errors.New("failed to parse replicated " + name)
+	}
+
+	meta.Version = version
+	return meta, parsed, nil
+}
+
+// collectionState returns the lines that rebuild the collection on a secondary, a DELETE of its old copy and a
+// REBUILD per element
+func collectionState(key string, entry cache.Entry) []string {
+	lines := []string{"DELETE " + key}
+	rebuild := func(cmd string, args string) {
+		line := replication.VersionedWrite("REBUILD", key, entry.Version, entry.Timestamp, entry.Origin, cmd+" "+args)
+		lines = append(lines, line)
+	}
+
+	switch entry.Kind {
+	case cache.KindHash:
+		for _, field := range sortedFields(entry.Hash) {
+			rebuild("HSET", field+" "+entry.Hash[field])
+		}
+	case cache.KindList:
+		for _, value := range entry.List {
+			rebuild("RPUSH", value)
+		}
+	case cache.KindSet:
+		for _, member := range sortedMembers(entry.Members) {
+			rebuild("SADD", member)
+		}
+	case cache.KindZSet:
+		for _, member := range entry.ZSet.Range(0, -1, false) {
+			rebuild("ZADD", formatScore(member.Score)+" "+member.Member)
+		}
+	}
+
+	return lines
+}
+
+// readCollection calls read with the entry of the key while the lock of the cache is held, read must copy what it
+// keeps. It reports false if the key doesn't exist
+func (s *Server) readCollection(key string, kind cache.Kind, read func(entry cache.Entry)) (bool, error) {
+	exists := false
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		var entry cache.Entry
+		entry, exists = st.Get(key)
+		if !exists {
+			return
+		}
+		if entry.Kind != kind {
+			err = errWrongType
+			return
+		}
+
+		st.Touch(key)
+		read(entry)
+	})
+
+	return exists, err
+}
+
+// hget returns the value of a field of a hash
+func (s *Server) hget(key string, field string) (string, error) {
+	value, found := "", false
+	exists, err := s.readCollection(key, cache.KindHash, func(entry cache.Entry) {
+		value, found = entry.Hash[field]
+	})
+	if err != nil {
+		return "", err
+	}
+	if !exists || !found {
+		return "", errKeyNotFound
+	}
+
+	return value, nil
+}
+
+// hgetall returns the fields of a hash, each followed by its value, sorted by field
+func (s *Server) hgetall(key string) ([]string, error) {
+	lines := []string{}
+	_, err := s.readCollection(key, cache.KindHash, func(entry cache.Entry) {
+		for _, field := range sortedFields(entry.Hash) {
+			lines = append(lines, field, entry.Hash[field])
+		}
+	})
+
+	return lines, err
+}
+
+// lrange returns the elements of a list from start to stop, both included. A negative index counts from the end
+func (s *Server) lrange(key string, start int, stop int) ([]string, error) {
+	lines := []string{}
+	_, err := s.readCollection(key, cache.KindList, func(entry cache.Entry) {
+		length := len(entry.List)
+		if start < 0 {
+			start = max(length+start, 0)
+		}
+		if stop < 0 {
+			stop = length + stop
+		}
+		stop = min(stop, length-1)
+
+		if start <= stop {
+			lines = append(lines, entry.List[start:stop+1]...)
+		}
+	})
+
+	return lines, err
+}
+
+// smembers returns the members of a set, sorted
+func (s *Server) smembers(key string) ([]string, error) {
+	lines := []string{}
+	_, err := s.readCollection(key, cache.KindSet, func(entry cache.Entry) {
+		lines = sortedMembers(entry.Members)
+	})
+
+	return lines, err
+}
+
+// sismember reports if member belongs to the set
+func (s *Server) sismember(key string, member string) (bool, error) {
+	found := false
+	_, err := s.readCollection(key, cache.KindSet, func(entry cache.Entry) {
+		_, found = entry.Members[member]
+	})
+
+	return found, err
+}
+
+func sortedFields(hash map[string]string) []string {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+func sortedMembers(members map[string]struct{}) []string {
+	sorted := make([]string, 0, len(members))
+	for member := range members {
+		sorted = append(sorted, member)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
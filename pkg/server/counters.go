@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+)
+
+var (
+	errNotInteger = errors.New("Value is not an integer")
+	errNotFloat   = errors.New("Value is not a valid float")
+	errOverflow   = errors.New("Increment or decrement would overflow")
+)
+
+// parseIncrBy returns the delta of INCR <key>, DECR <key>, INCRBY <key> <n> or DECRBY <key> <n>
+func parseIncrBy(cmd []string) (int64, error) {
+	delta := int64(1)
+	switch cmd[0] {
+	case "INCR", "DECR":
+		if len(cmd) != 2 {
+			return 0, fmt.Errorf("Usage: %s <key>", cmd[0])
+		}
+	default:
+		if len(cmd) != 3 {
+			return 0, fmt.Errorf("Usage: %s <key> <increment>", cmd[0])
+		}
+		var err error
+		if delta, err = strconv.ParseInt(cmd[2], 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	}
+
+	if cmd[0] == "DECR" || cmd[0] == "DECRBY" {
+		if delta == math.MinInt64 {
+			return 0, errOverflow
+		}
+		delta = -delta
+	}
+
+	return delta, nil
+}
+
+// incrBy adds delta to the integer value of the key, a missing key counts as 0
+func (s *Server) incrBy(key string, delta int64) (int64, error) {
+	var result int64
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		result, err = s.incrByLocked(st, s.replicator, key, delta)
+	})
+
+	return result, err
+}
+
+// incrByLocked is incrBy while the lock of the cache is held
+func (s *Server) incrByLocked(st cache.Store, sink eventSink, key string, delta int64) (int64, error) {
+	entry, exists := st.Get(key)
+	if exists && entry.Kind != cache.KindString {
+		return 0, errWrongType
+	}
+
+	current := int64(0)
+	if exists {
+		var err error
+		if current, err = strconv.ParseInt(entry.Value, 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, errOverflow
+	}
+
+	result := current + delta
+	s.setCounter(st, sink, key, strconv.FormatInt(result, 10), entry)
+
+	return result, nil
+}
+
+// incrByFloat adds delta to the numeric value of the key, a missing key counts as 0
+func (s *Server) incrByFloat(key string, delta float64) (string, error) {
+	var result string
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		entry, exists := st.Get(key)
+		if exists && entry.Kind != cache.KindString {
+			err = errWrongType
+			return
+		}
+
+		current := 0.0
+		if exists {
+			if current, err = strconv.ParseFloat(entry.Value, 64); err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+				err = errNotFloat
+				return
+			}
+		}
+
+		sum := current + delta
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			err = errOverflow
+			return
+		}
+
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		s.setCounter(st, s.replicator, key, result, entry)
+	})
+
+	return result, err
+}
+
+// setCounter stores the new value of a counter, the expiration of the key is kept. The absolute value is replicated
+// so a replay of the event is harmless
+func (s *Server) setCounter(st cache.Store, sink eventSink, key string, value string, previous cache.Entry) {
+	s.storeEntry(st, sink, key, cache.Entry{Value: value, Timestamp: s.clock.Now(), Origin: s.clusterId, ExpiresAt: previous.ExpiresAt})
+}
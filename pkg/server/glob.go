@@ -0,0 +1,120 @@
+package server
+
+import "fmt"
+
+// matchGlob reports if s matches the glob pattern. * matches any sequence, ? any character, [abc], [a-z] and [^abc]
+// a character of a set and \ escapes the next character. Unlike path.Match a * also matches a /
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	// the position after the last * and the position of s it was tried at, to backtrack on a mismatch
+	starP, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starI = p+1, i
+				p++
+				continue
+
+			case '?':
+				p++
+				i++
+				continue
+
+			case '[':
+				if matched, next := matchSet(pattern, p, s[i]); matched {
+					p = next
+					i++
+					continue
+				}
+
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+
+		// let the last * match one more character
+		starI++
+		p, i = starP, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matchSet matches c against the set that starts at pattern[start], it returns the position after the set
+func matchSet(pattern string, start int, c byte) (bool, int) {
+	p := start + 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for ; p < len(pattern) && pattern[p] != ']'; p++ {
+		low := pattern[p]
+		if low == '\\' && p+1 < len(pattern) {
+			p++
+			low = pattern[p]
+		}
+
+		high := low
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			high = pattern[p+2]
+			p += 2
+		}
+
+		if low <= c && c <= high {
+			matched = true
+		}
+	}
+
+	if p >= len(pattern) {
+		// an unclosed set never matches, validGlob rejects it
+		return false, p
+	}
+
+	return matched != negate, p + 1
+}
+
+// validGlob rejects the patterns with an unclosed set
+func validGlob(pattern string) error {
+	for p := 0; p < len(pattern); p++ {
+		switch pattern[p] {
+		case '\\':
+			p++
+		case '[':
+			p++
+			for p < len(pattern) && pattern[p] != ']' {
+				if pattern[p] == '\\' {
+					p++
+				}
+				p++
+			}
+			if p >= len(pattern) {
+				return fmt.Errorf("unclosed [ in the pattern")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+)
+
+// Keyspace notifications. For every enabled class of events a change of a key is published to
+// __keyspace__:<key> with the event as the message and to __keyevent__:<event> with the key as the message. A flush
+// has no key, it is published only to __keyevent__:flush with * as the message. Every node publishes the changes of
+// its own cache, the writes that a secondary applies from its primary included.
+
+const (
+	keyspaceChannelPrefix = "__keyspace__:"
+	keyeventChannelPrefix = "__keyevent__:"
+)
+
+// keyspaceClasses are the classes of events that can be enabled, by the name that is published
+var keyspaceClasses = map[string]cache.EventType{
+	cache.EventSet.String():    cache.EventSet,
+	cache.EventDelete.String(): cache.EventDelete,
+	cache.EventEvict.String():  cache.EventEvict,
+	cache.EventExpire.String(): cache.EventExpire,
+	cache.EventFlush.String():  cache.EventFlush,
+}
+
+// SetKeyspaceEvents enables the notifications of the classes of events, set, del, evicted, expired and flush, or all
+// of them with "all". No classes, the default, disables them
+func (s *Server) SetKeyspaceEvents(classes []string) error {
+	var enabled uint32
+	for _, class := range classes {
+		if strings.ToLower(class) == "all" {
+			for _, event := range keyspaceClasses {
+				enabled |= 1 << event
+			}
+			continue
+		}
+
+		event, exists := keyspaceClasses[strings.ToLower(class)]
+		if !exists {
+			return fmt.Errorf("unknown keyspace event: %s", class)
+		}
+		enabled |= 1 << event
+	}
+
+	s.keyspaceEvents.Store(enabled)
+
+	return nil
+}
+
+// notifyKeyspace publishes a change of the cache if its class is enabled, it is called with the lock of the cache held
+func (s *Server) notifyKeyspace(event cache.EventType, key string) {
+	if s.keyspaceEvents.Load()&(1<<event) == 0 {
+		return
+	}
+
+	if event == cache.EventFlush {
+		s.pubsub.publish(keyeventChannelPrefix+event.String(), "*")
+		return
+	}
+
+	s.pubsub.publish(keyspaceChannelPrefix+key, event.String())
+	s.pubsub.publish(keyeventChannelPrefix+event.String(), key)
+}
+
+const (
+	// how often the expiration looks for expired keys and how many keys it examines at a time
+	expirationInterval = 100 * time.Millisecond
+	expirationSample   = 20
+	// a sample with more expired keys than this is likely followed by more, so the next one is examined right away
+	expirationRepeat = expirationSample / 4
+	// the most samples of a round, so the cache is not locked for long
+	expirationMaxSamples = 16
+	// how often the expired leases of the locks are dropped
+	lockSweepInterval = time.Second
+)
+
+// ExpireKeys removes the expired keys that nobody accesses until done is closed, so their expired events are
+// published and their space is freed. It drops the expired leases of the locks too
+func (s *Server) ExpireKeys(done <-chan struct{}) {
+	ticker := time.NewTicker(expirationInterval)
+	defer ticker.Stop()
+	lockSweep := time.NewTicker(lockSweepInterval)
+	defer lockSweep.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-lockSweep.C:
+			s.locks.removeExpired(time.Now())
+		case <-ticker.C:
+			for i := 0; i < expirationMaxSamples; i++ {
+				if s.cache.RemoveExpired(expirationSample) <= expirationRepeat {
+					break
+				}
+			}
+		}
+	}
+}
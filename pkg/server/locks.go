@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Locks with a lease, for the clients that need mutual exclusion, e.g. to run a job on one worker or to load a missing
+// key only once. A lock is granted with a fencing token that is greater than every token granted before, so whatever
+// the holder protects can reject a holder whose lease expired without noticing. The tokens come from the hybrid
+// logical clock of the server, they keep growing across a restart or a failover as long as the clocks of the servers
+// are closer than the time it takes. The locks live only in the memory of the server that granted them, they are not
+// replicated, so a failover frees them.
+
+// parseLease parses <command> <name> <owner> <milliseconds> of LOCK and EXTEND
+func parseLease(cmd []string) (string, time.Duration, error) {
+	usage := fmt.Errorf("Usage: %s <name> <owner> <milliseconds>", cmd[0])
+	if len(cmd) != 3 {
+		return "", 0, usage
+	}
+	args := strings.Split(cmd[2], " ")
+	if len(args) != 2 {
+		return "", 0, usage
+	}
+
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || ttl <= 0 {
+		return "", 0, errors.New("Invalid lock time")
+	}
+
+	return args[0], time.Duration(ttl) * time.Millisecond, nil
+}
+
+type lease struct {
+	owner     string
+	token     uint64
+	expiresAt time.Time
+}
+
+type lockTable struct {
+	lock   sync.Mutex
+	leases map[string]lease
+	// the source of the fencing tokens
+	nextToken func() uint64
+}
+
+func newLockTable(nextToken func() uint64) *lockTable {
+	return &lockTable{leases: make(map[string]lease), nextToken: nextToken}
+}
+
+// acquire grants the lock if it is free or expired and returns its fencing token. The owner that holds it gets the
+// same token again with a new lease, so a LOCK that is retried after a lost reply doesn't lock out its own owner.
+// Otherwise it returns false and the time until the lease of the holder expires
+func (lt *lockTable) acquire(name string, owner string, ttl time.Duration) (uint64, time.Duration, bool) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	now := time.Now()
+	current, exists := lt.leases[name]
+	if exists && now.Before(current.expiresAt) {
+		if current.owner != owner {
+			return 0, current.expiresAt.Sub(now), false
+		}
+	} else {
+		current = lease{owner: owner, token: lt.nextToken()}
+	}
+
+	current.expiresAt = now.Add(ttl)
+	lt.leases[name] = current
+
+	return current.token, 0, true
+}
+
+// extend renews the lease of the owner that holds the lock, an expired lease can't be renewed since another owner
+// might have taken the lock in the meantime
+func (lt *lockTable) extend(name string, owner string, ttl time.Duration) bool {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	now := time.Now()
+	current, exists := lt.leases[name]
+	if !exists || current.owner != owner || !now.Before(current.expiresAt) {
+		return false
+	}
+
+	current.expiresAt = now.Add(ttl)
+	lt.leases[name] = current
+
+	return true
+}
+
+func (lt *lockTable) release(name string, owner string) bool {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	current, exists := lt.leases[name]
+	if !exists || current.owner != owner || !time.Now().Before(current.expiresAt) {
+		return false
+	}
+
+	delete(lt.leases, name)
+
+	return true
+}
+
+// removeExpired drops the leases that were never released, it runs periodically to keep the table small
+func (lt *lockTable) removeExpired(now time.Time) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	for name, current := range lt.leases {
+		if !now.Before(current.expiresAt) {
+			delete(lt.leases, name)
+		}
+	}
+}
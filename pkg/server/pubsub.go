@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Pub/sub. A connection that sends SUBSCRIBE or PSUBSCRIBE enters the subscriber mode and stays in it until it is
+// closed, it receives a MESSAGE <channel> <message> line for every PUBLISH to one of its channels and a PMESSAGE
+// <pattern> <channel> <message> line for every PUBLISH to a channel that matches one of its patterns. The messages
+// are not stored nor replicated, only the subscribers of the node that receives the PUBLISH get them.
+
+// the number of lines that can wait for a slow subscriber before its connection is dropped
+const messageBufferSize = 1000
+
+type subscriber struct {
+	*pushConn
+	// the channels and the patterns of the subscriber, protected by the lock of pubsub
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// count is the number of the subscriptions, the lock of pubsub must be held
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+type pubsub struct {
+	lock sync.Mutex
+	// channel or pattern -> subscribers
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// subscribe adds a channel, or a pattern, to the subscriber and returns the number of its subscriptions
+func (ps *pubsub) subscribe(sub *subscriber, name string, pattern bool) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	index, own := ps.channels, sub.channels
+	if pattern {
+		index, own = ps.patterns, sub.patterns
+	}
+
+	subs, exists := index[name]
+	if !exists {
+		subs = make(map[*subscriber]struct{})
+		index[name] = subs
+	}
+	subs[sub] = struct{}{}
+	own[name] = struct{}{}
+
+	return sub.count()
+}
+
+// unsubscribe removes a channel, or a pattern, from the subscriber and returns the number of its subscriptions
+func (ps *pubsub) unsubscribe(sub *subscriber, name string, pattern bool) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if pattern {
+		delete(sub.patterns, name)
+		unindex(ps.patterns, sub, name)
+	} else {
+		delete(sub.channels, name)
+		unindex(ps.channels, sub, name)
+	}
+
+	return sub.count()
+}
+
+// remove drops every subscription of a subscriber whose connection is closed
+func (ps *pubsub) remove(sub *subscriber) {
+	sub.close()
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for channel := range sub.channels {
+		unindex(ps.channels, sub, channel)
+	}
+	for pattern := range sub.patterns {
+		unindex(ps.patterns, sub, pattern)
+	}
+}
+
+func unindex(index map[string]map[*subscriber]struct{}, sub *subscriber, name string) {
+	if subs, exists := index[name]; exists {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(index, name)
+		}
+	}
+}
+
+// publish sends the message to the subscribers of the channel and of the patterns that match it, it returns how
+// many received it. A subscriber that can't keep up is dropped and doesn't count
+func (ps *pubsub) publish(channel string, message string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	received := 0
+	for sub := range ps.channels[channel] {
+		if sub.push("MESSAGE " + channel + " " + message) {
+			received++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if sub.push("PMESSAGE " + pattern + " " + channel + " " + message) {
+				received++
+			}
+		}
+	}
+
+	return received
+}
+
+// serveSubscriber serves a connection in the subscriber mode, starting with the SUBSCRIBE or PSUBSCRIBE that switched
+// it, until the connection is closed. The replies are queued with the messages so they are written in order
+func (s *Server) serveSubscriber(conn net.Conn, scanner *bufio.Scanner, first string) {
+	sub := &subscriber{
+		pushConn: newPushConn(conn, messageBufferSize),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	go sub.run()
+	defer s.pubsub.remove(sub)
+
+	s.subscriberCommand(sub, first)
+	for scanner.Scan() {
+		s.subscriberCommand(sub, scanner.Text())
+	}
+}
+
+func (s *Server) subscriberCommand(sub *subscriber, line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch fields[0] {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		// <command> <channel or pattern> [...], every name is confirmed with <command> <name> <subscriptions>
+		if len(fields) < 2 {
+			sub.push(fmt.Sprintf("ERROR: Usage: %s <name> [name ...]", fields[0]))
+			return
+		}
+
+		pattern := strings.HasPrefix(fields[0], "P")
+		for _, name := range fields[1:] {
+			if pattern {
+				if err := validGlob(name); err != nil {
+					sub.push(fmt.Sprintf("ERROR: invalid pattern %s, %s", name, err.Error()))
+					continue
+				}
+			}
+
+			var count int
+			if strings.HasSuffix(fields[0], "UNSUBSCRIBE") {
+				count = s.pubsub.unsubscribe(sub, name, pattern)
+			} else {
+				count = s.pubsub.subscribe(sub, name, pattern)
+			}
+			sub.push(fmt.Sprintf("%s %s %d", fields[0], name, count))
+		}
+
+	case "PING":
+		sub.push("PONG")
+
+	default:
+		sub.push("ERROR: only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE and PING are allowed in subscriber mode")
+	}
+}
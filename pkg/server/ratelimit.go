@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+)
+
+// Rate limiting. THROTTLE <key> <capacity> <refill-per-second> <cost> is a token bucket and
+// WINDOW <key> <limit> <window-milliseconds> <cost> a sliding window counter, both decide under the lock of the cache
+// so the concurrent requests of a key can't race. The reply is ALLOWED or DENIED followed by the remaining requests and
+// the milliseconds to wait before the cost fits, 0 when it was allowed. The state is a string key that expires once it
+// doesn't matter anymore, only an allowed request writes it and it is replicated like a SET. A cost of 0 asks without
+// taking anything.
+
+var errNotRateLimit = errors.New("Value is not a rate limit state")
+
+// rateDecision is the reply of THROTTLE and WINDOW
+type rateDecision struct {
+	allowed    bool
+	remaining  int64
+	retryAfter time.Duration
+}
+
+func (d rateDecision) String() string {
+	verdict := "DENIED"
+	if d.allowed {
+		verdict = "ALLOWED"
+	}
+
+	return fmt.Sprintf("%s %d %d", verdict, d.remaining, ceilMilliseconds(d.retryAfter))
+}
+
+// ceilMilliseconds rounds up, a client that waits the reply of a denied request should not be denied again
+func ceilMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// parseRateLimit parses the <limit> <rate> <cost> arguments of THROTTLE and WINDOW, the rate is the refill per second
+// of THROTTLE and the window of WINDOW
+func parseRateLimit(cmd []string) (int64, float64, int64, error) {
+	usage := fmt.Errorf("Usage: %s", rateLimitUsage[cmd[0]])
+	if len(cmd) != 3 {
+		return 0, 0, 0, usage
+	}
+	args := strings.Split(cmd[2], " ")
+	if len(args) != 3 {
+		return 0, 0, 0, usage
+	}
+
+	limit, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, 0, 0, errors.New("Invalid limit")
+	}
+	rate, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) || cmd[0] == "WINDOW" && rate != math.Trunc(rate) {
+		return 0, 0, 0, errors.New("Invalid rate")
+	}
+	cost, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || cost < 0 || cost > limit {
+		return 0, 0, 0, errors.New("Invalid cost, it must be between 0 and the limit")
+	}
+
+	return limit, rate, cost, nil
+}
+
+var rateLimitUsage = map[string]string{
+	"THROTTLE": "THROTTLE <key> <capacity> <refill-per-second> <cost>",
+	"WINDOW":   "WINDOW <key> <limit> <window-milliseconds> <cost>",
+}
+
+// throttle takes cost tokens from the bucket of the key. A missing bucket is full, it refills continuously at rate
+// tokens per second up to capacity. The state is <tokens> <unix milliseconds of the last refill>
+func (s *Server) throttle(key string, capacity int64, rate float64, cost int64, now time.Time) (rateDecision, error) {
+	var decision rateDecision
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		entry, exists := st.Get(key)
+		if exists && entry.Kind != cache.KindString {
+			err = errWrongType
+			return
+		}
+
+		tokens := float64(capacity)
+		if exists {
+			var last int64
+			if tokens, last, err = parseBucket(entry.Value); err != nil {
+				return
+			}
+			if elapsed := now.UnixMilli() - last; elapsed > 0 {
+				tokens += rate * float64(elapsed) / 1000
+			}
+			tokens = min(tokens, float64(capacity))
+		}
+
+		if tokens < float64(cost) {
+			missing := (float64(cost) - tokens) / rate
+			decision = rateDecision{remaining: int64(tokens), retryAfter: time.Duration(math.Ceil(missing * float64(time.Second)))}
+			return
+		}
+
+		tokens -= float64(cost)
+		decision = rateDecision{allowed: true, remaining: int64(tokens)}
+		if cost == 0 {
+			return
+		}
+
+		// a bucket that is full again is the same as a missing one
+		untilFull := time.Duration(math.Ceil((float64(capacity) - tokens) / rate * float64(time.Second)))
+		state := strconv.FormatFloat(tokens, 'f', -1, 64) + " " + strconv.FormatInt(now.UnixMilli(), 10)
+		s.storeEntry(st, s.replicator, key, cache.Entry{Value: state, Timestamp: s.clock.Now(), Origin: s.clusterId, ExpiresAt: now.Add(untilFull + time.Millisecond)})
+	})
+
+	return decision, err
+}
+
+func parseBucket(state string) (float64, int64, error) {
+	fields := strings.Split(state, " ")
+	if len(fields) != 2 {
+		return 0, 0, errNotRateLimit
+	}
+	tokens, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || tokens < 0 {
+		return 0, 0, errNotRateLimit
+	}
+	last, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, errNotRateLimit
+	}
+
+	return tokens, last, nil
+}
+
+// slidingWindow counts cost requests of the key in the window that ends now. The count of the previous fixed window
+// is weighted by the part of it that is still in the sliding window, which needs two counters instead of a timestamp
+// per request. The state is <unix milliseconds of the current fixed window> <previous count> <current count>
+func (s *Server) slidingWindow(key string, limit int64, window time.Duration, cost int64, now time.Time) (rateDecision, error) {
+	var decision rateDecision
+	var err error
+
+	w := window.Milliseconds()
+	nowMs := now.UnixMilli()
+	start := nowMs - nowMs%w
+
+	s.cache.Atomic(func(st cache.Store) {
+		entry, exists := st.Get(key)
+		if exists && entry.Kind != cache.KindString {
+			err = errWrongType
+			return
+		}
+
+		var previous, current int64
+		if exists {
+			var stateStart, statePrevious, stateCurrent int64
+			if stateStart, statePrevious, stateCurrent, err = parseWindow(entry.Value); err != nil {
+				return
+			}
+			switch stateStart {
+			case start:
+				previous, current = statePrevious, stateCurrent
+			case start - w:
+				previous = stateCurrent
+			}
+		}
+
+		elapsed := nowMs - start
+		estimate := int64(math.Ceil(float64(previous)*float64(w-elapsed)/float64(w))) + current
+		if estimate+cost > limit {
+			decision = rateDecision{remaining: max(limit-estimate, 0), retryAfter: windowRetryAfter(limit, w, cost, previous, current, elapsed)}
+			return
+		}
+
+		decision = rateDecision{allowed: true, remaining: limit - estimate - cost}
+		if cost == 0 {
+			return
+		}
+
+		state := fmt.Sprintf("%d %d %d", start, previous, current+cost)
+		s.storeEntry(st, s.replicator, key, cache.Entry{Value: state, Timestamp: s.clock.Now(), Origin: s.clusterId, ExpiresAt: time.UnixMilli(start + 2*w)})
+	})
+
+	return decision, err
+}
+
+// windowRetryAfter is the time until the weighted count of the previous window has dropped enough for cost to fit,
+// in this window if the current count leaves room, otherwise in the next one
+func windowRetryAfter(limit, w, cost, previous, current, elapsed int64) time.Duration {
+	// the point of a window of length w, after which previous*(w-t)/w <= room
+	fitsAt := func(previous, room int64) int64 {
+		if previous <= room {
+			return 0
+		}
+		return int64(math.Ceil(float64(w) * (1 - float64(room)/float64(previous))))
+	}
+
+	var wait int64
+	if room := limit - cost - current; room >= 0 {
+		wait = fitsAt(previous, room) - elapsed
+	} else {
+		wait = w - elapsed + fitsAt(current, limit-cost)
+	}
+
+	return time.Duration(max(wait, 1)) * time.Millisecond
+}
+
+func parseWindow(state string) (int64, int64, int64, error) {
+	fields := strings.Split(state, " ")
+	if len(fields) != 3 {
+		return 0, 0, 0, errNotRateLimit
+	}
+
+	var values [3]int64
+	for i, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || value < 0 {
+			return 0, 0, 0, errNotRateLimit
+		}
+		values[i] = value
+	}
+
+	return values[0], values[1], values[2], nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultScanCount = 10
+	// KEYS reads the keys in batches so the lock of the cache is not held for the whole key space
+	keysBatchSize = 1000
+)
+
+type scanArgs struct {
+	cursor  uint64
+	pattern string
+	count   int
+}
+
+// parseScanArgs parses <cursor> [MATCH <pattern>] [COUNT <n>]
+func parseScanArgs(args []string) (scanArgs, error) {
+	if len(args) == 0 {
+		return scanArgs{}, fmt.Errorf("missing cursor")
+	}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return scanArgs{}, fmt.Errorf("invalid cursor")
+	}
+
+	parsed := scanArgs{cursor: cursor, pattern: "*", count: defaultScanCount}
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return scanArgs{}, fmt.Errorf("missing value of %s", args[i])
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			if err := validGlob(args[i+1]); err != nil {
+				return scanArgs{}, err
+			}
+			parsed.pattern = args[i+1]
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return scanArgs{}, fmt.Errorf("invalid count")
+			}
+			parsed.count = count
+		default:
+			return scanArgs{}, fmt.Errorf("unknown option %s", args[i])
+		}
+	}
+
+	return parsed, nil
+}
+
+// matcher returns the filter of the keys for the scan of the cache, nil matches every key
+func matcher(pattern string) func(string) bool {
+	if pattern == "*" {
+		return nil
+	}
+
+	return func(key string) bool {
+		return matchGlob(pattern, key)
+	}
+}
+
+// scan examines up to count keys after the cursor and returns the ones that match and the cursor of the next call,
+// zero when the iteration is complete. A call can return fewer keys than count, even none, before the end
+func (s *Server) scan(args scanArgs) ([]string, uint64) {
+	return s.cache.Scan(args.cursor, args.count, matcher(args.pattern))
+}
+
+// keys returns every key that matches the pattern
+func (s *Server) keys(pattern string) []string {
+	keys := []string{}
+
+	cursor := uint64(0)
+	for {
+		batch, next := s.cache.Scan(cursor, keysBatchSize, matcher(pattern))
+		keys = append(keys, batch...)
+
+		if next == 0 {
+			return keys
+		}
+		cursor = next
+	}
+}
@@ -3,14 +3,21 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/voukatas/CacheGopher/pkg/cache"
 	"github.com/voukatas/CacheGopher/pkg/config"
 	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 	"github.com/voukatas/CacheGopher/pkg/replication"
+	"github.com/voukatas/CacheGopher/pkg/sharding"
 )
 
 type Server struct {
@@ -23,16 +30,78 @@ type Server struct {
 	writeLock      sync.Mutex // lock to protect the queuedWrites
 	isRecovering   bool
 	recoveryLock   sync.Mutex // lock to protect the isRecovering flag
+	clock          *replication.HLC
+	clusterId      string // origin of the writes that are accepted by this cluster
+	tracker        *tracker
+	locks          *lockTable
+	pubsub         *pubsub
+	// the placement of the keys and the position of the shard of the server, set by SetShards
+	ring  *sharding.Ring
+	shard uint32
+	// the classes of the keyspace notifications, a bit per cache.EventType
+	keyspaceEvents atomic.Uint32
+	// how many times keys were removed from the cache, the WATCH of a missing key checks it. Protected by the lock of
+	// the cache
+	removals uint64
+	// set by EnableCrossCluster, the writes of collections and FLUSH are rejected. Protected by the lock of the cache
+	crossCluster bool
 }
 
 func NewServer(cache cache.Cache, logger logger.Logger, replicator replication.ReplicationService, isPrimary bool, primaryAddress string) *Server {
-	return &Server{
+	clock := replication.NewHLC()
+	s := &Server{
 		cache:          cache,
 		logger:         logger,
 		replicator:     replicator,
 		isPrimary:      isPrimary,
 		primaryAddress: primaryAddress,
+		clock:          clock,
+		tracker:        newTracker(),
+		locks:          newLockTable(clock.Now),
+		pubsub:         newPubsub(),
 	}
+
+	cache.SetListener(s.onCacheEvent)
+
+	return s
+}
+
+// onCacheEvent is called with the lock of the cache held
+func (s *Server) onCacheEvent(event cache.EventType, key string) {
+	s.notifyKeyspace(event, key)
+
+	if event != cache.EventSet {
+		s.removals++
+	}
+
+	if event == cache.EventFlush {
+		s.tracker.invalidateAll()
+		return
+	}
+
+	s.tracker.invalidate(key)
+}
+
+// SetClusterId sets the origin that is attached to the writes of this cluster, it is used by the cross cluster replication
+func (s *Server) SetClusterId(clusterId string) {
+	s.clusterId = clusterId
+}
+
+// EnableCrossCluster is called before the cross cluster links start. The links forward only the strings, so it fails
+// if the cache holds a collection and from then on the writes of collections and FLUSH are rejected
+func (s *Server) EnableCrossCluster() error {
+	var err error
+	s.cache.Atomic(func(st cache.Store) {
+		for _, key := range st.Keys() {
+			if entry, _ := st.Get(key); entry.Kind != cache.KindString {
+				err = fmt.Errorf("cross cluster replication supports only strings, the key %s holds a collection", key)
+				return
+			}
+		}
+		s.crossCluster = true
+	})
+
+	return err
 }
 
 type LogEvent struct {
@@ -44,15 +113,176 @@ type LogEvent struct {
 }
 
 func (s *Server) SendCurrentState(conn net.Conn) {
+	s.sendState(conn)
+}
+
+func (s *Server) sendState(w io.Writer) error {
 	s.logger.Debug("Sending current state")
 
-	data := s.cache.GetSnapshot()
-	for k, v := range data {
-		fmt.Fprintf(conn, "SET %s %s\n", k, v)
-		s.logger.Debug("Key: " + k + "Value: " + v + "\n")
+	// copy the entries under the lock and write them without it
+	lines := make([]string, 0)
+	s.cache.Atomic(func(st cache.Store) {
+		for _, key := range st.Keys() {
+			entry, _ := st.Get(key)
+			if entry.Kind != cache.KindString {
+				lines = append(lines, collectionState(key, entry)...)
+				continue
+			}
+			lines = append(lines, replication.VersionedSet(key, entry.Version, entry.ExpiresAt, entry.Timestamp, entry.Origin, entry.Value))
+		}
+	})
+
+	for _, line := range lines {
+		if err := protocol.WriteLine(w, line); err != nil {
+			return err
+		}
+		s.logger.Debug(line)
+	}
+
+	return nil
+}
+
+// StartReplication connects a secondary to its primary, on a primary it does nothing since the secondaries connect to it
+func (s *Server) StartReplication() {
+	s.replicator.StartFollower(s)
+}
 
+// ApplyReplicated applies a write that was received from the primary or from a recovery
+func (s *Server) ApplyReplicated(cmd []string) error {
+	if cmd[0] == "FLUSH" {
+		s.cache.Flush()
+		return nil
 	}
 
+	var err error
+	s.cache.Atomic(func(st cache.Store) {
+		err = s.applyReplicated(st, cmd)
+	})
+
+	return err
+}
+
+// ApplyReplicatedBatch applies the writes of a transaction of the primary at once, so no reader sees a part of them
+func (s *Server) ApplyReplicatedBatch(cmds [][]string) error {
+	var err error
+	s.cache.Atomic(func(st cache.Store) {
+		for _, cmd := range cmds {
+			if err = s.applyReplicated(st, cmd); err != nil {
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// applyReplicated applies a replicated write other than a FLUSH while the lock of the cache is held. The timestamp and
+// the origin of the primary are stored with the entry, a server that takes over keeps them for the cross cluster links
+func (s *Server) applyReplicated(st cache.Store, cmd []string) error {
+	switch cmd[0] {
+	case "SET":
+		// SET <key> <timestamp> <origin> <value>
+		args, err := replicatedArgs(cmd, 3)
+		if err != nil {
+			return err
+		}
+		entry, err := s.replicatedEntry(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		entry.Value = args[2]
+		st.Set(cmd[1], entry)
+	case "PSETEXAT":
+		// PSETEXAT <key> <unix ms> <timestamp> <origin> <value>
+		args, err := replicatedArgs(cmd, 4)
+		if err != nil {
+			return err
+		}
+		expiresAt, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiration time: %s", args[0])
+		}
+		entry, err := s.replicatedEntry(args[1], args[2])
+		if err != nil {
+			return err
+		}
+
+		entry.Value, entry.ExpiresAt = args[3], time.UnixMilli(expiresAt)
+		st.Set(cmd[1], entry)
+	case "VSET":
+		// VSET <key> <version> <unix ms, 0 for never> <timestamp> <origin> <value>
+		args, err := replicatedArgs(cmd, 5)
+		if err != nil {
+			return err
+		}
+		version, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version: %s", args[0])
+		}
+		expires, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiration time: %s", args[1])
+		}
+		entry, err := s.replicatedEntry(args[2], args[3])
+		if err != nil {
+			return err
+		}
+
+		entry.Value, entry.Version = args[4], version
+		if expires != 0 {
+			entry.ExpiresAt = time.UnixMilli(expires)
+		}
+		st.Set(cmd[1], entry)
+	case "DELETE":
+		if len(cmd) != 2 {
+			return fmt.Errorf("failed to parse replicated key")
+		}
+
+		st.Delete(cmd[1])
+	case "HSET", "HDEL", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM":
+		return s.applyReplicatedCollection(st, cmd)
+	case "REBUILD":
+		return s.applyRebuild(st, cmd)
+	default:
+		return fmt.Errorf("unknown replicated command: %s", cmd[0])
+	}
+
+	return nil
+}
+
+// replicatedArgs splits the arguments of a replicated SET, the last one is the value that can contain spaces
+func replicatedArgs(cmd []string, count int) ([]string, error) {
+	if len(cmd) != 3 {
+		return nil, fmt.Errorf("failed to parse replicated key value")
+	}
+	args := strings.SplitN(cmd[2], " ", count)
+	if len(args) != count {
+		return nil, fmt.Errorf("failed to parse replicated key value")
+	}
+
+	return args, nil
+}
+
+// replicatedEntry returns an entry with the timestamp and the origin of a replicated write, the clock of the server
+// moves past the timestamp so the writes it accepts after a failover are newer
+func (s *Server) replicatedEntry(timestamp string, origin string) (cache.Entry, error) {
+	ts, origin, err := replication.ParseStamp(timestamp, origin)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	s.clock.Update(ts)
+
+	return cache.Entry{Timestamp: ts, Origin: origin}, nil
+}
+
+// KeepOnly removes the keys that the primary doesn't have anymore after a full sync
+func (s *Server) KeepOnly(keys map[string]struct{}) {
+	for _, key := range s.cache.Keys() {
+		if _, exists := keys[key]; !exists {
+			s.cache.Delete(key)
+		}
+	}
 }
 
 func (s *Server) StopWriteOpsAndEnableQueuedWrites() {
@@ -79,15 +309,20 @@ func (s *Server) SendQueuedWrites(conn net.Conn) {
 
 	for _, v := range s.queuedWrites {
 
-		if v.Op == "SET" {
+		if v.Op == "DELETE" {
 
-			fmt.Fprintf(conn, "SET %s %s\n", v.Key, v.Value)
-			s.logger.Debug("Key: " + v.Key + "Value: " + v.Value + "\n")
+			protocol.WriteLine(conn, "DELETE "+v.Key)
+			s.logger.Debug("Key: " + v.Key + "\n")
 
-		} else if v.Op == "DELETE" {
+		} else if v.Op == "FLUSH" {
 
-			fmt.Fprintf(conn, "DELETE %s\n", v.Key)
-			s.logger.Debug("Key: " + v.Key + "\n")
+			protocol.WriteLine(conn, "FLUSH")
+
+		} else if _, ok := collectionUsage[v.Op]; ok || v.Op == "VSET" {
+
+			// a VSET or a write of a collection, the value is <version> and the rest of the replicated line
+			protocol.WriteLine(conn, v.Op+" "+v.Key+" "+v.Value)
+			s.logger.Debug("Key: " + v.Key + "Value: " + v.Value + "\n")
 
 		}
 
@@ -106,7 +341,7 @@ func (s *Server) IsRecovering(cmd []string) {
 	if s.isRecovering {
 		var event *LogEvent
 
-		if cmd[0] == "SET" {
+		if _, ok := collectionUsage[cmd[0]]; cmd[0] == "VSET" || ok {
 			event = &LogEvent{
 				Key:   cmd[1],
 				Value: cmd[2],
@@ -117,6 +352,10 @@ func (s *Server) IsRecovering(cmd []string) {
 				Key: cmd[1],
 				Op:  cmd[0],
 			}
+		} else if cmd[0] == "FLUSH" {
+			event = &LogEvent{
+				Op: cmd[0],
+			}
 		} else {
 			s.logger.Error("Unknown command: " + cmd[0])
 			return
@@ -140,6 +379,7 @@ func (s *Server) HandleRecovery(myConfig config.ServerConfig) error {
 
 		defer conn.Close()
 		scanner := bufio.NewScanner(conn)
+		scanner.Split(protocol.ScanLines)
 		replConn := &replication.ReplConn{Conn: conn, Scanner: scanner}
 		err = s.startRecovery(replConn, myConfig.ID)
 		if err != nil {
@@ -151,12 +391,11 @@ func (s *Server) HandleRecovery(myConfig config.ServerConfig) error {
 		for _, serverId := range myConfig.Secondaries {
 			fmt.Println("\n", serverId)
 			replConn, err := s.replicator.GetSecondaryConn(serverId)
-			//conn, err := net.Dial("tcp", "localhost:31338")
 			if err != nil {
 				s.logger.Error(err.Error())
 				continue
 			}
-			//defer conn.Close()
+			defer replConn.Conn.Close()
 
 			err = s.startRecovery(replConn, myConfig.ID)
 			if err != nil {
@@ -184,22 +423,8 @@ func (s *Server) startRecovery(replConn *replication.ReplConn, serverId string)
 		}
 		parts := strings.SplitN(replConn.Scanner.Text(), " ", 3)
 
-		switch parts[0] {
-		case "SET":
-			if len(parts) != 3 {
-				return fmt.Errorf("failed to parse recover key value")
-			}
-
-			s.cache.Set(parts[1], parts[2])
-			fmt.Fprintf(replConn.Conn, "OK\n")
-		case "DELETE":
-			if len(parts) != 2 {
-				return fmt.Errorf("failed to parse recover key value")
-			}
-
-			s.cache.Delete(parts[1])
-			fmt.Fprintf(replConn.Conn, "OK\n")
-
+		if err := s.ApplyReplicated(parts); err != nil {
+			return fmt.Errorf("failed to parse recover key value: %w", err)
 		}
 	}
 
@@ -211,6 +436,68 @@ func (s *Server) startRecovery(replConn *replication.ReplConn, serverId string)
 	return nil
 }
 
+// writeLines sends a multi-line reply, a header with the number of lines goes first so the reader knows where the reply ends
+func writeLines(w io.Writer, lines []string) error {
+	if _, err := fmt.Fprintf(w, "*%d\n", len(lines)); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if err := protocol.WriteLine(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyRemoteWrite applies a write of another cluster if it is newer than the local value (last-writer-wins).
+// The write keeps its origin so the cross cluster links of this cluster don't send it back
+func (s *Server) applyRemoteWrite(we replication.WriteEvent) bool {
+	s.clock.Update(we.Timestamp)
+
+	applied := false
+	s.cache.Atomic(func(st cache.Store) {
+		current, exists := st.Get(we.Key)
+		if exists && !replication.IsNewer(we.Timestamp, we.Origin, current.Timestamp, current.Origin) {
+			return
+		}
+
+		switch we.Cmd {
+		case "SET":
+			we.Version = st.Set(we.Key, cache.Entry{Value: we.Value, Timestamp: we.Timestamp, Origin: we.Origin, ExpiresAt: we.ExpiresAt})
+			applied = true
+		case "DELETE":
+			applied = st.Delete(we.Key)
+		}
+	})
+
+	if applied {
+		s.replicator.AddWriteEvent(we)
+	}
+
+	return applied
+}
+
+// CrossClusterState returns the writes of the current state that originated from this cluster, a cross cluster link
+// sends them when it starts or when it fell behind
+func (s *Server) CrossClusterState() []replication.WriteEvent {
+	events := make([]replication.WriteEvent, 0)
+
+	s.cache.Atomic(func(st cache.Store) {
+		for _, key := range st.Keys() {
+			entry, _ := st.Get(key)
+			// the cross cluster links replicate only the strings
+			if entry.Kind != cache.KindString || entry.Origin != s.clusterId || entry.Timestamp == 0 {
+				continue
+			}
+			events = append(events, replication.WriteEvent{Cmd: "SET", Key: key, Value: entry.Value, Timestamp: entry.Timestamp, Origin: entry.Origin, ExpiresAt: entry.ExpiresAt})
+		}
+	})
+
+	return events
+}
+
 func (s *Server) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 
@@ -219,29 +506,191 @@ func (s *Server) HandleConnection(conn net.Conn) {
 
 	buf := make([]byte, initBufSize, maxTokenSize) // 64KB
 
-	scanner := bufio.NewScanner(conn) // Can read up to 64KB by default
+	scanner := protocol.NewScanner(conn) // Can read up to 64KB by default
 	scanner.Buffer(buf, maxTokenSize)
 	s.logger.Debug("inside HandleConnection")
 
+	// set by REPLCONF when the other side is a secondary that wants to replicate from us
+	replicaId := ""
+	// set by TRACKING when the other side keeps the values it reads in a client side cache
+	trackingId := ""
+	// MULTI and WATCH
+	tx := &transaction{}
+
 	for scanner.Scan() {
 
 		s.logger.Debug("inside scanner: " + scanner.Text())
 
-		cmd := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		// a bulk line is kept as it is, the spaces around a value belong to it
+		line := scanner.Text()
+		if !scanner.Bulk() {
+			line = strings.TrimSpace(line)
+		}
+		cmd := strings.SplitN(line, " ", 3)
+		if _, control := txControlCommands[cmd[0]]; tx.multi && !control {
+			protocol.WriteLine(conn, s.queue(tx, cmd))
+			continue
+		}
+
 		switch cmd[0] {
-		case "SET":
+		case "SET", "SETNX", "SETXX":
+			// SET <key> <value>, SETNX only if the key doesn't exist and SETXX only if it exists
 			if len(cmd) != 3 {
-				fmt.Fprintf(conn, "ERROR: Usage: SET <key> <value>\n")
-				s.logger.Error("ERROR: Usage: SET <key> <value>")
+				fmt.Fprintf(conn, "ERROR: Usage: %s <key> <value>\n", cmd[0])
+				s.logger.Error("ERROR: Usage: " + cmd[0] + " <key> <value>")
+				continue
+			}
+			condition := setConditions[cmd[0]]
+			if !s.set(cmd[1], cache.Entry{Value: cmd[2], Timestamp: s.clock.Now(), Origin: s.clusterId}, condition) {
+				if condition == ifAbsent {
+					fmt.Fprintf(conn, "EXISTS\n")
+				} else {
+					fmt.Fprintf(conn, "ERROR: Key not found\n")
+				}
 				continue
 			}
-			s.cache.Set(cmd[1], cmd[2])
 			fmt.Fprintf(conn, "OK\n")
 			s.logger.Debug("SET OK")
-			s.replicator.AddWriteEvent(replication.WriteEvent{Key: cmd[1], Value: cmd[2], Cmd: cmd[0]})
 
-			// check if we recover and do your thing
-			s.IsRecovering(cmd)
+		case "PSETEX":
+			// PSETEX <key> <milliseconds> <value>, the key is removed when the time passes
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: PSETEX <key> <milliseconds> <value>\n")
+				continue
+			}
+			args := strings.SplitN(cmd[2], " ", 2)
+			if len(args) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: PSETEX <key> <milliseconds> <value>\n")
+				continue
+			}
+			ttl, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || ttl <= 0 {
+				fmt.Fprintf(conn, "ERROR: Invalid expire time\n")
+				continue
+			}
+
+			expiresAt := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+			s.set(cmd[1], cache.Entry{Value: args[1], Timestamp: s.clock.Now(), Origin: s.clusterId, ExpiresAt: expiresAt}, always)
+			fmt.Fprintf(conn, "OK\n")
+
+		case "CAS":
+			// CAS <key> <version> <value>, version 0 creates a key that doesn't exist. The reply is the new version
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: CAS <key> <version> <value>\n")
+				continue
+			}
+			args := strings.SplitN(cmd[2], " ", 2)
+			if len(args) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: CAS <key> <version> <value>\n")
+				continue
+			}
+			version, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Fprintf(conn, "ERROR: Invalid version\n")
+				continue
+			}
+
+			stored, swapped, err := s.compareAndSet(cmd[1], version, args[1])
+			switch {
+			case err != nil:
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+			case swapped:
+				fmt.Fprintf(conn, "%d\n", stored)
+			default:
+				fmt.Fprintf(conn, "CONFLICT\n")
+			}
+
+		case "INCR", "DECR", "INCRBY", "DECRBY":
+			// INCR <key> | DECR <key> | INCRBY <key> <n> | DECRBY <key> <n>, the reply is the new value
+			delta, err := parseIncrBy(cmd)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+
+			value, err := s.incrBy(cmd[1], delta)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			fmt.Fprintf(conn, "%d\n", value)
+
+		case "INCRBYFLOAT":
+			// INCRBYFLOAT <key> <increment>, the reply is the new value
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: INCRBYFLOAT <key> <increment>\n")
+				continue
+			}
+			delta, err := strconv.ParseFloat(cmd[2], 64)
+			if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+				protocol.WriteLine(conn, "ERROR: "+errNotFloat.Error())
+				continue
+			}
+
+			value, err := s.incrByFloat(cmd[1], delta)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			protocol.WriteLine(conn, value)
+
+		case "THROTTLE", "WINDOW":
+			// THROTTLE <key> <capacity> <refill-per-second> <cost> | WINDOW <key> <limit> <window-milliseconds> <cost>,
+			// the reply is ALLOWED|DENIED <remaining> <retry after milliseconds>
+			limit, rate, cost, err := parseRateLimit(cmd)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+
+			var decision rateDecision
+			if cmd[0] == "THROTTLE" {
+				decision, err = s.throttle(cmd[1], limit, rate, cost, time.Now())
+			} else {
+				decision, err = s.slidingWindow(cmd[1], limit, time.Duration(rate)*time.Millisecond, cost, time.Now())
+			}
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			fmt.Fprintf(conn, "%s\n", decision)
+
+		case "LOCK", "EXTEND":
+			// LOCK <name> <owner> <milliseconds> replies with the fencing token, or LOCKED <milliseconds> until the
+			// lease of the holder expires. EXTEND <name> <owner> <milliseconds> renews the lease of the holder
+			owner, ttl, err := parseLease(cmd)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+
+			if cmd[0] == "EXTEND" {
+				if s.locks.extend(cmd[1], owner, ttl) {
+					fmt.Fprintf(conn, "OK\n")
+				} else {
+					fmt.Fprintf(conn, "ERROR: Lock not held\n")
+				}
+				continue
+			}
+
+			if token, wait, ok := s.locks.acquire(cmd[1], owner, ttl); ok {
+				fmt.Fprintf(conn, "%d\n", token)
+			} else {
+				fmt.Fprintf(conn, "LOCKED %d\n", max(wait.Milliseconds(), 1))
+			}
+
+		case "UNLOCK":
+			// UNLOCK <name> <owner>
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: UNLOCK <name> <owner>\n")
+				continue
+			}
+
+			if s.locks.release(cmd[1], cmd[2]) {
+				fmt.Fprintf(conn, "OK\n")
+			} else {
+				fmt.Fprintf(conn, "ERROR: Lock not held\n")
+			}
 
 		case "GET":
 			if len(cmd) != 2 {
@@ -249,31 +698,340 @@ func (s *Server) HandleConnection(conn net.Conn) {
 				s.logger.Debug("ERROR: Usage: GET <key>")
 				continue
 			}
-			v, ok := s.cache.Get(cmd[1])
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+			entry, ok, err := s.getString(cmd[1])
+			v := entry.Value
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
 			if !ok {
 				fmt.Fprintf(conn, "ERROR: Key not found\n")
 				s.logger.Debug("ERROR: Key not found: " + cmd[1])
 				continue
 			}
-			fmt.Fprintf(conn, "%s\n", v)
+			protocol.WriteLine(conn, v)
 			s.logger.Debug("GET" + " value:" + v)
 
+		case "HSET", "HDEL", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZINCRBY", "ZREM":
+			// the reply is the value of a pop, 1 or 0 for a new field, the new score of a ZINCRBY or the count of
+			// the elements that were added, removed or are in the list after a push
+			args := ""
+			if len(cmd) == 3 {
+				args = cmd[2]
+			}
+			parsed, ok := parseCollectionArgs(cmd[0], args)
+			if len(cmd) < 2 || !ok {
+				fmt.Fprintf(conn, "ERROR: Usage: %s\n", collectionUsage[cmd[0]])
+				continue
+			}
+
+			reply, err := s.writeCollection(cmd[0], cmd[1], args, parsed)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			protocol.WriteLine(conn, reply)
+
+		case "HGET":
+			// HGET <key> <field>
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: HGET <key> <field>\n")
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			value, err := s.hget(cmd[1], cmd[2])
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			protocol.WriteLine(conn, value)
+
+		case "HGETALL", "SMEMBERS":
+			// HGETALL <key> replies with every field followed by its value, SMEMBERS <key> with every member
+			if len(cmd) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: %s <key>\n", cmd[0])
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			read := s.hgetall
+			if cmd[0] == "SMEMBERS" {
+				read = s.smembers
+			}
+			lines, err := read(cmd[1])
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			writeLines(conn, lines)
+
+		case "LRANGE":
+			// LRANGE <key> <start> <stop>, the indexes are included and a negative one counts from the end
+			start, stop, ok := 0, 0, len(cmd) == 3
+			if ok {
+				start, stop, ok = parseRange(cmd[2])
+			}
+			if !ok {
+				fmt.Fprintf(conn, "ERROR: Usage: LRANGE <key> <start> <stop>\n")
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			lines, err := s.lrange(cmd[1], start, stop)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			writeLines(conn, lines)
+
+		case "SISMEMBER":
+			// SISMEMBER <key> <member>, the reply is 1 or 0
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: SISMEMBER <key> <member>\n")
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			found, err := s.sismember(cmd[1], cmd[2])
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			protocol.WriteLine(conn, countReply(found))
+
+		case "ZRANGE", "ZREVRANGE":
+			// ZRANGE <key> <start> <stop> [WITHSCORES], ZREVRANGE counts the ranks from the highest score
+			args := zrangeArgs{}
+			ok := len(cmd) == 3
+			if ok {
+				args, ok = parseZRangeArgs(cmd[2])
+			}
+			if !ok {
+				fmt.Fprintf(conn, "ERROR: Usage: %s <key> <start> <stop> [WITHSCORES]\n", cmd[0])
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			members, err := s.zrange(cmd[1], args.start, args.stop, cmd[0] == "ZREVRANGE")
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			writeLines(conn, zmemberLines(members, args.withScores))
+
+		case "ZRANGEBYSCORE":
+			// ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT <offset> <count>], min and max are included
+			args := zrangeArgs{}
+			ok := len(cmd) == 3
+			if ok {
+				args, ok = parseZRangeByScoreArgs(cmd[2])
+			}
+			if !ok {
+				fmt.Fprintf(conn, "ERROR: Usage: ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT <offset> <count>]\n")
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			members, err := s.zrangeByScore(cmd[1], args.min, args.max, args.offset, args.count)
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			writeLines(conn, zmemberLines(members, args.withScores))
+
+		case "ZRANK", "ZSCORE":
+			// ZRANK <key> <member> replies with the rank from zero in ascending order, ZSCORE <key> <member> with
+			// the score
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: %s <key> <member>\n", cmd[0])
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+
+			var reply string
+			var err error
+			if cmd[0] == "ZRANK" {
+				var rank int
+				rank, err = s.zrank(cmd[1], cmd[2])
+				reply = strconv.Itoa(rank)
+			} else {
+				var score float64
+				score, err = s.zscore(cmd[1], cmd[2])
+				reply = formatScore(score)
+			}
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			protocol.WriteLine(conn, reply)
+
+		case "MULTI":
+			if tx.multi {
+				fmt.Fprintf(conn, "ERROR: MULTI calls can't be nested\n")
+				continue
+			}
+			tx.multi = true
+			fmt.Fprintf(conn, "OK\n")
+
+		case "EXEC":
+			// the reply is ABORTED if a watched key changed, otherwise a *<n> header and the reply of every command
+			if !tx.multi {
+				fmt.Fprintf(conn, "ERROR: EXEC without MULTI\n")
+				continue
+			}
+			if tx.failed {
+				tx.reset()
+				fmt.Fprintf(conn, "ERROR: EXECABORT Transaction discarded because of previous errors\n")
+				continue
+			}
+
+			replies, ok := s.exec(tx)
+			tx.reset()
+			if !ok {
+				fmt.Fprintf(conn, "ABORTED\n")
+				continue
+			}
+			writeLines(conn, replies)
+
+		case "DISCARD":
+			if !tx.multi {
+				fmt.Fprintf(conn, "ERROR: DISCARD without MULTI\n")
+				continue
+			}
+			tx.reset()
+			fmt.Fprintf(conn, "OK\n")
+
+		case "WATCH":
+			// WATCH <key> [key ...], the next EXEC of this connection is aborted if one of the keys changes
+			if len(cmd) < 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: WATCH <key> [key ...]\n")
+				continue
+			}
+			if tx.multi {
+				fmt.Fprintf(conn, "ERROR: WATCH inside MULTI is not allowed\n")
+				continue
+			}
+			keys := strings.Fields(strings.Join(cmd[1:], " "))
+			if err := s.checkOwned(keys...); err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			s.watch(tx, keys)
+			fmt.Fprintf(conn, "OK\n")
+
+		case "UNWATCH":
+			if tx.multi {
+				fmt.Fprintf(conn, "ERROR: UNWATCH inside MULTI is not allowed\n")
+				continue
+			}
+			tx.watched = nil
+			fmt.Fprintf(conn, "OK\n")
+
+		case "GETS":
+			// GETS <key>, the reply is <version> <value>
+			if len(cmd) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: GETS <key>\n")
+				continue
+			}
+			if trackingId != "" {
+				s.tracker.track(cmd[1], trackingId)
+			}
+			entry, ok, err := s.getString(cmd[1])
+			if err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
+			if !ok {
+				fmt.Fprintf(conn, "ERROR: Key not found\n")
+				continue
+			}
+			protocol.WriteLine(conn, strconv.FormatUint(entry.Version, 10)+" "+entry.Value)
+
 		case "DELETE":
 			if len(cmd) != 2 {
 				fmt.Fprintf(conn, "ERROR: Usage: DELETE <key>\n")
 				continue
 			}
 
-			res := s.cache.Delete(cmd[1])
-			if res {
+			if s.deleteKey(cmd[1]) {
 				fmt.Fprintf(conn, "OK\n")
-				s.replicator.AddWriteEvent(replication.WriteEvent{Key: cmd[1], Cmd: cmd[0]})
 			} else {
-
 				fmt.Fprintf(conn, "ERROR: Key not found\n")
 			}
 
-			s.IsRecovering(cmd)
+		case "XSET":
+			// XSET <key> <timestamp> <origin> <expires> <value>, a write that was accepted by another cluster. The
+			// expiration is a unix time in milliseconds, 0 for a key without one
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: XSET <key> <timestamp> <origin> <expires> <value>\n")
+				continue
+			}
+			args := strings.SplitN(cmd[2], " ", 4)
+			if len(args) != 4 {
+				fmt.Fprintf(conn, "ERROR: Usage: XSET <key> <timestamp> <origin> <expires> <value>\n")
+				continue
+			}
+			ts, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Fprintf(conn, "ERROR: Invalid timestamp\n")
+				continue
+			}
+			expires, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil || expires < 0 {
+				fmt.Fprintf(conn, "ERROR: Invalid expiration time\n")
+				continue
+			}
+			we := replication.WriteEvent{Cmd: "SET", Key: cmd[1], Value: args[3], Timestamp: ts, Origin: args[1]}
+			if expires != 0 {
+				we.ExpiresAt = time.UnixMilli(expires)
+			}
+
+			if s.applyRemoteWrite(we) {
+				fmt.Fprintf(conn, "OK\n")
+			} else {
+				fmt.Fprintf(conn, "STALE\n")
+			}
+
+		case "XDELETE":
+			// XDELETE <key> <timestamp> <origin>
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: XDELETE <key> <timestamp> <origin>\n")
+				continue
+			}
+			args := strings.Split(cmd[2], " ")
+			if len(args) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: XDELETE <key> <timestamp> <origin>\n")
+				continue
+			}
+			ts, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Fprintf(conn, "ERROR: Invalid timestamp\n")
+				continue
+			}
+
+			if s.applyRemoteWrite(replication.WriteEvent{Cmd: "DELETE", Key: cmd[1], Timestamp: ts, Origin: args[1]}) {
+				fmt.Fprintf(conn, "OK\n")
+			} else {
+				fmt.Fprintf(conn, "STALE\n")
+			}
 
 		case "FLUSH":
 			if len(cmd) != 1 {
@@ -282,27 +1040,106 @@ func (s *Server) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			s.cache.Flush()
+			if err := s.flush(); err != nil {
+				protocol.WriteLine(conn, "ERROR: "+err.Error())
+				continue
+			}
 			fmt.Fprintf(conn, "OK\n")
 
+		case "SCAN":
+			// SCAN <cursor> [MATCH <pattern>] [COUNT <n>], the first line of the reply is the cursor of the next call
+			args, err := parseScanArgs(strings.Fields(strings.Join(cmd[1:], " ")))
+			if err != nil {
+				fmt.Fprintf(conn, "ERROR: Usage: SCAN <cursor> [MATCH <pattern>] [COUNT <n>], %s\n", err.Error())
+				continue
+			}
+
+			keys, next := s.scan(args)
+			writeLines(conn, append([]string{strconv.FormatUint(next, 10)}, keys...))
+
 		case "KEYS":
-			if len(cmd) != 1 {
+			// KEYS [pattern], the reply is a *<n> header followed by the n keys
+			if len(cmd) > 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: KEYS [pattern]\n")
+				continue
+			}
 
-				fmt.Fprintf(conn, "ERROR: Usage: KEYS\n")
+			pattern := "*"
+			if len(cmd) == 2 {
+				pattern = cmd[1]
+			}
+			if err := validGlob(pattern); err != nil {
+				fmt.Fprintf(conn, "ERROR: Usage: KEYS [pattern], %s\n", err.Error())
 				continue
 			}
 
-			keys := s.cache.Keys()
-			if len(keys) == 0 {
-				fmt.Fprintf(conn, "No keys found\n")
+			writeLines(conn, s.keys(pattern))
+
+		case "TRACKING":
+			// TRACKING <id> | OFF, the reads of this connection are tracked for the client that listens on INVALIDATIONS <id>
+			if len(cmd) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: TRACKING <id>|OFF\n")
 				continue
+			}
 
+			trackingId = cmd[1]
+			if strings.ToUpper(trackingId) == "OFF" {
+				trackingId = ""
 			}
+			fmt.Fprintf(conn, "OK\n")
 
-			for _, key := range keys {
-				fmt.Fprintf(conn, "%s\n", key)
+		case "INVALIDATIONS":
+			// INVALIDATIONS <id>, the connection receives the invalidations of the keys that were read with TRACKING <id>
+			if len(cmd) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: INVALIDATIONS <id>\n")
+				continue
+			}
+
+			sub := s.tracker.subscribe(cmd[1], conn)
+			fmt.Fprintf(conn, "OK\n")
+			go sub.run()
+
+			// nothing is expected from the client on this connection, the read only detects when it goes away
+			for scanner.Scan() {
+			}
+			s.tracker.unsubscribe(sub)
+			return
+
+		case "SUBSCRIBE", "PSUBSCRIBE":
+			// SUBSCRIBE <channel> [channel ...], PSUBSCRIBE <pattern> [pattern ...], the connection is in the
+			// subscriber mode from now on
+			if len(cmd) < 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: %s <name> [name ...]\n", cmd[0])
+				continue
 			}
 
+			s.serveSubscriber(conn, scanner.Scanner, line)
+			return
+
+		case "PUBLISH":
+			// PUBLISH <channel> <message>, the reply is the number of subscribers that received it
+			if len(cmd) != 3 {
+				fmt.Fprintf(conn, "ERROR: Usage: PUBLISH <channel> <message>\n")
+				continue
+			}
+
+			fmt.Fprintf(conn, "%d\n", s.pubsub.publish(cmd[1], cmd[2]))
+
+		case "INFO":
+			// INFO [section], the only section for now is replication
+			if len(cmd) > 2 || (len(cmd) == 2 && strings.ToLower(cmd[1]) != "replication") {
+				fmt.Fprintf(conn, "ERROR: Usage: INFO [replication]\n")
+				continue
+			}
+
+			writeLines(conn, append([]string{"# Replication"}, s.replicator.Info()...))
+
+		case "OFFSET":
+			// OFFSET, the reply is <replication id> <offset>, the position of this server in the replication stream.
+			// The clients use it for read your writes, the offsets of different ids can't be compared
+			replId, offset := s.replicator.Offset()
+			fmt.Fprintf(conn, "%s %d\n", replId, offset)
+
 		case "PING":
 
 			fmt.Fprintf(conn, "PONG\n")
@@ -332,13 +1169,40 @@ func (s *Server) HandleConnection(conn net.Conn) {
 			fmt.Fprintf(conn, "RECOVEREND\n")
 			return
 
+		case "REPLCONF":
+			if len(cmd) != 2 {
+				fmt.Fprintf(conn, "ERROR: Usage: REPLCONF <serverId>\n")
+				continue
+			}
+
+			replicaId = cmd[1]
+			fmt.Fprintf(conn, "OK\n")
+
+		case "SYNC":
+			if !s.isPrimary {
+				fmt.Fprintf(conn, "ERROR: Not a primary\n")
+				continue
+			}
+			if replicaId == "" {
+				fmt.Fprintf(conn, "ERROR: REPLCONF is required before SYNC\n")
+				continue
+			}
+
+			// the connection belongs to the replication link from now on
+			replConn := &replication.ReplConn{Conn: conn, Scanner: scanner.Scanner}
+			if err := s.replicator.ServeSecondary(replicaId, replConn, s.sendState); err != nil {
+				s.logger.Error(err.Error())
+			}
+			s.logger.Info("Replication link to " + replicaId + " closed")
+			return
+
 		case "EXIT":
 
 			fmt.Fprintf(conn, "Goodbye!\n")
 			return
 
 		default:
-			fmt.Fprintf(conn, "ERROR: Unknown command: %s\n", cmd[0])
+			protocol.WriteLine(conn, "ERROR: Unknown command: "+cmd[0])
 
 		}
 	}
@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/voukatas/CacheGopher/pkg/cache"
 	"github.com/voukatas/CacheGopher/pkg/config"
 	"github.com/voukatas/CacheGopher/pkg/logger"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 	"github.com/voukatas/CacheGopher/pkg/replication"
 )
 
@@ -68,6 +70,7 @@ func TestKeyReplicationAndRecoveryForTheSecondary(t *testing.T) {
 
 	// start secondary server
 	secondaryReplicator, _ := replication.NewReplicator("secondary", &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}, log)
+	defer secondaryReplicator.Stop()
 	secondaryServer := NewServer(localCacheSecondary, log, secondaryReplicator, false, "localhost:8000")
 
 	secondaryListener, err := net.Listen("tcp", secondaryConfig.Address)
@@ -93,9 +96,13 @@ func TestKeyReplicationAndRecoveryForTheSecondary(t *testing.T) {
 		}
 	}()
 
+	// the secondary starts before the primary, it keeps retrying until the primary is up
+	secondaryServer.StartReplication()
+
 	// start primary server
 
 	primaryReplicator, _ := replication.NewReplicator("primary", &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}, log)
+	defer primaryReplicator.Stop()
 
 	primaryServer := NewServer(localCachePrimary, log, primaryReplicator, true, "")
 	primaryListener, err := net.Listen("tcp", primaryConfig.Address)
@@ -222,6 +229,7 @@ func TestKeyReplicationAndRecoveryForThePrimary(t *testing.T) {
 
 	// start secondary server
 	secondaryReplicator, _ := replication.NewReplicator("secondary", &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}, log)
+	defer secondaryReplicator.Stop()
 	secondaryServer := NewServer(localCacheSecondary, log, secondaryReplicator, false, "localhost:8000")
 
 	secondaryListener, err := net.Listen("tcp", secondaryConfig.Address)
@@ -247,9 +255,13 @@ func TestKeyReplicationAndRecoveryForThePrimary(t *testing.T) {
 		}
 	}()
 
+	// the secondary starts before the primary, it keeps retrying until the primary is up
+	secondaryServer.StartReplication()
+
 	// start primary server
 
 	primaryReplicator, _ := replication.NewReplicator("primary", &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}, log)
+	defer primaryReplicator.Stop()
 
 	primaryServer := NewServer(localCachePrimary, log, primaryReplicator, true, "")
 	primaryListener, err := net.Listen("tcp", primaryConfig.Address)
@@ -326,3 +338,354 @@ func TestKeyReplicationAndRecoveryForThePrimary(t *testing.T) {
 	// close the channel and the servers
 	close(done)
 }
+
+func startReplicationTestNode(t *testing.T, cfg *config.Configuration, serverConfig config.ServerConfig, primaryAddress string) (*Server, func()) {
+	log := logger.SetupDebugLogger()
+	localCache, _ := cache.NewCache("LRU", 100)
+
+	replicator, err := replication.NewReplicator(serverConfig.ID, cfg, log)
+	if err != nil {
+		t.Fatalf("Failed to create replicator: %v", err)
+	}
+
+	isPrimary := primaryAddress == ""
+	node := NewServer(localCache, log, replicator, isPrimary, primaryAddress)
+
+	listener, err := net.Listen("tcp", serverConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go node.HandleConnection(conn)
+		}
+	}()
+
+	node.StartReplication()
+
+	return node, func() {
+		listener.Close()
+		replicator.Stop()
+	}
+}
+
+func waitForKey(c cache.Cache, key string, want string) bool {
+	for i := 0; i < 50; i++ {
+		if v, ok := c.Get(key); ok && v == want {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSecondaryJoinsRunningPrimary(t *testing.T) {
+	primaryConfig := config.ServerConfig{ID: "primary", Address: "localhost:8010", Role: "PRIMARY"}
+	secondaryConfig := config.ServerConfig{ID: "secondary", Address: "localhost:8011", Role: "SECONDARY", Primary: "primary"}
+	// the primary doesn't know anything about the secondary
+	primaryCfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig}}
+	secondaryCfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}
+
+	primaryServer, stopPrimary := startReplicationTestNode(t, primaryCfg, primaryConfig, "")
+	defer stopPrimary()
+
+	primaryServer.cache.Set("before", "join")
+	// the values that a line can't hold are framed in the state and in the stream
+	primaryServer.cache.Set("binary", "line one\nline two ")
+
+	secondaryServer, stopSecondary := startReplicationTestNode(t, secondaryCfg, secondaryConfig, primaryConfig.Address)
+	// a stale key that the primary doesn't have should be removed by the full sync
+	secondaryServer.cache.Set("stale", "value")
+
+	if !waitForKey(secondaryServer.cache, "before", "join") {
+		t.Fatal("Secondary should receive the state of the primary when it joins")
+	}
+	if _, exists := secondaryServer.cache.Get("stale"); exists {
+		t.Error("Secondary should drop the keys that the primary doesn't have")
+	}
+
+	clientConn, err := net.Dial("tcp", primaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	fmt.Fprintf(clientConn, "SET after join\n")
+	if res, _, _ := reader.ReadLine(); string(res) != "OK" {
+		t.Fatalf(`res= %q; want "OK"`, res)
+	}
+
+	if !waitForKey(secondaryServer.cache, "after", "join") {
+		t.Fatal("Secondary should receive the writes after it joins")
+	}
+
+	protocol.WriteLine(clientConn, "SET streamed $1\r\n\x00")
+	if res, _, _ := reader.ReadLine(); string(res) != "OK" {
+		t.Fatalf(`res= %q; want "OK"`, res)
+	}
+	if !waitForKey(secondaryServer.cache, "streamed", "$1\r\n\x00") || !waitForKey(secondaryServer.cache, "binary", "line one\nline two ") {
+		t.Fatal("Secondary should receive the values with any byte")
+	}
+
+	// restart the secondary with an empty cache, it should rejoin and get everything back
+	stopSecondary()
+	secondaryServer, stopSecondary = startReplicationTestNode(t, secondaryCfg, secondaryConfig, primaryConfig.Address)
+	defer stopSecondary()
+
+	if !waitForKey(secondaryServer.cache, "after", "join") {
+		t.Fatal("Secondary should resync after a restart")
+	}
+}
+
+func TestSyncRequiresReplconf(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	myServer := NewServer(localCache, logger.SetupDebugLogger(), &replication.MockReplicator{}, true, "")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go myServer.HandleConnection(serverConn)
+
+	fmt.Fprintf(clientConn, "SYNC\n")
+	scanner := bufio.NewScanner(clientConn)
+	scanner.Scan()
+	if scanner.Text() != "ERROR: REPLCONF is required before SYNC" {
+		t.Errorf("unexpected response: %q", scanner.Text())
+	}
+}
+
+func readInfo(t *testing.T, address string) map[string]string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "INFO replication\n")
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(protocol.ScanLines)
+	scanner.Scan()
+
+	var lines int
+	if _, err := fmt.Sscanf(scanner.Text(), "*%d", &lines); err != nil {
+		t.Fatalf("Expected a multi-line reply, got %q", scanner.Text())
+	}
+
+	info := make(map[string]string)
+	for i := 0; i < lines && scanner.Scan(); i++ {
+		if k, v, found := strings.Cut(scanner.Text(), ":"); found {
+			info[k] = v
+		}
+	}
+
+	return info
+}
+
+func TestReplicationInfo(t *testing.T) {
+	primaryConfig := config.ServerConfig{ID: "primary", Address: "localhost:8020", Role: "PRIMARY"}
+	secondaryConfig := config.ServerConfig{ID: "secondary", Address: "localhost:8021", Role: "SECONDARY", Primary: "primary"}
+	cfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}
+
+	_, stopPrimary := startReplicationTestNode(t, cfg, primaryConfig, "")
+	defer stopPrimary()
+	secondaryServer, stopSecondary := startReplicationTestNode(t, cfg, secondaryConfig, primaryConfig.Address)
+	defer stopSecondary()
+
+	clientConn, err := net.Dial("tcp", primaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	// the secondary might connect after the first write, it gets it either from the state or from the stream
+	for _, key := range []string{"a", "b", "c"} {
+		fmt.Fprintf(clientConn, "SET %s value\n", key)
+		reader.ReadLine()
+	}
+
+	if !waitForKey(secondaryServer.cache, "c", "value") {
+		t.Fatal("Secondary should have the key 'c'")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	info := readInfo(t, primaryConfig.Address)
+	if info["role"] != "primary" || info["offset"] != "3" || info["connected_secondaries"] != "1" {
+		t.Errorf("Unexpected primary info: %v", info)
+	}
+	if !strings.Contains(info["secondary"], "id=secondary") || !strings.Contains(info["secondary"], "state=online") ||
+		!strings.Contains(info["secondary"], "acked_offset=3,lag=0") {
+		t.Errorf("Unexpected secondary entry in primary info: %v", info["secondary"])
+	}
+
+	info = readInfo(t, secondaryConfig.Address)
+	if info["role"] != "secondary" || info["link_status"] != "up" || info["offset"] != "3" || info["last_contact_seconds"] != "0" {
+		t.Errorf("Unexpected secondary info: %v", info)
+	}
+
+	// the secondary goes away, the primary reports it offline with the error
+	stopSecondary()
+	fmt.Fprintf(clientConn, "SET d value\n")
+	reader.ReadLine()
+	time.Sleep(200 * time.Millisecond)
+
+	info = readInfo(t, primaryConfig.Address)
+	if info["connected_secondaries"] != "0" || !strings.Contains(info["secondary"], "state=offline") {
+		t.Errorf("Expected the secondary to be offline: %v", info)
+	}
+}
+
+func TestOffset(t *testing.T) {
+	primaryConfig := config.ServerConfig{ID: "primary", Address: "localhost:8022", Role: "PRIMARY"}
+	secondaryConfig := config.ServerConfig{ID: "secondary", Address: "localhost:8023", Role: "SECONDARY", Primary: "primary"}
+	cfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}
+
+	primaryServer, stopPrimary := startReplicationTestNode(t, cfg, primaryConfig, "")
+	defer stopPrimary()
+	secondaryServer, stopSecondary := startReplicationTestNode(t, cfg, secondaryConfig, primaryConfig.Address)
+	defer stopSecondary()
+
+	clientConn, err := net.Dial("tcp", primaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	// the offset that follows a write covers it, even before the write is dispatched to the secondaries. It comes
+	// with the replication id of the primary, a restarted primary counts from zero with a new one
+	replId, _ := primaryServer.replicator.Offset()
+	fmt.Fprintf(clientConn, "SET a value\nSET b value\nOFFSET\n")
+	for _, want := range []string{"OK", "OK", replId + " 2"} {
+		if line, _, _ := reader.ReadLine(); string(line) != want {
+			t.Fatalf("expected %s, got %s", want, line)
+		}
+	}
+
+	if !waitForKey(secondaryServer.cache, "b", "value") {
+		t.Fatal("Secondary should have the key 'b'")
+	}
+
+	secondaryConn, err := net.Dial("tcp", secondaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer secondaryConn.Close()
+	secondaryReader := bufio.NewReader(secondaryConn)
+
+	// the secondary reports the offset of the last write it applied, with the replication id of its primary
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fmt.Fprintf(secondaryConn, "OFFSET\n")
+		line, _, _ := secondaryReader.ReadLine()
+		if string(line) == replId+" 2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the secondary at offset 2, got %s", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlushIsReplicated(t *testing.T) {
+	primaryConfig := config.ServerConfig{ID: "primary", Address: "localhost:8024", Role: "PRIMARY"}
+	secondaryConfig := config.ServerConfig{ID: "secondary", Address: "localhost:8025", Role: "SECONDARY", Primary: "primary"}
+	cfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}
+
+	_, stopPrimary := startReplicationTestNode(t, cfg, primaryConfig, "")
+	defer stopPrimary()
+	secondaryServer, stopSecondary := startReplicationTestNode(t, cfg, secondaryConfig, primaryConfig.Address)
+	defer stopSecondary()
+
+	clientConn, err := net.Dial("tcp", primaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	fmt.Fprintf(clientConn, "SET a value\n")
+	reader.ReadLine()
+	if !waitForKey(secondaryServer.cache, "a", "value") {
+		t.Fatal("Secondary should have the key 'a'")
+	}
+
+	fmt.Fprintf(clientConn, "FLUSH\n")
+	if line, _, _ := reader.ReadLine(); string(line) != "OK" {
+		t.Fatalf("expected OK, got %s", line)
+	}
+
+	for i := 0; i < 50 && len(secondaryServer.cache.Keys()) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if keys := secondaryServer.cache.Keys(); len(keys) != 0 {
+		t.Errorf("expected the secondary to be flushed, got %v", keys)
+	}
+}
+
+func TestTransactionIsReplicated(t *testing.T) {
+	primaryConfig := config.ServerConfig{ID: "primary", Address: "localhost:8026", Role: "PRIMARY"}
+	secondaryConfig := config.ServerConfig{ID: "secondary", Address: "localhost:8027", Role: "SECONDARY", Primary: "primary"}
+	cfg := &config.Configuration{Servers: []config.ServerConfig{primaryConfig, secondaryConfig}}
+
+	primaryServer, stopPrimary := startReplicationTestNode(t, cfg, primaryConfig, "")
+	defer stopPrimary()
+	secondaryServer, stopSecondary := startReplicationTestNode(t, cfg, secondaryConfig, primaryConfig.Address)
+	defer stopSecondary()
+
+	clientConn, err := net.Dial("tcp", primaryConfig.Address)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	fmt.Fprintf(clientConn, "SET ready yes\n")
+	reader.ReadLine()
+	if !waitForKey(secondaryServer.cache, "ready", "yes") {
+		t.Fatal("Secondary should have the key 'ready'")
+	}
+
+	fmt.Fprintf(clientConn, "MULTI\nSET doc body\nSADD index doc\nINCR docs\nEXEC\n")
+	for _, want := range []string{"OK", "QUEUED", "QUEUED", "QUEUED", "*3", "OK", "1", "1"} {
+		if line, _, _ := reader.ReadLine(); string(line) != want {
+			t.Fatalf("expected %s, got %s", want, line)
+		}
+	}
+
+	// the batch is acknowledged as one write, so the offsets of both sides still match
+	fmt.Fprintf(clientConn, "SET after batch\n")
+	reader.ReadLine()
+	if !waitForKey(secondaryServer.cache, "after", "batch") {
+		t.Fatal("Secondary should receive the writes after the transaction")
+	}
+	if v, _ := secondaryServer.cache.Get("docs"); v != "1" {
+		t.Errorf("expected docs to be 1 on the secondary, got %q", v)
+	}
+
+	for _, key := range []string{"doc", "index", "docs"} {
+		var primary, replica cache.Entry
+		primaryServer.cache.Atomic(func(st cache.Store) { primary, _ = st.Get(key) })
+		secondaryServer.cache.Atomic(func(st cache.Store) { replica, _ = st.Get(key) })
+		if primary.Version == 0 || primary.Version != replica.Version {
+			t.Errorf("expected version %d for %s on the secondary, got %d", primary.Version, key, replica.Version)
+		}
+	}
+	// the secondary moves its offset right after it applies a write
+	position := func(s *Server) string {
+		replId, offset := s.replicator.Offset()
+		return fmt.Sprintf("%s %d", replId, offset)
+	}
+	for i := 0; i < 50 && position(primaryServer) != position(secondaryServer); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if position(primaryServer) != position(secondaryServer) {
+		t.Errorf("expected the positions to match, primary %s, secondary %s", position(primaryServer), position(secondaryServer))
+	}
+}
@@ -2,10 +2,20 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/protocol"
 	"github.com/voukatas/CacheGopher/pkg/replication"
+	"github.com/voukatas/CacheGopher/pkg/sharding"
 )
 
 type MockCache struct {
@@ -20,6 +30,10 @@ func (m *MockCache) Set(key string, value string) {
 	m.SetCalled = true
 }
 
+func (m *MockCache) SetEntry(key string, entry cache.Entry) {
+	m.SetCalled = true
+}
+
 func (m *MockCache) Get(key string) (string, bool) {
 	m.GetCalled = true
 	return "value", true
@@ -38,25 +52,112 @@ func (m *MockCache) Keys() []string {
 	m.KeysCalled = true
 	return []string{"key1", "key2"}
 }
+
+func (m *MockCache) Scan(cursor uint64, count int, match func(key string) bool) ([]string, uint64) {
+	m.KeysCalled = true
+	return []string{"key1", "key2"}, 0
+}
+
 func (m *MockCache) GetSnapshot() map[string]string {
 	return map[string]string{}
 }
 
+func (m *MockCache) RemoveExpired(count int) int {
+	return 0
+}
+
+func (m *MockCache) Atomic(fn func(s cache.Store)) {
+	fn(&mockStore{m})
+}
+
+// mockStore is the view of the MockCache inside Atomic
+type mockStore struct {
+	m *MockCache
+}
+
+func (s *mockStore) Get(key string) (cache.Entry, bool) {
+	value, ok := s.m.Get(key)
+	return cache.Entry{Value: value}, ok
+}
+
+func (s *mockStore) Touch(key string) {
+}
+
+func (s *mockStore) Set(key string, entry cache.Entry) uint64 {
+	s.m.SetCalled = true
+	return 1
+}
+
+func (s *mockStore) Delete(key string) bool {
+	s.m.DeleteCalled = true
+	return false
+}
+
+func (s *mockStore) Flush() {
+}
+
+func (s *mockStore) Keys() []string {
+	return []string{}
+}
+
+func (m *MockCache) SetListener(listener cache.Listener) {
+}
+
 func (lru *MockCache) Lock() {
 }
 
 func (lru *MockCache) Unlock() {
 }
 
+// MockLogger is shared by the connections of a server, so it is safe for concurrent use
 type MockLogger struct {
+	lock          sync.Mutex
 	DebugMessages []string
 	ErrorMessages []string
 }
 
-func (m *MockLogger) Debug(msg string) { m.DebugMessages = append(m.DebugMessages, msg) }
-func (m *MockLogger) Info(msg string)  {}
-func (m *MockLogger) Warn(msg string)  {}
-func (m *MockLogger) Error(msg string) { m.ErrorMessages = append(m.ErrorMessages, msg) }
+func (m *MockLogger) Debug(msg string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.DebugMessages = append(m.DebugMessages, msg)
+}
+func (m *MockLogger) Info(msg string) {}
+func (m *MockLogger) Warn(msg string) {}
+func (m *MockLogger) Error(msg string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ErrorMessages = append(m.ErrorMessages, msg)
+}
+
+// newTestConn connects to the server through a pipe that is closed with the test. send returns the reply of a command,
+// the lines of a *<n> reply are joined with a comma, and sendLines returns the lines of a *<n> reply
+func newTestConn(t *testing.T, server *Server) (func(cmd string) string, func(cmd string) []string) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go server.HandleConnection(serverConn)
+	scanner := bufio.NewScanner(clientConn)
+	scanner.Split(protocol.ScanLines)
+
+	sendLines := func(cmd string) []string {
+		protocol.WriteLine(clientConn, cmd)
+		scanner.Scan()
+		var n int
+		if _, err := fmt.Sscanf(scanner.Text(), "*%d", &n); err != nil {
+			return []string{scanner.Text()}
+		}
+		lines := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			scanner.Scan()
+			lines = append(lines, scanner.Text())
+		}
+		return lines
+	}
+	send := func(cmd string) string {
+		return strings.Join(sendLines(cmd), ",")
+	}
+
+	return send, sendLines
+}
 
 func TestHandleConnection(t *testing.T) {
 	mockCache := &MockCache{}
@@ -107,3 +208,1231 @@ func TestHandleConnection(t *testing.T) {
 		t.Error("Expected info messages to be logged")
 	}
 }
+
+func TestCrossClusterLastWriterWins(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	server.SetClusterId("eu")
+
+	send, _ := newTestConn(t, server)
+
+	if resp := send("SET key local"); resp != "OK" {
+		t.Fatalf("Expected OK, got %s", resp)
+	}
+
+	// a write of the remote cluster from the past loses
+	if resp := send("XSET key 1 us 0 remote"); resp != "STALE" {
+		t.Errorf("Expected STALE, got %s", resp)
+	}
+	if resp := send("GET key"); resp != "local" {
+		t.Errorf("Expected local, got %s", resp)
+	}
+
+	// a newer one wins and keeps its origin
+	future := (uint64(time.Now().Add(time.Hour).UnixMilli()) << 16)
+	if resp := send(fmt.Sprintf("XSET key %d us 0 remote value", future)); resp != "OK" {
+		t.Errorf("Expected OK, got %s", resp)
+	}
+	if resp := send("GET key"); resp != "remote value" {
+		t.Errorf("Expected 'remote value', got %s", resp)
+	}
+	if state := server.CrossClusterState(); len(state) != 0 {
+		t.Errorf("A remote write must not be part of the local state, got %v", state)
+	}
+
+	// the local clock moved after the remote write so a local write wins again
+	send("SET key local again")
+	if state := server.CrossClusterState(); len(state) != 1 || state[0].Timestamp <= future {
+		t.Errorf("Expected the local write to be ordered after the remote one, got %v", state)
+	}
+
+	if resp := send(fmt.Sprintf("XDELETE key %d us", future)); resp != "STALE" {
+		t.Errorf("Expected STALE, got %s", resp)
+	}
+	if resp := send(fmt.Sprintf("XDELETE key %d us", future+(1<<32))); resp != "OK" {
+		t.Errorf("Expected OK, got %s", resp)
+	}
+
+	// a secondary that takes over keeps the timestamps and the origins of the primary
+	send("SET other local")
+	var state strings.Builder
+	server.sendState(&state)
+
+	secondaryCache, _ := cache.NewCache("LRU", 10)
+	secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	secondary.SetClusterId("eu")
+	for _, line := range strings.Split(strings.TrimSpace(state.String()), "\n") {
+		if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if recovered := secondary.CrossClusterState(); !reflect.DeepEqual(recovered, server.CrossClusterState()) {
+		t.Errorf("Expected the secondary to have the same cross cluster state, got %v", recovered)
+	}
+	if secondary.applyRemoteWrite(replication.WriteEvent{Cmd: "SET", Key: "other", Value: "old", Timestamp: 1, Origin: "us"}) {
+		t.Errorf("Expected an old remote write to lose on the secondary")
+	}
+
+	// a remote write keeps its expiration, and so does a local one in the state of the links
+	expiresAt := time.Now().Add(time.Hour).UnixMilli()
+	if resp := send(fmt.Sprintf("XSET ttl %d us %d value", future+(1<<32), expiresAt)); resp != "OK" {
+		t.Errorf("Expected OK, got %s", resp)
+	}
+	if entry, _, _ := server.getString("ttl"); entry.ExpiresAt.UnixMilli() != expiresAt {
+		t.Errorf("Expected the remote write to expire at %d, got %+v", expiresAt, entry)
+	}
+	if resp := send("XSET ttl 1 us soon value"); resp != "ERROR: Invalid expiration time" {
+		t.Errorf("Expected an invalid expiration time, got %s", resp)
+	}
+	send("PSETEX local 60000 value")
+	for _, we := range server.CrossClusterState() {
+		if we.Key == "local" && we.ExpiresAt.IsZero() {
+			t.Errorf("Expected the state of the links to keep the expiration, got %+v", we)
+		}
+	}
+
+	// the links forward only the strings, the collections and FLUSH are rejected once they are enabled
+	send("HSET hash field value")
+	if err := server.EnableCrossCluster(); err == nil {
+		t.Error("Expected the cross cluster replication to be rejected while the cache holds a collection")
+	}
+	send("DELETE hash")
+	if err := server.EnableCrossCluster(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"HSET hash field value", "MULTI", "RPUSH list value", "EXEC"} {
+		send(cmd)
+	}
+	if resp := send("SADD set member"); resp != "ERROR: collections are not supported with cross cluster replication" {
+		t.Errorf("Expected the collection to be rejected, got %s", resp)
+	}
+	if resp := send("FLUSH"); resp != "ERROR: FLUSH is not supported with cross cluster replication" {
+		t.Errorf("Expected FLUSH to be rejected, got %s", resp)
+	}
+	localCache.Atomic(func(st cache.Store) {
+		for _, key := range []string{"hash", "list", "set"} {
+			if _, exists := st.Get(key); exists {
+				t.Errorf("Expected the collection %s to be rejected", key)
+			}
+		}
+		if _, exists := st.Get("other"); !exists {
+			t.Error("Expected FLUSH to be rejected")
+		}
+	})
+}
+
+func TestExpiringKeysAndLocks(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	if resp := send("PSETEX key 100 some value"); resp != "OK" {
+		t.Fatalf("Expected OK, got %s", resp)
+	}
+	if resp := send("GET key"); resp != "some value" {
+		t.Errorf("Expected 'some value', got %s", resp)
+	}
+	if resp := send("PSETEX key soon value"); resp != "ERROR: Invalid expire time" {
+		t.Errorf("Expected an error for the invalid time, got %s", resp)
+	}
+
+	// the state that is sent to a secondary keeps the expiration
+	var state strings.Builder
+	server.sendState(&state)
+	if !strings.HasPrefix(state.String(), "VSET key 1 ") || !strings.HasSuffix(state.String(), " some value\n") {
+		t.Errorf("Unexpected state %q", state.String())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if resp := send("GET key"); resp != "ERROR: Key not found" {
+		t.Errorf("Expected the key to expire, got %s", resp)
+	}
+
+	// a replicated expiration in the past
+	past := time.Now().Add(-time.Second).UnixMilli()
+	if err := server.ApplyReplicated([]string{"PSETEXAT", "old", fmt.Sprintf("%d 1 - value", past)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := send("GET old"); resp != "ERROR: Key not found" {
+		t.Errorf("Expected the replicated key to be expired, got %s", resp)
+	}
+
+	token, err := strconv.ParseUint(send("LOCK key owner1 100"), 10, 64)
+	if err != nil {
+		t.Fatalf("Expected a fencing token, got %v", err)
+	}
+	if resp := send("LOCK key owner2 100"); !strings.HasPrefix(resp, "LOCKED ") {
+		t.Errorf("Expected LOCKED, got %s", resp)
+	}
+	// the holder gets its token again
+	if resp := send("LOCK key owner1 100"); resp != strconv.FormatUint(token, 10) {
+		t.Errorf("Expected the same token %d, got %s", token, resp)
+	}
+	if resp := send("EXTEND key owner2 100"); resp != "ERROR: Lock not held" {
+		t.Errorf("Expected an error for another owner, got %s", resp)
+	}
+	if resp := send("EXTEND key owner1 100"); resp != "OK" {
+		t.Errorf("Expected OK, got %s", resp)
+	}
+	if resp := send("UNLOCK key owner2"); resp != "ERROR: Lock not held" {
+		t.Errorf("Expected an error for another owner, got %s", resp)
+	}
+	if resp := send("UNLOCK key owner1"); resp != "OK" {
+		t.Errorf("Expected OK, got %s", resp)
+	}
+	if resp := send("LOCK key owner1 0"); resp != "ERROR: Invalid lock time" {
+		t.Errorf("Expected an error for a lease of 0, got %s", resp)
+	}
+	if resp := send("LOCK key 100"); resp != "ERROR: Usage: LOCK <name> <owner> <milliseconds>" {
+		t.Errorf("Expected the usage, got %s", resp)
+	}
+
+	// an expired lease is free, it can't be extended and the next holder gets a greater token
+	send("LOCK key owner1 50")
+	time.Sleep(100 * time.Millisecond)
+	if resp := send("EXTEND key owner1 100"); resp != "ERROR: Lock not held" {
+		t.Errorf("Expected the expired lease not to be extended, got %s", resp)
+	}
+	next, err := strconv.ParseUint(send("LOCK key owner2 100"), 10, 64)
+	if err != nil || next <= token {
+		t.Errorf("Expected the expired lease to be granted with a token greater than %d, got %d, %v", token, next, err)
+	}
+	// the sweep drops only the expired leases
+	send("LOCK other owner1 10")
+	time.Sleep(20 * time.Millisecond)
+	server.locks.removeExpired(time.Now())
+	if _, exists := server.locks.leases["other"]; exists || len(server.locks.leases) != 1 {
+		t.Errorf("Expected only the held lease to be kept, got %v", server.locks.leases)
+	}
+}
+
+func TestRecoveryQueueKeepsVersionsAndExpiration(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	server.StopWriteOpsAndEnableQueuedWrites()
+
+	// a FLUSH is queued too, it removes what the recovering primary had before it
+	server.set("flushed", cache.Entry{Value: "value"}, always)
+	server.flush()
+
+	expiresAt := time.Now().Add(time.Hour)
+	server.set("ttl", cache.Entry{Value: "some value", ExpiresAt: expiresAt}, always)
+	stored, _, _ := server.getString("ttl")
+	server.deleteKey("missing")
+	server.set("deleted", cache.Entry{Value: "value"}, always)
+	server.deleteKey("deleted")
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		server.SendQueuedWrites(serverConn)
+		serverConn.Close()
+	}()
+	scanner := bufio.NewScanner(clientConn)
+
+	recoveredCache, _ := cache.NewCache("LRU", 10)
+	recovered := NewServer(recoveredCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	recovered.set("deleted", cache.Entry{Value: "old"}, always)
+	recovered.set("stale", cache.Entry{Value: "old"}, always)
+	for scanner.Scan() {
+		if err := recovered.ApplyReplicated(strings.SplitN(scanner.Text(), " ", 3)); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+	}
+
+	recoveredCache.Atomic(func(st cache.Store) {
+		entry, exists := st.Get("ttl")
+		if !exists || entry.Value != "some value" || entry.Version != stored.Version || entry.ExpiresAt.UnixMilli() != expiresAt.UnixMilli() {
+			t.Errorf("expected the queued write to keep its version and expiration, got %+v", entry)
+		}
+		if _, exists := st.Get("deleted"); exists {
+			t.Errorf("expected the queued delete to be applied")
+		}
+		if _, exists := st.Get("stale"); exists {
+			t.Errorf("expected the queued flush to be applied")
+		}
+		if _, exists := st.Get("flushed"); exists {
+			t.Errorf("expected the write before the flush to be removed")
+		}
+	})
+}
+
+func TestScan(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 100)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	for i := 0; i < 25; i++ {
+		localCache.Set(fmt.Sprintf("key:%02d", i), "value")
+	}
+	localCache.Set("other", "value")
+
+	_, sendLines := newTestConn(t, server)
+
+	seen := map[string]bool{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		lines := sendLines("SCAN " + cursor + " MATCH key:* COUNT 10")
+		if calls > 10 {
+			t.Fatalf("the scan didn't complete, last reply %v", lines)
+		}
+		cursor = lines[0]
+		for _, key := range lines[1:] {
+			seen[key] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 25 || seen["other"] {
+		t.Errorf("expected the 25 matching keys, got %d", len(seen))
+	}
+
+	if keys := sendLines("KEYS key:1*"); len(keys) != 10 {
+		t.Errorf("expected 10 keys, got %v", keys)
+	}
+	if keys := sendLines("KEYS nothing*"); len(keys) != 0 {
+		t.Errorf("expected no keys, got %v", keys)
+	}
+	if keys := sendLines("KEYS"); len(keys) != 26 {
+		t.Errorf("expected every key, got %d", len(keys))
+	}
+
+	for _, cmd := range []string{"SCAN", "SCAN x", "SCAN 0 COUNT 0", "SCAN 0 MATCH [", "SCAN 0 LIMIT 1"} {
+		if lines := sendLines(cmd); !strings.HasPrefix(lines[0], "ERROR: Usage: SCAN") {
+			t.Errorf("%s: expected an error, got %v", cmd, lines)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "any/key", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users:42", false},
+		{"*:42", "user:42", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+	}
+
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.key); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.key, got, test.want)
+		}
+	}
+
+	if validGlob("key[0-9") == nil || validGlob("key[0-9]") != nil {
+		t.Error("expected only the unclosed set to be rejected")
+	}
+}
+
+// recordingReplicator keeps the replicated events
+type recordingReplicator struct {
+	replication.MockReplicator
+	lock   sync.Mutex
+	events []replication.WriteEvent
+}
+
+func (r *recordingReplicator) AddWriteEvent(we replication.WriteEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, we)
+}
+
+// streamLines returns the lines of the replication stream of the events, without the framing
+func streamLines(events []replication.WriteEvent) []string {
+	lines := []string{}
+	for _, we := range events {
+		switch we.Cmd {
+		case "SET":
+			lines = append(lines, replication.VersionedSet(we.Key, we.Version, we.ExpiresAt, we.Timestamp, we.Origin, we.Value))
+		case "DELETE":
+			lines = append(lines, "DELETE "+we.Key)
+		default:
+			lines = append(lines, replication.VersionedWrite(we.Cmd, we.Key, we.Version, we.Timestamp, we.Origin, we.Value))
+		}
+	}
+
+	return lines
+}
+
+func TestCounters(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"INCR counter", "1"},
+		{"INCRBY counter 10", "11"},
+		{"DECR counter", "10"},
+		{"DECRBY counter 15", "-5"},
+		{"INCRBY counter x", "ERROR: Value is not an integer"},
+		{"INCR", "ERROR: Usage: INCR <key>"},
+		{"SET text hello", "OK"},
+		{"INCR text", "ERROR: Value is not an integer"},
+		{"SET big 9223372036854775807", "OK"},
+		{"INCR big", "ERROR: Increment or decrement would overflow"},
+		{"DECRBY big -9223372036854775808", "ERROR: Increment or decrement would overflow"},
+		{"INCRBYFLOAT price 10.5", "10.5"},
+		{"INCRBYFLOAT price -0.25", "10.25"},
+		{"INCRBYFLOAT price NaN", "ERROR: Value is not a valid float"},
+		{"INCRBYFLOAT text 1", "ERROR: Value is not a valid float"},
+		{"GET counter", "-5"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+
+	// the expiration of the key is kept
+	send("PSETEX ttl 100 1")
+	send("INCR ttl")
+	time.Sleep(150 * time.Millisecond)
+	if resp := send("GET ttl"); resp != "ERROR: Key not found" {
+		t.Errorf("expected the counter to expire, got %s", resp)
+	}
+
+	// concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				server.incrBy("concurrent", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := localCache.Get("concurrent"); value != "1000" {
+		t.Errorf("expected 1000, got %s", value)
+	}
+
+	// the increments are replicated as absolute values so applying one twice is harmless
+	replicator.lock.Lock()
+	events := replicator.events
+	replicator.lock.Unlock()
+
+	secondaryCache, _ := cache.NewCache("LRU", 10)
+	secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	for _, we := range events {
+		if we.Key != "counter" {
+			continue
+		}
+		if we.Cmd != "SET" {
+			t.Fatalf("expected a SET, got %s", we.Cmd)
+		}
+		for i := 0; i < 2; i++ {
+			if err := secondary.ApplyReplicated([]string{"SET", we.Key, fmt.Sprintf("%d - %s", we.Timestamp, we.Value)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if value, _ := secondaryCache.Get("counter"); value != "-5" {
+		t.Errorf("expected the secondary to have -5, got %s", value)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"THROTTLE api 2 0.001 1", "ALLOWED 1 0"},
+		{"THROTTLE api 2 0.001 1", "ALLOWED 0 0"},
+		{"THROTTLE api 2 0.001 0", "ALLOWED 0 0"},
+		{"WINDOW login 1 60000 1", "ALLOWED 0 0"},
+		{"THROTTLE api 2 1", "ERROR: Usage: THROTTLE <key> <capacity> <refill-per-second> <cost>"},
+		{"WINDOW login", "ERROR: Usage: WINDOW <key> <limit> <window-milliseconds> <cost>"},
+		{"THROTTLE api 0 1 1", "ERROR: Invalid limit"},
+		{"THROTTLE api 2 -1 1", "ERROR: Invalid rate"},
+		{"WINDOW login 1 1.5 1", "ERROR: Invalid rate"},
+		{"THROTTLE api 2 1 3", "ERROR: Invalid cost, it must be between 0 and the limit"},
+		{"SET text hello", "OK"},
+		{"THROTTLE text 2 1 1", "ERROR: Value is not a rate limit state"},
+		{"RPUSH list a", "1"},
+		{"WINDOW list 1 1000 1", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+	if resp := send("THROTTLE api 2 0.001 1"); !strings.HasPrefix(resp, "DENIED 0 ") {
+		t.Errorf("expected DENIED, got %s", resp)
+	}
+
+	// the state is replicated as a SET that expires
+	replicator.lock.Lock()
+	var replicated []replication.WriteEvent
+	for _, we := range replicator.events {
+		if we.Key == "api" {
+			replicated = append(replicated, we)
+		}
+	}
+	replicator.lock.Unlock()
+	if len(replicated) != 2 || replicated[1].Cmd != "SET" || replicated[1].ExpiresAt.IsZero() {
+		t.Errorf("expected the 2 allowed requests to be replicated as expiring SETs, got %+v", replicated)
+	}
+
+	// the windows are aligned to the unix time, the state must not be expired by the real clock
+	base := time.Now().Truncate(time.Second).Add(time.Second)
+
+	decisions := []struct {
+		after    time.Duration
+		cost     int64
+		expected rateDecision
+	}{
+		{0, 1, rateDecision{allowed: true, remaining: 2}},
+		{0, 1, rateDecision{allowed: true, remaining: 1}},
+		{0, 1, rateDecision{allowed: true, remaining: 0}},
+		{0, 1, rateDecision{remaining: 0, retryAfter: 500 * time.Millisecond}},
+		{250 * time.Millisecond, 1, rateDecision{remaining: 0, retryAfter: 250 * time.Millisecond}},
+		{500 * time.Millisecond, 1, rateDecision{allowed: true, remaining: 0}},
+		{1500 * time.Millisecond, 2, rateDecision{allowed: true, remaining: 0}},
+		// the refill stops at the capacity
+		{time.Hour, 0, rateDecision{allowed: true, remaining: 3}},
+	}
+	for i, d := range decisions {
+		decision, err := server.throttle("bucket", 3, 2, d.cost, base.Add(d.after))
+		if err != nil || decision != d.expected {
+			t.Errorf("throttle %d: expected %+v, got %+v, %v", i, d.expected, decision, err)
+		}
+	}
+
+	decisions = []struct {
+		after    time.Duration
+		cost     int64
+		expected rateDecision
+	}{
+		{0, 1, rateDecision{allowed: true, remaining: 3}},
+		{0, 3, rateDecision{allowed: true, remaining: 0}},
+		// the count of this window must drop out first, 4 weighted by a quarter leaves room for 1
+		{0, 1, rateDecision{remaining: 0, retryAfter: 1250 * time.Millisecond}},
+		{1250 * time.Millisecond, 1, rateDecision{allowed: true, remaining: 0}},
+		{1250 * time.Millisecond, 1, rateDecision{remaining: 0, retryAfter: 250 * time.Millisecond}},
+		{1500 * time.Millisecond, 1, rateDecision{allowed: true, remaining: 0}},
+		// the state of a window that is not the previous one is forgotten
+		{3 * time.Second, 1, rateDecision{allowed: true, remaining: 3}},
+	}
+	for i, d := range decisions {
+		decision, err := server.slidingWindow("window", 4, time.Second, d.cost, base.Add(d.after))
+		if err != nil || decision != d.expected {
+			t.Errorf("slidingWindow %d: expected %+v, got %+v, %v", i, d.expected, decision, err)
+		}
+	}
+
+	// concurrent requests don't take more than the capacity
+	var wg sync.WaitGroup
+	var allowed sync.Map
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if decision, _ := server.throttle("concurrent", 50, 0.001, 1, time.Now()); decision.allowed {
+					allowed.Store(fmt.Sprintf("%d-%d", i, j), true)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	count := 0
+	allowed.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	if count != 50 {
+		t.Errorf("expected 50 allowed requests, got %d", count)
+	}
+}
+
+func TestVersionsAndConditionalWrites(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 10)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"GETS config", "ERROR: Key not found"},
+		{"CAS config 5 value", "CONFLICT"},
+		// version 0 creates the key
+		{"CAS config 0 a b", "1"},
+		{"GETS config", "1 a b"},
+		{"CAS config 0 value", "CONFLICT"},
+		{"CAS config 1 c", "2"},
+		{"CAS config 1 d", "CONFLICT"},
+		{"SET config e", "OK"},
+		{"GETS config", "3 e"},
+		{"CAS config x value", "ERROR: Invalid version"},
+		{"CAS config", "ERROR: Usage: CAS <key> <version> <value>"},
+		{"SETNX config f", "EXISTS"},
+		{"SETXX other f", "ERROR: Key not found"},
+		{"SETNX other value with spaces", "OK"},
+		{"GET other", "value with spaces"},
+		{"SETXX other g", "OK"},
+		{"GETS other", "5 g"},
+		{"SETNX other", "ERROR: Usage: SETNX <key> <value>"},
+		// a plain SET stores the value as it was sent
+		{"SET plain foo XX", "OK"},
+		{"GET plain", "foo XX"},
+		{"SET plain bar NX", "OK"},
+		{"GET plain", "bar NX"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+
+	// the expiration of the key is kept by a CAS
+	send("PSETEX ttl 100 a")
+	send("CAS ttl 6 b")
+	time.Sleep(150 * time.Millisecond)
+	if resp := send("GETS ttl"); resp != "ERROR: Key not found" {
+		t.Errorf("expected the key to expire, got %s", resp)
+	}
+
+	// the writes are replicated with their versions, so the secondary has the same ones
+	replicator.lock.Lock()
+	events := replicator.events
+	replicator.lock.Unlock()
+
+	secondaryCache, _ := cache.NewCache("LRU", 10)
+	secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	for _, we := range events {
+		if we.Version == 0 {
+			t.Fatalf("expected a version in %+v", we)
+		}
+		line := replication.VersionedSet(we.Key, we.Version, we.ExpiresAt, we.Timestamp, we.Origin, we.Value)
+		if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"config", "other"} {
+		var primary, replica cache.Entry
+		localCache.Atomic(func(st cache.Store) { primary, _ = st.Get(key) })
+		secondaryCache.Atomic(func(st cache.Store) { replica, _ = st.Get(key) })
+		if primary.Value != replica.Value || primary.Version != replica.Version {
+			t.Errorf("%s: expected the secondary to have %+v, got %+v", key, primary, replica)
+		}
+	}
+
+	// the full state keeps the versions too
+	var state strings.Builder
+	server.sendState(&state)
+	config, _, _ := server.getString("config")
+	if !strings.Contains(state.String(), fmt.Sprintf("VSET config 3 0 %d - e\n", config.Timestamp)) {
+		t.Errorf("unexpected state %q", state.String())
+	}
+
+	// a value can hold any byte, the lines that carry it are framed
+	for _, value := range []string{"a\nb ", "$5", " \r\x00"} {
+		if resp := send("SET binary " + value); resp != "OK" {
+			t.Errorf("SET %q: expected OK, got %q", value, resp)
+		}
+		if resp := send("GET binary"); resp != value {
+			t.Errorf("GET: expected %q, got %q", value, resp)
+		}
+	}
+}
+
+func TestCollections(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 100)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"HSET user name gopher", "1"},
+		{"HSET user bio likes go and caches", "1"},
+		{"HSET user name gopher2", "0"},
+		{"HGET user bio", "likes go and caches"},
+		{"HGET user age", "ERROR: Key not found"},
+		{"HGETALL user", "bio,likes go and caches,name,gopher2"},
+		{"HDEL user bio age", "1"},
+		{"HGETALL missing", ""},
+		{"HSET user", "ERROR: Usage: HSET <key> <field> <value>"},
+
+		{"RPUSH queue b", "1"},
+		{"RPUSH queue c d", "2"},
+		{"LPUSH queue a", "3"},
+		{"LRANGE queue 0 -1", "a,b,c d"},
+		{"LRANGE queue -2 10", "b,c d"},
+		{"LRANGE queue 5 10", ""},
+		{"LPOP queue", "a"},
+		{"RPOP queue", "c d"},
+		{"RPOP queue", "b"},
+		{"RPOP queue", "ERROR: Key not found"},
+		{"LRANGE queue x 1", "ERROR: Usage: LRANGE <key> <start> <stop>"},
+		{"LRANGE queue 0 1 junk", "ERROR: Usage: LRANGE <key> <start> <stop>"},
+		{"LRANGE queue 0", "ERROR: Usage: LRANGE <key> <start> <stop>"},
+
+		{"SADD tags go cache go", "2"},
+		{"SADD tags go", "0"},
+		{"SISMEMBER tags go", "1"},
+		{"SISMEMBER tags rust", "0"},
+		{"SMEMBERS tags", "cache,go"},
+		{"SREM tags go rust", "1"},
+
+		{"SET text hello", "OK"},
+		{"HSET text name gopher", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LRANGE text 0 -1", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"GET user", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"GETS tags", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"INCR tags", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"CAS tags 0 value", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SADD user name", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		// a SET replaces a value of any type
+		{"SET tags replaced", "OK"},
+		{"GET tags", "replaced"},
+		{"SADD tags a b", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SADD members a b c", "3"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+
+	// an emptied collection is removed
+	if _, exists := localCache.Get("queue"); exists {
+		t.Error("expected the empty list to be removed")
+	}
+
+	// a secondary that applies the replicated writes, or the full state, ends up with the same collections
+	replicator.lock.Lock()
+	events := replicator.events
+	replicator.lock.Unlock()
+
+	stream := streamLines(events)
+
+	var state strings.Builder
+	server.sendState(&state)
+
+	stateLines := strings.Split(strings.TrimSpace(state.String()), "\n")
+	// a new secondary can receive a write both in the state and in the stream, a replayed write is applied once
+	replayed := append(append([]string{}, stateLines...), stream...)
+	for name, lines := range map[string][]string{"stream": stream, "state": stateLines, "state and stream": replayed, "stream twice": append(append([]string{}, stream...), stream...)} {
+		secondaryCache, _ := cache.NewCache("LRU", 100)
+		secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+		for _, line := range lines {
+			if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+				t.Fatalf("%s: %s: %v", name, line, err)
+			}
+		}
+
+		for _, key := range []string{"user", "tags", "members", "queue", "text"} {
+			var primary, replica cache.Entry
+			localCache.Atomic(func(st cache.Store) { primary, _ = st.Get(key) })
+			secondaryCache.Atomic(func(st cache.Store) { replica, _ = st.Get(key) })
+			if !reflect.DeepEqual(primary, replica) {
+				t.Errorf("%s: expected the secondary to have %+v for %s, got %+v", name, primary, key, replica)
+			}
+		}
+	}
+
+	// a replayed push or pop of a list is not applied again
+	secondaryCache, _ := cache.NewCache("LRU", 100)
+	secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	for _, line := range []string{"RPUSH list 7 1 - a", "RPUSH list 7 1 - a", "RPUSH list 8 2 - b", "RPUSH list 9 3 - c", "LPOP list 10 4 -", "LPOP list 10 4 -"} {
+		if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	secondaryCache.Atomic(func(st cache.Store) {
+		if entry, _ := st.Get("list"); !reflect.DeepEqual(entry.List, []string{"b", "c"}) || entry.Version != 10 {
+			t.Errorf("expected the list [b c] with version 10, got %+v", entry)
+		}
+	})
+
+	// a list that was emptied and filled again: the emptying write is replicated as a DELETE, so a new secondary that
+	// receives the later writes both in the state and in the stream doesn't skip any of them
+	overlapCache, _ := cache.NewCache("LRU", 100)
+	overlapReplicator := &recordingReplicator{}
+	overlap := NewServer(overlapCache, &MockLogger{}, overlapReplicator, true, "")
+	sendOverlap, _ := newTestConn(t, overlap)
+	for _, cmd := range []string{"RPUSH list a", "RPOP list", "RPUSH list x", "RPUSH list y"} {
+		sendOverlap(cmd)
+	}
+
+	state.Reset()
+	overlap.sendState(&state)
+	overlapReplicator.lock.Lock()
+	overlapStream := streamLines(overlapReplicator.events)
+	overlapReplicator.lock.Unlock()
+	if overlapStream[1] != "DELETE list" {
+		t.Errorf("expected the emptied list to be replicated as a DELETE, got %q", overlapStream[1])
+	}
+
+	secondaryCache, _ = cache.NewCache("LRU", 100)
+	secondary = NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	for _, line := range append(strings.Split(strings.TrimSpace(state.String()), "\n"), overlapStream...) {
+		if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	var primary, replica cache.Entry
+	overlapCache.Atomic(func(st cache.Store) { primary, _ = st.Get("list") })
+	secondaryCache.Atomic(func(st cache.Store) { replica, _ = st.Get("list") })
+	if !reflect.DeepEqual(primary, replica) || !reflect.DeepEqual(replica.List, []string{"x", "y"}) {
+		t.Errorf("expected the secondary to have %+v, got %+v", primary, replica)
+	}
+}
+
+func TestSortedSets(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 100)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"ZADD board 10 alice 20 bob 15 carol", "3"},
+		{"ZADD board 25 alice 5 dave", "1"},
+		{"ZADD board 5 dave", "0"},
+		{"ZINCRBY board 2.5 carol", "17.5"},
+		{"ZINCRBY board 1 erin", "1"},
+		{"ZRANGE board 0 -1", "erin,dave,carol,bob,alice"},
+		{"ZRANGE board 0 1 WITHSCORES", "erin,1,dave,5"},
+		{"ZREVRANGE board 0 2 WITHSCORES", "alice,25,bob,20,carol,17.5"},
+		{"ZREVRANGE board -1 -1", "erin"},
+		{"ZRANGE board 10 20", ""},
+		{"ZRANGEBYSCORE board 5 20", "dave,carol,bob"},
+		{"ZRANGEBYSCORE board -inf +inf WITHSCORES LIMIT 1 2", "dave,5,carol,17.5"},
+		{"ZRANGEBYSCORE board (5 20", "ERROR: Usage: ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT <offset> <count>]"},
+		{"ZRANK board alice", "4"},
+		{"ZRANK board zed", "ERROR: Key not found"},
+		{"ZSCORE board carol", "17.5"},
+		{"ZREM board erin zed", "1"},
+		{"ZRANGE missing 0 -1", ""},
+		{"ZADD board 1", "ERROR: Usage: ZADD <key> <score> <member> [score member ...]"},
+		{"ZADD board nan x", "ERROR: Usage: ZADD <key> <score> <member> [score member ...]"},
+		{"ZINCRBY board x alice", "ERROR: Usage: ZINCRBY <key> <increment> <member>"},
+		{"ZADD inf +inf a", "1"},
+		{"ZINCRBY inf -inf a", "ERROR: Resulting score is not a number"},
+		{"ZADD tmp 1 a", "1"},
+		{"ZREM tmp a", "1"},
+
+		{"SADD tags go", "1"},
+		{"ZADD tags 1 go", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"ZRANGE tags 0 -1", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SMEMBERS board", "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+
+	// an emptied sorted set is removed
+	if _, exists := localCache.Get("tmp"); exists {
+		t.Error("expected the empty sorted set to be removed")
+	}
+
+	replicator.lock.Lock()
+	events := replicator.events
+	replicator.lock.Unlock()
+
+	// a ZINCRBY is replicated as the new score
+	for _, we := range events {
+		if we.Cmd == "ZINCRBY" {
+			t.Errorf("expected ZINCRBY to be replicated as ZADD, got %+v", we)
+		}
+	}
+	stream := streamLines(events)
+
+	var state strings.Builder
+	server.sendState(&state)
+
+	stateLines := strings.Split(strings.TrimSpace(state.String()), "\n")
+	// a new secondary can receive a write both in the state and in the stream, a replayed write is applied once
+	replayed := append(append([]string{}, stateLines...), stream...)
+	for name, lines := range map[string][]string{"stream": stream, "state": stateLines, "state and stream": replayed, "stream twice": append(append([]string{}, stream...), stream...)} {
+		secondaryCache, _ := cache.NewCache("LRU", 100)
+		secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+		for _, line := range lines {
+			if err := secondary.ApplyReplicated(strings.SplitN(line, " ", 3)); err != nil {
+				t.Fatalf("%s: %s: %v", name, line, err)
+			}
+		}
+
+		for _, key := range []string{"board", "inf", "tmp"} {
+			var primary, replica cache.Entry
+			localCache.Atomic(func(st cache.Store) { primary, _ = st.Get(key) })
+			secondaryCache.Atomic(func(st cache.Store) { replica, _ = st.Get(key) })
+			if primary.Version != replica.Version {
+				t.Errorf("%s: expected version %d for %s, got %d", name, primary.Version, key, replica.Version)
+			}
+			if primary.ZSet == nil {
+				if replica.ZSet != nil {
+					t.Errorf("%s: expected %s to be removed", name, key)
+				}
+				continue
+			}
+			// the skip lists differ in their levels, so the members are compared
+			if replica.ZSet == nil || !reflect.DeepEqual(primary.ZSet.Range(0, -1, false), replica.ZSet.Range(0, -1, false)) {
+				t.Errorf("%s: expected the secondary to have the same members for %s", name, key)
+			}
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 100)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+
+	connect := func() (net.Conn, *bufio.Scanner) {
+		clientConn, serverConn := net.Pipe()
+		go server.HandleConnection(serverConn)
+		return clientConn, bufio.NewScanner(clientConn)
+	}
+	send := func(conn net.Conn, scanner *bufio.Scanner, cmd string) string {
+		conn.Write([]byte(cmd + "\n"))
+		scanner.Scan()
+		return scanner.Text()
+	}
+	expectLine := func(scanner *bufio.Scanner, expected string) {
+		t.Helper()
+		if !scanner.Scan() || scanner.Text() != expected {
+			t.Errorf("expected %q, got %q", expected, scanner.Text())
+		}
+	}
+
+	subConn, subScanner := connect()
+	defer subConn.Close()
+	publisher, pubScanner := connect()
+	defer publisher.Close()
+
+	if resp := send(publisher, pubScanner, "SUBSCRIBE"); resp != "ERROR: Usage: SUBSCRIBE <name> [name ...]" {
+		t.Errorf("unexpected reply to SUBSCRIBE without channels: %q", resp)
+	}
+
+	subConn.Write([]byte("SUBSCRIBE news alerts\n"))
+	expectLine(subScanner, "SUBSCRIBE news 1")
+	expectLine(subScanner, "SUBSCRIBE alerts 2")
+	subConn.Write([]byte("PSUBSCRIBE user:*\n"))
+	expectLine(subScanner, "PSUBSCRIBE user:* 3")
+
+	// only the subscription commands are served in subscriber mode
+	subConn.Write([]byte("GET news\n"))
+	expectLine(subScanner, "ERROR: only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE and PING are allowed in subscriber mode")
+	subConn.Write([]byte("PING\n"))
+	expectLine(subScanner, "PONG")
+
+	if resp := send(publisher, pubScanner, "PUBLISH news hello subscribers"); resp != "1" {
+		t.Errorf("expected 1 receiver, got %q", resp)
+	}
+	expectLine(subScanner, "MESSAGE news hello subscribers")
+	if resp := send(publisher, pubScanner, "PUBLISH user:42 logged in"); resp != "1" {
+		t.Errorf("expected 1 receiver, got %q", resp)
+	}
+	expectLine(subScanner, "PMESSAGE user:* user:42 logged in")
+	if resp := send(publisher, pubScanner, "PUBLISH sports goal"); resp != "0" {
+		t.Errorf("expected no receivers, got %q", resp)
+	}
+
+	subConn.Write([]byte("UNSUBSCRIBE news\n"))
+	expectLine(subScanner, "UNSUBSCRIBE news 2")
+	if resp := send(publisher, pubScanner, "PUBLISH news ignored"); resp != "0" {
+		t.Errorf("expected no receivers after UNSUBSCRIBE, got %q", resp)
+	}
+
+	// a subscriber that doesn't read is dropped once its buffer is full
+	published := 0
+	for i := 0; i < messageBufferSize+10; i++ {
+		if resp := send(publisher, pubScanner, fmt.Sprintf("PUBLISH alerts %d", i)); resp == "0" {
+			break
+		}
+		published++
+	}
+	if published > messageBufferSize+1 {
+		t.Errorf("expected the slow subscriber to be dropped, %d messages were queued", published)
+	}
+
+	// the subscriptions of a dropped subscriber are removed
+	time.Sleep(50 * time.Millisecond)
+	server.pubsub.lock.Lock()
+	defer server.pubsub.lock.Unlock()
+	if len(server.pubsub.channels) != 0 || len(server.pubsub.patterns) != 0 {
+		t.Errorf("expected no subscriptions, got %v and %v", server.pubsub.channels, server.pubsub.patterns)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 2)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+
+	if err := server.SetKeyspaceEvents([]string{"set", "gone"}); err == nil {
+		t.Error("expected an unknown class to fail")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.HandleConnection(serverConn)
+	scanner := bufio.NewScanner(clientConn)
+	expectLine := func(expected string) {
+		t.Helper()
+		if !scanner.Scan() || scanner.Text() != expected {
+			t.Errorf("expected %q, got %q", expected, scanner.Text())
+		}
+	}
+
+	clientConn.Write([]byte("SUBSCRIBE __keyevent__:set __keyevent__:evicted __keyevent__:expired __keyevent__:flush __keyspace__:b\n"))
+	expectLine("SUBSCRIBE __keyevent__:set 1")
+	expectLine("SUBSCRIBE __keyevent__:evicted 2")
+	expectLine("SUBSCRIBE __keyevent__:expired 3")
+	expectLine("SUBSCRIBE __keyevent__:flush 4")
+	expectLine("SUBSCRIBE __keyspace__:b 5")
+
+	// nothing is published by default
+	localCache.Set("ignored", "value")
+	localCache.Delete("ignored")
+
+	if err := server.SetKeyspaceEvents([]string{"evicted", "expired", "flush", "del"}); err != nil {
+		t.Fatal(err)
+	}
+	localCache.Set("a", "a")
+	localCache.Set("b", "b")
+	localCache.Set("c", "c") // evicts a
+	expectLine("MESSAGE __keyevent__:evicted a")
+
+	localCache.Delete("b")
+	expectLine("MESSAGE __keyspace__:b del")
+
+	localCache.SetEntry("d", cache.Entry{Value: "d", ExpiresAt: time.Now().Add(-time.Second)})
+	localCache.RemoveExpired(10)
+	expectLine("MESSAGE __keyevent__:expired d")
+
+	localCache.Flush()
+	expectLine("MESSAGE __keyevent__:flush *")
+
+	// the sets are published once they are enabled
+	if err := server.SetKeyspaceEvents([]string{"all"}); err != nil {
+		t.Fatal(err)
+	}
+	localCache.Set("b", "b")
+	expectLine("MESSAGE __keyspace__:b set")
+	expectLine("MESSAGE __keyevent__:set b")
+}
+
+func TestTransactions(t *testing.T) {
+	localCache, _ := cache.NewCache("LRU", 100)
+	replicator := &recordingReplicator{}
+	server := NewServer(localCache, &MockLogger{}, replicator, true, "")
+
+	send, _ := newTestConn(t, server)
+	other, _ := newTestConn(t, server)
+
+	tests := []struct {
+		send     func(string) string
+		cmd      string
+		expected string
+	}{
+		{send, "MULTI", "OK"},
+		{send, "SET doc body", "QUEUED"},
+		{send, "SADD index doc", "QUEUED"},
+		{send, "INCR docs", "QUEUED"},
+		{send, "GET doc", "QUEUED"},
+		{send, "LPOP index", "QUEUED"},
+		// the other connections don't see the queued writes
+		{other, "GET doc", "ERROR: Key not found"},
+		{send, "EXEC", "OK,1,1,body,ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{other, "GET doc", "body"},
+
+		// a change of a watched key aborts the transaction
+		{send, "WATCH doc missing", "OK"},
+		{other, "SET doc changed", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "SET doc mine", "QUEUED"},
+		{send, "EXEC", "ABORTED"},
+		{send, "GET doc", "changed"},
+		// a key that is created after WATCH changed too
+		{send, "WATCH missing", "OK"},
+		{other, "SET missing now", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "EXEC", "ABORTED"},
+		// so is a key that is created and deleted after WATCH
+		{send, "WATCH gone", "OK"},
+		{other, "SET gone for now", "OK"},
+		{other, "DELETE gone", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "SET gone mine", "QUEUED"},
+		{send, "EXEC", "ABORTED"},
+		{send, "GET gone", "ERROR: Key not found"},
+		// a missing key that stays untouched doesn't abort
+		{send, "WATCH gone", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "SET gone mine", "QUEUED"},
+		{send, "EXEC", "OK"},
+		// EXEC forgets the watched keys
+		{other, "SET doc again", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "EXEC", ""},
+		{send, "WATCH doc", "OK"},
+		{send, "UNWATCH", "OK"},
+		{other, "SET doc unwatched", "OK"},
+		{send, "MULTI", "OK"},
+		{send, "DELETE doc", "QUEUED"},
+		{send, "EXEC", "OK"},
+
+		// a rejected command discards the transaction
+		{send, "MULTI", "OK"},
+		{send, "SET doc", "ERROR: Usage: SET <key> <value>"},
+		{send, "FLUSH", "ERROR: FLUSH can't be used in a transaction"},
+		{send, "SET doc queued", "QUEUED"},
+		{send, "EXEC", "ERROR: EXECABORT Transaction discarded because of previous errors"},
+		{send, "GET doc", "ERROR: Key not found"},
+
+		{send, "MULTI", "OK"},
+		{send, "MULTI", "ERROR: MULTI calls can't be nested"},
+		{send, "WATCH doc", "ERROR: WATCH inside MULTI is not allowed"},
+		{send, "SET doc discarded", "QUEUED"},
+		{send, "DISCARD", "OK"},
+		{send, "GET doc", "ERROR: Key not found"},
+		{send, "EXEC", "ERROR: EXEC without MULTI"},
+		{send, "DISCARD", "ERROR: DISCARD without MULTI"},
+
+		// the conditional writes are separate commands, a SET keeps its value as it was sent
+		{send, "MULTI", "OK"},
+		{send, "SET doc foo XX", "QUEUED"},
+		{send, "SETNX doc bar", "QUEUED"},
+		{send, "SETXX doc baz", "QUEUED"},
+		{send, "GET doc", "QUEUED"},
+		{send, "EXEC", "OK,EXISTS,OK,baz"},
+	}
+
+	for _, tt := range tests {
+		if resp := tt.send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+
+	replicator.lock.Lock()
+	events := replicator.events
+	replicator.lock.Unlock()
+
+	// the writes of the first transaction are replicated as one batch, the failed LPOP isn't part of it
+	var batch []replication.WriteEvent
+	for _, we := range events {
+		if we.Cmd == "MULTI" {
+			batch = we.Batch
+			break
+		}
+		t.Errorf("expected the transaction to be replicated first, got %+v", we)
+	}
+	cmds := []string{}
+	for _, we := range batch {
+		cmds = append(cmds, we.Cmd+" "+we.Key)
+	}
+	if expected := []string{"SET doc", "SADD index", "SET docs"}; !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("expected the batch %v, got %v", expected, cmds)
+	}
+
+	secondaryCache, _ := cache.NewCache("LRU", 100)
+	secondary := NewServer(secondaryCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	if err := secondary.ApplyReplicatedBatch([][]string{
+		strings.SplitN(replication.VersionedSet(batch[0].Key, batch[0].Version, batch[0].ExpiresAt, batch[0].Timestamp, batch[0].Origin, batch[0].Value), " ", 3),
+		strings.SplitN(replication.VersionedWrite(batch[1].Cmd, batch[1].Key, batch[1].Version, batch[1].Timestamp, batch[1].Origin, batch[1].Value), " ", 3),
+		strings.SplitN(replication.VersionedSet(batch[2].Key, batch[2].Version, batch[2].ExpiresAt, batch[2].Timestamp, batch[2].Origin, batch[2].Value), " ", 3),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := secondaryCache.Get("docs"); v != "1" {
+		t.Errorf("expected docs to be 1 on the secondary, got %q", v)
+	}
+	if err := secondary.ApplyReplicatedBatch([][]string{{"FLUSH"}}); err == nil {
+		t.Error("expected a FLUSH in a batch to fail")
+	}
+}
+
+func TestMultiKeyCommandsStayOnTheShard(t *testing.T) {
+	cfg := &config.Configuration{Servers: []config.ServerConfig{
+		{ID: "shard1", Address: "localhost:31337", Role: "PRIMARY"},
+		{ID: "shard2", Address: "localhost:31338", Role: "PRIMARY"},
+		{ID: "secondary", Address: "localhost:31339", Role: "SECONDARY", Primary: "shard1"},
+	}}
+	localCache, _ := cache.NewCache("LRU", 100)
+	server := NewServer(localCache, &MockLogger{}, &replication.MockReplicator{}, true, "")
+	server.SetShards(cfg, "localhost:31337")
+
+	// a tag that lives on this shard and one that doesn't
+	ring := sharding.NewRing([]string{"localhost:31337", "localhost:31338"})
+	own, other := "", ""
+	for i := 0; own == "" || other == ""; i++ {
+		tag := strconv.Itoa(i)
+		if ring.Owner(tag) == sharding.Hash("localhost:31337") {
+			own = tag
+		} else {
+			other = tag
+		}
+	}
+
+	send, _ := newTestConn(t, server)
+
+	crossShard := func(key string) string {
+		return "ERROR: CROSSSHARD Key " + key + " belongs to another shard, use a {tag} to keep the keys together"
+	}
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"WATCH user:{" + own + "}:profile user:{" + own + "}:settings", "OK"},
+		{"WATCH user:{" + own + "}:profile user:{" + other + "}:settings", crossShard("user:{" + other + "}:settings")},
+		{"MULTI", "OK"},
+		{"SET user:{" + own + "}:profile alice", "QUEUED"},
+		{"SADD user:{" + own + "}:groups admins", "QUEUED"},
+		{"SET user:{" + other + "}:profile bob", crossShard("user:{" + other + "}:profile")},
+		{"EXEC", "ERROR: EXECABORT Transaction discarded because of previous errors"},
+		// the single key commands are not checked, the clients send them to the right primary
+		{"SET user:{" + other + "}:profile bob", "OK"},
+	}
+
+	for _, tt := range tests {
+		if resp := send(tt.cmd); resp != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.expected, resp)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/config"
+	"github.com/voukatas/CacheGopher/pkg/sharding"
+)
+
+// SetShards tells the server the topology of cfg, where the clients place the keys. The multi-key commands, WATCH
+// and the commands of a transaction, are then limited to the keys of its own shard. own is the address of the primary
+// of the shard, the server itself or the primary of a secondary. Without it every key is accepted
+func (s *Server) SetShards(cfg *config.Configuration, own string) {
+	primaries := []string{}
+	for _, server := range cfg.Servers {
+		if strings.ToUpper(server.Role) == "PRIMARY" {
+			primaries = append(primaries, server.Address)
+		}
+	}
+
+	s.ring = sharding.NewRing(primaries)
+	s.shard = sharding.Hash(own)
+}
+
+// checkOwned fails for the first key that lives on another shard
+func (s *Server) checkOwned(keys ...string) error {
+	if s.ring == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if s.ring.Owner(key) != s.shard {
+			return fmt.Errorf("CROSSSHARD Key %s belongs to another shard, use a {tag} to keep the keys together", key)
+		}
+	}
+
+	return nil
+}
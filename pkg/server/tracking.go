@@ -0,0 +1,184 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/voukatas/CacheGopher/pkg/protocol"
+)
+
+// The tracking of client side caches. A client opens a dedicated connection with INVALIDATIONS <id> and enables the
+// tracking on its data connections with TRACKING <id>. Every key that is read through a tracked connection is remembered
+// and when it changes (set, delete, eviction, expiration) an INVALIDATE <key> line is pushed to the dedicated connection.
+// The tracking of a key is removed when the invalidation is sent, the next read tracks it again.
+
+// the number of invalidations that can wait for a slow client before its connection is dropped
+const invalidationBufferSize = 1000
+
+// pushConn is a connection that the server pushes lines to from other goroutines. The lines are queued and written by
+// run, a client that lets the queue fill up is dropped
+type pushConn struct {
+	conn      net.Conn
+	out       chan string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPushConn(conn net.Conn, size int) *pushConn {
+	return &pushConn{
+		conn: conn,
+		out:  make(chan string, size),
+		done: make(chan struct{}),
+	}
+}
+
+func (p *pushConn) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// push never blocks, the cache lock might be held by the caller. It reports false if the line was not queued
+func (p *pushConn) push(line string) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	select {
+	case p.out <- line:
+		return true
+	default:
+		p.close()
+		return false
+	}
+}
+
+// run writes the queued lines until the connection is closed
+func (p *pushConn) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case line := <-p.out:
+			if err := protocol.WriteLine(p.conn, line); err != nil {
+				p.close()
+				return
+			}
+		}
+	}
+}
+
+// an invalidation subscriber that lost invalidations can't trust its cache anymore, dropping the connection tells it
+// to flush it
+type invalidationSubscriber struct {
+	id string
+	*pushConn
+}
+
+type tracker struct {
+	lock        sync.Mutex
+	subscribers map[string]*invalidationSubscriber
+	// key -> ids of the clients that read it
+	keys map[string]map[string]struct{}
+	// fast path for the servers without tracking clients, the listener of the cache is called on every write
+	active atomic.Bool
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		subscribers: make(map[string]*invalidationSubscriber),
+		keys:        make(map[string]map[string]struct{}),
+	}
+}
+
+func (t *tracker) subscribe(id string, conn net.Conn) *invalidationSubscriber {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if old, exists := t.subscribers[id]; exists {
+		old.close()
+	}
+
+	sub := &invalidationSubscriber{id: id, pushConn: newPushConn(conn, invalidationBufferSize)}
+	t.subscribers[id] = sub
+	t.active.Store(true)
+
+	return sub
+}
+
+func (t *tracker) unsubscribe(sub *invalidationSubscriber) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sub.close()
+
+	if current, exists := t.subscribers[sub.id]; !exists || current != sub {
+		return
+	}
+	delete(t.subscribers, sub.id)
+
+	for key, ids := range t.keys {
+		delete(ids, sub.id)
+		if len(ids) == 0 {
+			delete(t.keys, key)
+		}
+	}
+
+	t.active.Store(len(t.subscribers) > 0)
+}
+
+// track must be called before the key is read, so a write that happens in between is not missed
+func (t *tracker) track(key string, id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, exists := t.subscribers[id]; !exists {
+		return
+	}
+
+	ids, exists := t.keys[key]
+	if !exists {
+		ids = make(map[string]struct{})
+		t.keys[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (t *tracker) invalidate(key string) {
+	if !t.active.Load() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ids, exists := t.keys[key]
+	if !exists {
+		return
+	}
+	delete(t.keys, key)
+
+	for id := range ids {
+		if sub, exists := t.subscribers[id]; exists {
+			sub.push("INVALIDATE " + key)
+		}
+	}
+}
+
+func (t *tracker) invalidateAll() {
+	if !t.active.Load() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.keys = make(map[string]map[string]struct{})
+	for _, sub := range t.subscribers {
+		sub.push("INVALIDATEALL")
+	}
+}
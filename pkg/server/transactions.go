@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/replication"
+)
+
+// Transactions. After MULTI the commands of a connection are queued, each is answered with QUEUED, and EXEC runs them
+// under one lock of the cache so no other command sees a part of them. EXEC replies with a *<n> header and a reply
+// line per command, a command that fails doesn't undo the others. The writes are replicated as one batch that the
+// secondaries apply at once. WATCH <key> [key ...] before MULTI makes EXEC reply ABORTED without running anything if
+// one of the keys changed in the meantime, the versions of the keys tell. A missing key has no version, a key that was
+// missing when it was watched aborts EXEC if any key of the cache was removed in the meantime, since it might have
+// been written and removed again.
+
+// txControlCommands are the commands that are not queued after MULTI
+var txControlCommands = map[string]struct{}{
+	"MULTI":   {},
+	"EXEC":    {},
+	"DISCARD": {},
+	"WATCH":   {},
+	"UNWATCH": {},
+	"EXIT":    {},
+}
+
+// txOp runs a queued command while the lock of the cache is held and returns its reply line
+type txOp func(st cache.Store, sink eventSink) string
+
+// transaction is the MULTI and WATCH state of a connection
+type transaction struct {
+	// the state of the watched keys when they were watched
+	watched map[string]watchedKey
+	// set by MULTI, the commands wait in queued until EXEC
+	multi  bool
+	queued []txOp
+	// a command that was rejected while it was queued discards the transaction on EXEC
+	failed bool
+}
+
+// watchedKey is the version of a watched key, zero for a missing key, and the removals of the cache when it was watched
+type watchedKey struct {
+	version  uint64
+	removals uint64
+}
+
+// changed reports whether the key was written or, if it was missing, whether it might have been written and removed
+func (w watchedKey) changed(entry cache.Entry, removals uint64) bool {
+	return entry.Version != w.version || (w.version == 0 && removals != w.removals)
+}
+
+// reset ends the transaction and forgets the watched keys, after EXEC or DISCARD
+func (tx *transaction) reset() {
+	*tx = transaction{}
+}
+
+// batchSink collects the write events of a transaction, they are replicated together
+type batchSink struct {
+	events []replication.WriteEvent
+}
+
+func (b *batchSink) AddWriteEvent(we replication.WriteEvent) {
+	b.events = append(b.events, we)
+}
+
+// watch remembers the current versions of the keys
+func (s *Server) watch(tx *transaction, keys []string) {
+	if tx.watched == nil {
+		tx.watched = make(map[string]watchedKey)
+	}
+
+	s.cache.Atomic(func(st cache.Store) {
+		for _, key := range keys {
+			entry, _ := st.Get(key)
+			tx.watched[key] = watchedKey{version: entry.Version, removals: s.removals}
+		}
+	})
+}
+
+// queue parses a command after MULTI and queues it, it returns the reply to the command. A key of another shard is
+// rejected, the primaries don't coordinate
+func (s *Server) queue(tx *transaction, cmd []string) string {
+	op, err := s.parseTxCommand(cmd)
+	if err == nil {
+		err = s.checkOwned(cmd[1])
+	}
+	if err != nil {
+		tx.failed = true
+		return "ERROR: " + err.Error()
+	}
+
+	tx.queued = append(tx.queued, op)
+
+	return "QUEUED"
+}
+
+// parseTxCommand checks the arguments of a command that can run in a transaction, the writes of the strings, the
+// counters and the collections and GET
+func (s *Server) parseTxCommand(cmd []string) (txOp, error) {
+	switch cmd[0] {
+	case "SET", "SETNX", "SETXX":
+		if len(cmd) != 3 {
+			return nil, fmt.Errorf("Usage: %s <key> <value>", cmd[0])
+		}
+		condition := setConditions[cmd[0]]
+		return func(st cache.Store, sink eventSink) string {
+			if s.setLocked(st, sink, cmd[1], cache.Entry{Value: cmd[2], Timestamp: s.clock.Now(), Origin: s.clusterId}, condition) {
+				return "OK"
+			}
+			if condition == ifAbsent {
+				return "EXISTS"
+			}
+			return "ERROR: Key not found"
+		}, nil
+
+	case "GET":
+		if len(cmd) != 2 {
+			return nil, errors.New("Usage: GET <key>")
+		}
+		return func(st cache.Store, sink eventSink) string {
+			entry, exists, err := getStringLocked(st, cmd[1])
+			if err != nil {
+				return "ERROR: " + err.Error()
+			}
+			if !exists {
+				return "ERROR: Key not found"
+			}
+			return entry.Value
+		}, nil
+
+	case "DELETE":
+		if len(cmd) != 2 {
+			return nil, errors.New("Usage: DELETE <key>")
+		}
+		return func(st cache.Store, sink eventSink) string {
+			if s.deleteLocked(st, sink, cmd[1]) {
+				return "OK"
+			}
+			return "ERROR: Key not found"
+		}, nil
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		delta, err := parseIncrBy(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return func(st cache.Store, sink eventSink) string {
+			value, err := s.incrByLocked(st, sink, cmd[1], delta)
+			if err != nil {
+				return "ERROR: " + err.Error()
+			}
+			return strconv.FormatInt(value, 10)
+		}, nil
+	}
+
+	if _, ok := collectionUsage[cmd[0]]; ok {
+		args := ""
+		if len(cmd) == 3 {
+			args = cmd[2]
+		}
+		parsed, ok := parseCollectionArgs(cmd[0], args)
+		if len(cmd) < 2 || !ok {
+			return nil, errors.New("Usage: " + collectionUsage[cmd[0]])
+		}
+		return func(st cache.Store, sink eventSink) string {
+			reply, err := s.writeCollectionLocked(st, sink, cmd[0], cmd[1], args, parsed)
+			if err != nil {
+				return "ERROR: " + err.Error()
+			}
+			return reply
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%s can't be used in a transaction", cmd[0])
+}
+
+// exec runs the queued commands under one lock of the cache and replicates their writes as one batch. It returns
+// the replies and false, without running anything, if a watched key changed
+func (s *Server) exec(tx *transaction) ([]string, bool) {
+	var replies []string
+	aborted := false
+
+	s.cache.Atomic(func(st cache.Store) {
+		for key, watched := range tx.watched {
+			if entry, _ := st.Get(key); watched.changed(entry, s.removals) {
+				aborted = true
+				return
+			}
+		}
+
+		batch := &batchSink{}
+		replies = make([]string, 0, len(tx.queued))
+		for _, op := range tx.queued {
+			replies = append(replies, op(st, batch))
+		}
+
+		if len(batch.events) > 0 {
+			last := batch.events[len(batch.events)-1]
+			s.replicator.AddWriteEvent(replication.WriteEvent{Cmd: "MULTI", Batch: batch.events, Timestamp: last.Timestamp, Origin: s.clusterId})
+		}
+	})
+
+	return replies, !aborted
+}
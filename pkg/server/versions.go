@@ -0,0 +1,158 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+	"github.com/voukatas/CacheGopher/pkg/replication"
+)
+
+// setCondition is the condition of a SET, SETNX or SETXX
+type setCondition int
+
+const (
+	always setCondition = iota
+	// SETNX, only if the key doesn't exist
+	ifAbsent
+	// SETXX, only if the key exists
+	ifPresent
+)
+
+// setConditions are the conditions of the commands that store a string, the value is always taken as it was sent
+var setConditions = map[string]setCondition{
+	"SET":   always,
+	"SETNX": ifAbsent,
+	"SETXX": ifPresent,
+}
+
+// eventSink receives the write events of the local writes, the replicator or the batch of a transaction
+type eventSink interface {
+	AddWriteEvent(we replication.WriteEvent)
+}
+
+// set stores the entry if the condition holds, it reports if the entry was stored
+func (s *Server) set(key string, entry cache.Entry, condition setCondition) bool {
+	stored := false
+
+	s.cache.Atomic(func(st cache.Store) {
+		stored = s.setLocked(st, s.replicator, key, entry, condition)
+	})
+
+	return stored
+}
+
+// setLocked is set while the lock of the cache is held
+func (s *Server) setLocked(st cache.Store, sink eventSink, key string, entry cache.Entry, condition setCondition) bool {
+	_, exists := st.Get(key)
+	if (condition == ifAbsent && exists) || (condition == ifPresent && !exists) {
+		return false
+	}
+
+	s.storeEntry(st, sink, key, entry)
+
+	return true
+}
+
+// getString returns the entry of a key that holds a string and marks it as recently used
+func (s *Server) getString(key string) (cache.Entry, bool, error) {
+	var entry cache.Entry
+	exists := false
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		entry, exists, err = getStringLocked(st, key)
+	})
+
+	return entry, exists, err
+}
+
+// getStringLocked is getString while the lock of the cache is held
+func getStringLocked(st cache.Store, key string) (cache.Entry, bool, error) {
+	entry, exists := st.Get(key)
+	if !exists {
+		return entry, false, nil
+	}
+	if entry.Kind != cache.KindString {
+		return entry, true, errWrongType
+	}
+
+	st.Touch(key)
+
+	return entry, true, nil
+}
+
+// compareAndSet stores the value only if the current version of the key is version, zero for a key that doesn't
+// exist. The expiration of the key is kept. It returns the new version and false on a mismatch
+func (s *Server) compareAndSet(key string, version uint64, value string) (uint64, bool, error) {
+	var stored uint64
+	swapped := false
+	var err error
+
+	s.cache.Atomic(func(st cache.Store) {
+		current, exists := st.Get(key)
+		if exists && current.Kind != cache.KindString {
+			err = errWrongType
+			return
+		}
+		if current.Version != version {
+			return
+		}
+
+		stored = s.storeEntry(st, s.replicator, key, cache.Entry{Value: value, Timestamp: s.clock.Now(), Origin: s.clusterId, ExpiresAt: current.ExpiresAt})
+		swapped = true
+	})
+
+	return stored, swapped, err
+}
+
+// storeEntry stores a local write and replicates it with the version that the cache assigned. The event is added
+// while the lock of the cache is held, so the secondaries apply the writes of a key in the same order
+func (s *Server) storeEntry(st cache.Store, sink eventSink, key string, entry cache.Entry) uint64 {
+	version := st.Set(key, entry)
+	sink.AddWriteEvent(replication.WriteEvent{Key: key, Value: entry.Value, Cmd: "SET", Timestamp: entry.Timestamp, Origin: entry.Origin, ExpiresAt: entry.ExpiresAt, Version: version})
+
+	// the recovery log keeps the version, the expiration and the timestamp like the replication stream
+	s.IsRecovering(strings.SplitN(replication.VersionedSet(key, version, entry.ExpiresAt, entry.Timestamp, entry.Origin, entry.Value), " ", 3))
+
+	return version
+}
+
+// deleteKey removes a key and replicates the removal, it reports false if the key doesn't exist
+func (s *Server) deleteKey(key string) bool {
+	deleted := false
+	s.cache.Atomic(func(st cache.Store) {
+		deleted = s.deleteLocked(st, s.replicator, key)
+	})
+
+	return deleted
+}
+
+// deleteLocked is deleteKey while the lock of the cache is held
+func (s *Server) deleteLocked(st cache.Store, sink eventSink, key string) bool {
+	if !st.Delete(key) {
+		return false
+	}
+
+	sink.AddWriteEvent(replication.WriteEvent{Key: key, Cmd: "DELETE", Timestamp: s.clock.Now(), Origin: s.clusterId})
+	s.IsRecovering([]string{"DELETE", key})
+
+	return true
+}
+
+// flush removes every key and replicates the FLUSH while the lock of the cache is held, like any other write, so the
+// secondaries receive it in the same order as the writes around it
+func (s *Server) flush() error {
+	var err error
+	s.cache.Atomic(func(st cache.Store) {
+		// a FLUSH can't be forwarded to the other clusters, it would remove their own writes too
+		if s.crossCluster {
+			err = errCrossClusterFlush
+			return
+		}
+		st.Flush()
+		s.replicator.AddWriteEvent(replication.WriteEvent{Cmd: "FLUSH", Timestamp: s.clock.Now(), Origin: s.clusterId})
+		s.IsRecovering([]string{"FLUSH"})
+	})
+
+	return err
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/voukatas/CacheGopher/pkg/cache"
+)
+
+// parseScore parses a score of a sorted set, -inf and +inf are valid and NaN is not
+func parseScore(arg string) (float64, error) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("invalid score: " + arg)
+	}
+
+	return score, nil
+}
+
+// formatScore formats a score with the fewest digits that parse back to the same score
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// zrangeArgs are the arguments of ZRANGE, ZREVRANGE and ZRANGEBYSCORE after the key
+type zrangeArgs struct {
+	start, stop int
+	min, max    float64
+	withScores  bool
+	// LIMIT of ZRANGEBYSCORE, a count below 1 returns all the members after the offset
+	offset, count int
+}
+
+// parseZRangeArgs parses <start> <stop> [WITHSCORES]
+func parseZRangeArgs(args string) (zrangeArgs, bool) {
+	var parsed zrangeArgs
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 {
+		return parsed, false
+	}
+
+	var err1, err2 error
+	parsed.start, err1 = strconv.Atoi(fields[0])
+	parsed.stop, err2 = strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return parsed, false
+	}
+	if len(fields) == 3 {
+		if !strings.EqualFold(fields[2], "WITHSCORES") {
+			return parsed, false
+		}
+		parsed.withScores = true
+	}
+
+	return parsed, true
+}
+
+// parseZRangeByScoreArgs parses <min> <max> [WITHSCORES] [LIMIT <offset> <count>]
+func parseZRangeByScoreArgs(args string) (zrangeArgs, bool) {
+	var parsed zrangeArgs
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return parsed, false
+	}
+
+	var err1, err2 error
+	parsed.min, err1 = parseScore(fields[0])
+	parsed.max, err2 = parseScore(fields[1])
+	if err1 != nil || err2 != nil {
+		return parsed, false
+	}
+
+	rest := fields[2:]
+	if len(rest) > 0 && strings.EqualFold(rest[0], "WITHSCORES") {
+		parsed.withScores = true
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return parsed, true
+	}
+	if len(rest) != 3 || !strings.EqualFold(rest[0], "LIMIT") {
+		return parsed, false
+	}
+	parsed.offset, err1 = strconv.Atoi(rest[1])
+	parsed.count, err2 = strconv.Atoi(rest[2])
+
+	return parsed, err1 == nil && err2 == nil && parsed.offset >= 0
+}
+
+// zmemberLines returns the members, each followed by its score with scores
+func zmemberLines(members []cache.ZMember, withScores bool) []string {
+	lines := make([]string, 0, len(members))
+	for _, member := range members {
+		lines = append(lines, member.Member)
+		if withScores {
+			lines = append(lines, formatScore(member.Score))
+		}
+	}
+
+	return lines
+}
+
+// zrange returns the members of a sorted set from start to stop by rank, both included. A negative index counts
+// from the end and with reverse the ranks count from the highest score
+func (s *Server) zrange(key string, start int, stop int, reverse bool) ([]cache.ZMember, error) {
+	members := []cache.ZMember{}
+	_, err := s.readCollection(key, cache.KindZSet, func(entry cache.Entry) {
+		members = entry.ZSet.Range(start, stop, reverse)
+	})
+
+	return members, err
+}
+
+// zrangeByScore returns the members of a sorted set with a score from min to max, both included
+func (s *Server) zrangeByScore(key string, min float64, max float64, offset int, count int) ([]cache.ZMember, error) {
+	members := []cache.ZMember{}
+	_, err := s.readCollection(key, cache.KindZSet, func(entry cache.Entry) {
+		members = entry.ZSet.RangeByScore(min, max, offset, count)
+	})
+
+	return members, err
+}
+
+// zrank returns the rank of a member of a sorted set in ascending order, starting from zero
+func (s *Server) zrank(key string, member string) (int, error) {
+	rank, found := 0, false
+	exists, err := s.readCollection(key, cache.KindZSet, func(entry cache.Entry) {
+		rank, found = entry.ZSet.Rank(member)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !exists || !found {
+		return 0, errKeyNotFound
+	}
+
+	return rank, nil
+}
+
+// zscore returns the score of a member of a sorted set
+func (s *Server) zscore(key string, member string) (float64, error) {
+	score, found := 0.0, false
+	exists, err := s.readCollection(key, cache.KindZSet, func(entry cache.Entry) {
+		score, found = entry.ZSet.Score(member)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !exists || !found {
+		return 0, errKeyNotFound
+	}
+
+	return score, nil
+}
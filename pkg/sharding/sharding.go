@@ -0,0 +1,72 @@
+package sharding
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// The placement of the keys on the primaries. A primary has a position on a ring, the hash of its address, and a key
+// belongs to the first primary at or after the hash of the key. The client and the servers place the keys the same way.
+
+// HashTag returns the part of the key that is hashed. If the key contains a {tag} with at least one character only the
+// tag is hashed, so user:{42}:profile and user:{42}:settings live on the same primary. Only the first { and the first }
+// after it count, a key without a tag is hashed whole
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
+
+// Hash is the position of a string on the ring
+func Hash(s string) uint32 {
+	hash := sha1.New()
+	hash.Write([]byte(s))
+	// common practice to use 32-bit, also performs faster in calculations
+	return binary.BigEndian.Uint32(hash.Sum(nil)[:4])
+}
+
+// KeyHash is the position of a key on the ring
+func KeyHash(key string) uint32 {
+	return Hash(HashTag(key))
+}
+
+// Ring is the positions of the primaries, it answers which one owns a key
+type Ring struct {
+	hashes []uint32
+}
+
+// NewRing places the primaries by their addresses
+func NewRing(addresses []string) *Ring {
+	hashes := make([]uint32, 0, len(addresses))
+	for _, address := range addresses {
+		hashes = append(hashes, Hash(address))
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	return &Ring{hashes: hashes}
+}
+
+// Owner returns the position of the primary that owns the key
+func (r *Ring) Owner(key string) uint32 {
+	keyHash := KeyHash(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= keyHash
+	})
+
+	// past the last primary the ring starts over
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+
+	return r.hashes[idx]
+}
@@ -0,0 +1,47 @@
+package sharding
+
+import "testing"
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"user:{42}:profile", "42"},
+		{"user:{42}:settings", "42"},
+		{"{42}", "42"},
+		{"plain", "plain"},
+		// an empty tag or one that isn't closed hashes the whole key
+		{"user:{}:profile", "user:{}:profile"},
+		{"user:{42", "user:{42"},
+		{"user:}42{", "user:}42{"},
+		// only the first { and the first } after it count
+		{"{a}{b}", "a"},
+		{"x{a{b}c}", "a{b"},
+	}
+
+	for _, tt := range tests {
+		if tag := HashTag(tt.key); tag != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.key, tt.expected, tag)
+		}
+	}
+}
+
+func TestRingPlacesTaggedKeysTogether(t *testing.T) {
+	ring := NewRing([]string{"localhost:31337", "localhost:31338", "localhost:31339"})
+
+	owners := map[uint32]bool{}
+	for i := 0; i < 100; i++ {
+		owners[ring.Owner(string(rune('a'+i%26))+string(rune('0'+i/26)))] = true
+	}
+	if len(owners) < 2 {
+		t.Fatalf("expected the keys to spread over the primaries, got %d", len(owners))
+	}
+
+	owner := ring.Owner("user:{42}:profile")
+	for _, key := range []string{"user:{42}:settings", "{42}", "orders:{42}"} {
+		if ring.Owner(key) != owner {
+			t.Errorf("expected %s to live with user:{42}:profile", key)
+		}
+	}
+}